@@ -0,0 +1,58 @@
+package ipset
+
+import "time"
+
+// Backoff computes the delay before each retry
+type Backoff interface {
+	// Delay returns the bounds of the delay before the retry after the attempt-th attempt (starting at 1).
+	// prev is the delay before the previous retry, or zero before the first retry.
+	// The delay is chosen randomly between min and max, so return the same value as both for a fixed delay
+	Delay(attempt int, prev time.Duration) (min, max time.Duration)
+}
+
+// BackoffFunc is an adapter to use an ordinary function as a Backoff
+type BackoffFunc func(attempt int, prev time.Duration) (min, max time.Duration)
+
+// Delay calls f(attempt, prev)
+func (f BackoffFunc) Delay(attempt int, prev time.Duration) (min, max time.Duration) {
+	return f(attempt, prev)
+}
+
+// ConstantBackoff returns a Backoff whose delay is between base and max on every retry.
+// This is the default strategy
+func ConstantBackoff(base, max time.Duration) Backoff {
+	return BackoffFunc(func(int, time.Duration) (time.Duration, time.Duration) {
+		return base, max
+	})
+}
+
+// ExponentialBackoff returns a Backoff whose delay is between zero and base * 2^(attempt-1), capped at max ("full jitter")
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return BackoffFunc(func(attempt int, _ time.Duration) (time.Duration, time.Duration) {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return 0, d
+	})
+}
+
+// DecorrelatedJitterBackoff returns a Backoff whose delay is between base and three times the previous delay, capped at max
+func DecorrelatedJitterBackoff(base, max time.Duration) Backoff {
+	return BackoffFunc(func(_ int, prev time.Duration) (time.Duration, time.Duration) {
+		if prev < base {
+			prev = base
+		}
+		upper := prev * 3
+		if upper > max {
+			upper = max
+		}
+		if upper < base {
+			upper = base
+		}
+		return base, upper
+	})
+}
@@ -0,0 +1,46 @@
+package ipset
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(100*time.Millisecond, 200*time.Millisecond)
+	for attempt := 1; attempt < 5; attempt++ {
+		min, max := b.Delay(attempt, time.Second)
+		assert.Equal(t, 100*time.Millisecond, min)
+		assert.Equal(t, 200*time.Millisecond, max)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(100*time.Millisecond, time.Second)
+	for attempt, want := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		3:  400 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		60: time.Second,
+	} {
+		min, max := b.Delay(attempt, 0)
+		assert.Equal(t, time.Duration(0), min)
+		assert.Equal(t, want, max, attempt)
+	}
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	b := DecorrelatedJitterBackoff(100*time.Millisecond, time.Second)
+	for prev, want := range map[time.Duration]time.Duration{
+		0:                      300 * time.Millisecond,
+		250 * time.Millisecond: 750 * time.Millisecond,
+		500 * time.Millisecond: time.Second,
+	} {
+		min, max := b.Delay(2, prev)
+		assert.Equal(t, 100*time.Millisecond, min)
+		assert.Equal(t, want, max, prev)
+	}
+}
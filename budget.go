@@ -0,0 +1,64 @@
+package ipset
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget is a budget of retries and time shared by all the retries of an operation,
+// or of all the IP sets of a batch operation such as AppendMany
+type RetryBudget struct {
+	// Retries is the number of retries, on WAFOptimisticLockException and transient errors alike
+	Retries int
+	// Time bounds the time from the start of the operation after which no retry is made. Zero means no bound
+	Time time.Duration
+}
+
+// retryBudget is the RetryBudget left to an operation
+type retryBudget struct {
+	mu      sync.Mutex
+	retries int
+	// deadline is zero if the time is not bounded
+	deadline time.Time
+}
+
+func newRetryBudget(b RetryBudget) *retryBudget {
+	r := &retryBudget{retries: b.Retries}
+	if b.Time > 0 {
+		r.deadline = time.Now().Add(b.Time)
+	}
+	return r
+}
+
+// take consumes a retry made after delay, and reports false without consuming it
+// if no retry is left or the retry would start after the deadline
+func (b *retryBudget) take(delay time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.retries <= 0 || !b.deadline.IsZero() && time.Now().Add(delay).After(b.deadline) {
+		return false
+	}
+	b.retries--
+	return true
+}
+
+// exhausted reports whether the deadline has passed.
+// An operation can still be made without retries left as it may succeed at the first attempt
+func (b *retryBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+// remaining returns the RetryBudget left. The Time is zero if the time is not bounded or the deadline has passed
+func (b *retryBudget) remaining() RetryBudget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := RetryBudget{Retries: b.retries}
+	if !b.deadline.IsZero() {
+		if left := time.Until(b.deadline); left > 0 {
+			r.Time = left
+		}
+	}
+	return r
+}
@@ -0,0 +1,265 @@
+package ipset
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+// idCache caches IP set IDs by scope and name
+type idCache struct {
+	mu      sync.Mutex
+	entries map[string]idCacheEntry
+}
+
+type idCacheEntry struct {
+	id      string
+	expires time.Time
+}
+
+func newIDCache() *idCache {
+	return &idCache{entries: make(map[string]idCacheEntry)}
+}
+
+func (c *idCache) key(scope Scope, name string) string {
+	return string(scope) + "/" + name
+}
+
+func (c *idCache) get(scope Scope, name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[c.key(scope, name)]
+	if !ok || !time.Now().Before(e.expires) {
+		return "", false
+	}
+	return e.id, true
+}
+
+func (c *idCache) set(scope Scope, name, id string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.key(scope, name)] = idCacheEntry{id: id, expires: time.Now().Add(ttl)}
+}
+
+func (c *idCache) delete(scope Scope, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, c.key(scope, name))
+}
+
+// ipSetCache caches the GetIPSet outputs by scope, ID and name
+type ipSetCache struct {
+	mu      sync.Mutex
+	entries map[string]ipSetCacheEntry
+}
+
+type ipSetCacheEntry struct {
+	out     *wafv2.GetIPSetOutput
+	expires time.Time
+}
+
+func newIPSetCache() *ipSetCache {
+	return &ipSetCache{entries: make(map[string]ipSetCacheEntry)}
+}
+
+func (c *ipSetCache) key(scope Scope, ipSetID, ipSetName string) string {
+	return string(scope) + "/" + ipSetID + "/" + ipSetName
+}
+
+// get returns a copy of the cached output, so that the caller can modify its addresses
+func (c *ipSetCache) get(scope Scope, ipSetID, ipSetName string) (*wafv2.GetIPSetOutput, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := c.key(scope, ipSetID, ipSetName)
+	e, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(e.expires) {
+		delete(c.entries, k)
+		return nil, false
+	}
+	return copyGetIPSetOutput(e.out), true
+}
+
+func (c *ipSetCache) set(scope Scope, ipSetID, ipSetName string, out *wafv2.GetIPSetOutput, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.key(scope, ipSetID, ipSetName)] = ipSetCacheEntry{out: copyGetIPSetOutput(out), expires: time.Now().Add(ttl)}
+}
+
+func (c *ipSetCache) delete(scope Scope, ipSetID, ipSetName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, c.key(scope, ipSetID, ipSetName))
+}
+
+func copyGetIPSetOutput(out *wafv2.GetIPSetOutput) *wafv2.GetIPSetOutput {
+	ipSet := *out.IPSet
+	ipSet.Addresses = aws.StringSlice(aws.StringValueSlice(out.IPSet.Addresses))
+	return &wafv2.GetIPSetOutput{IPSet: &ipSet, LockToken: out.LockToken}
+}
+
+// listCache caches the IP set summaries of ListIPSets by scope
+type listCache struct {
+	mu      sync.Mutex
+	entries map[Scope]listCacheEntry
+}
+
+type listCacheEntry struct {
+	ipSets  []IPSetSummary
+	expires time.Time
+}
+
+func newListCache() *listCache {
+	return &listCache{entries: make(map[Scope]listCacheEntry)}
+}
+
+// get returns a copy of the cached summaries, so that the caller can modify them
+func (c *listCache) get(scope Scope) ([]IPSetSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[scope]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(e.expires) {
+		delete(c.entries, scope)
+		return nil, false
+	}
+	return append([]IPSetSummary{}, e.ipSets...), true
+}
+
+func (c *listCache) set(scope Scope, ipSets []IPSetSummary, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[scope] = listCacheEntry{ipSets: append([]IPSetSummary{}, ipSets...), expires: time.Now().Add(ttl)}
+}
+
+func (c *listCache) delete(scope Scope) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, scope)
+}
+
+// quotaCache caches the address limits read by WithMaxAddressesFromQuota by the service and quota codes
+type quotaCache struct {
+	mu      sync.Mutex
+	entries map[string]quotaCacheEntry
+}
+
+type quotaCacheEntry struct {
+	limit   int
+	expires time.Time
+}
+
+func newQuotaCache() *quotaCache {
+	return &quotaCache{entries: make(map[string]quotaCacheEntry)}
+}
+
+func (c *quotaCache) key(serviceCode, quotaCode string) string {
+	return serviceCode + "/" + quotaCode
+}
+
+func (c *quotaCache) get(serviceCode, quotaCode string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[c.key(serviceCode, quotaCode)]
+	if !ok || !time.Now().Before(e.expires) {
+		return 0, false
+	}
+	return e.limit, true
+}
+
+func (c *quotaCache) set(serviceCode, quotaCode string, limit int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.key(serviceCode, quotaCode)] = quotaCacheEntry{limit: limit, expires: time.Now().Add(ttl)}
+}
+
+// recentCache remembers the CIDRs recently appended or removed by the client for WithDedupWindow
+type recentCache struct {
+	mu     sync.Mutex
+	ipSets map[string]*recentIPSet
+}
+
+type recentIPSet struct {
+	// size is the number of addresses after the last recorded operation
+	size  int
+	cidrs map[string]recentEntry
+}
+
+type recentEntry struct {
+	op      string
+	expires time.Time
+}
+
+func newRecentCache() *recentCache {
+	return &recentCache{ipSets: make(map[string]*recentIPSet)}
+}
+
+func (c *recentCache) key(scope Scope, ipSetID, ipSetName string) string {
+	return string(scope) + "/" + ipSetID + "/" + ipSetName
+}
+
+// lookup reports whether op has been applied to all cidrs of the IP set within the window,
+// and returns the number of addresses after the last recorded operation
+func (c *recentCache) lookup(scope Scope, ipSetID, ipSetName, op string, cidrs []string) (int, bool) {
+	if len(cidrs) == 0 {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.ipSets[c.key(scope, ipSetID, ipSetName)]
+	if !ok {
+		return 0, false
+	}
+	now := time.Now()
+	for _, cidr := range cidrs {
+		e, ok := s.cidrs[cidr]
+		if !ok || e.op != op || !now.Before(e.expires) {
+			return 0, false
+		}
+	}
+	return s.size, true
+}
+
+// record remembers that op has been applied to cidrs of the IP set
+func (c *recentCache) record(scope Scope, ipSetID, ipSetName, op string, cidrs []string, size int, window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := c.key(scope, ipSetID, ipSetName)
+	s, ok := c.ipSets[k]
+	if !ok {
+		s = &recentIPSet{cidrs: make(map[string]recentEntry)}
+		c.ipSets[k] = s
+	}
+	now := time.Now()
+	for cidr, e := range s.cidrs {
+		if !now.Before(e.expires) {
+			delete(s.cidrs, cidr)
+		}
+	}
+	s.size = size
+	for _, cidr := range cidrs {
+		s.cidrs[cidr] = recentEntry{op: op, expires: now.Add(window)}
+	}
+}
+
+// forget drops the CIDRs of the IP set remembered by record
+func (c *recentCache) forget(scope Scope, ipSetID, ipSetName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ipSets, c.key(scope, ipSetID, ipSetName))
+}
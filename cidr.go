@@ -0,0 +1,205 @@
+package ipset
+
+import (
+	"net/netip"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// normalizeCIDR returns cidr in the canonical form stored in the IP set.
+// A bare IP address is converted to a CIDR of a single address (/32 for IPv4, /128 for IPv6),
+// the host bits are masked (192.0.2.5/24 becomes 192.0.2.0/24)
+// and IPv6 addresses are formatted in the RFC 5952 form with lower-case hex digits (2001:0DB8:0:0:0:0:0:1/128 becomes 2001:db8::1/128)
+func normalizeCIDR(cidr string) (string, error) {
+	if p, err := netip.ParsePrefix(cidr); err == nil {
+		return p.Masked().String(), nil
+	}
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return "", err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+}
+
+// MinPrefixLength is the shortest prefix length of the addresses of an IP set.
+// WAF supports all the IPv4 and IPv6 CIDRs except /0 in both of the scopes
+const MinPrefixLength = 1
+
+// prefixCIDR returns p in the canonical form stored in the IP set,
+// or an *InvalidCIDRError if p is not valid and a *PrefixLengthError if WAF does not allow its prefix length
+func prefixCIDR(p netip.Prefix) (string, error) {
+	if !p.IsValid() {
+		return "", &InvalidCIDRError{CIDRs: []string{p.String()}}
+	}
+	if p.Bits() < MinPrefixLength {
+		return "", &PrefixLengthError{CIDRs: []string{p.String()}}
+	}
+	return p.Masked().String(), nil
+}
+
+// normalizeCIDRs normalizes all cidrs and returns an *InvalidCIDRError listing every malformed one,
+// or a *PrefixLengthError listing every one whose prefix length WAF does not allow
+func normalizeCIDRs(cidrs []string) ([]string, error) {
+	normalized := make([]string, 0, len(cidrs))
+	var invalid, disallowed []string
+	for _, c := range cidrs {
+		n, err := normalizeCIDR(c)
+		if err != nil {
+			invalid = append(invalid, c)
+			continue
+		}
+		if netip.MustParsePrefix(n).Bits() < MinPrefixLength {
+			disallowed = append(disallowed, c)
+			continue
+		}
+		normalized = append(normalized, n)
+	}
+	if len(invalid) > 0 {
+		return nil, &InvalidCIDRError{CIDRs: invalid}
+	}
+	if len(disallowed) > 0 {
+		return nil, &PrefixLengthError{CIDRs: disallowed}
+	}
+	return normalized, nil
+}
+
+// canonicalAddresses returns the addresses of the IP set in the canonical form, removing equivalent duplicates.
+// Addresses that cannot be parsed are kept as they are
+func canonicalAddresses(addresses []*string) []string {
+	canonical := make([]string, 0, len(addresses))
+	seen := make(map[string]struct{}, len(addresses))
+	for _, a := range addresses {
+		c, err := normalizeCIDR(aws.StringValue(a))
+		if err != nil {
+			c = aws.StringValue(a)
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		canonical = append(canonical, c)
+	}
+	return canonical
+}
+
+// sortCIDRs sorts cidrs by IP address and then by prefix length.
+// IPv4 CIDRs come before IPv6 ones, and CIDRs that cannot be parsed come last in lexical order
+func sortCIDRs(cidrs []string) {
+	sort.SliceStable(cidrs, func(i, j int) bool {
+		pi, erri := netip.ParsePrefix(cidrs[i])
+		pj, errj := netip.ParsePrefix(cidrs[j])
+		switch {
+		case erri != nil && errj != nil:
+			return cidrs[i] < cidrs[j]
+		case erri != nil:
+			return false
+		case errj != nil:
+			return true
+		}
+		if c := pi.Addr().Compare(pj.Addr()); c != 0 {
+			return c < 0
+		}
+		return pi.Bits() < pj.Bits()
+	})
+}
+
+// aggregateCIDRs returns the smallest set of CIDRs covering exactly the same IP addresses as the normalized cidrs.
+// CIDRs contained in another one are removed, and pairs of adjacent CIDRs forming a larger CIDR allowed by WAF are merged into it.
+// The result is sorted as sortCIDRs, and CIDRs that cannot be parsed are kept as they are
+func aggregateCIDRs(cidrs []string) []string {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	var unparsable []string
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			unparsable = append(unparsable, c)
+			continue
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+	// prefixes are sorted so that a prefix comes before the prefixes it contains
+	// and the lower half of a parent comes right before its upper half
+	merged := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if n := len(merged); n > 0 && merged[n-1].Contains(p.Addr()) && merged[n-1].Bits() <= p.Bits() {
+			continue
+		}
+		merged = append(merged, p)
+		for n := len(merged); n >= 2; n = len(merged) {
+			lo, hi := merged[n-2], merged[n-1]
+			// WAF does not allow the CIDRs broader than MinPrefixLength
+			if lo.Bits() != hi.Bits() || lo.Bits() <= MinPrefixLength {
+				break
+			}
+			parent := netip.PrefixFrom(lo.Addr(), lo.Bits()-1).Masked()
+			if parent.Addr() != lo.Addr() || !parent.Contains(hi.Addr()) {
+				break
+			}
+			merged = append(merged[:n-2], parent)
+		}
+	}
+	aggregated := make([]string, 0, len(merged)+len(unparsable))
+	for _, p := range merged {
+		aggregated = append(aggregated, p.String())
+	}
+	sort.Strings(unparsable)
+	return append(aggregated, unparsable...)
+}
+
+// coveringPrefix returns the address that is a broader prefix than cidr and contains it
+func coveringPrefix(addresses []string, cidr string) (string, bool) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", false
+	}
+	for _, a := range addresses {
+		ap, err := netip.ParsePrefix(a)
+		if err != nil {
+			continue
+		}
+		if ap.Bits() < p.Bits() && ap.Contains(p.Addr()) {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// sameCIDRs reports whether a and b have the same CIDRs regardless of the order
+func sameCIDRs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := addressSet(a)
+	for _, c := range b {
+		if _, ok := set[c]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAddressFamily returns an *AddressFamilyMismatchError if any of the normalized cidrs
+// does not match the IP address version of the IP set
+func checkAddressFamily(ipAddressVersion IPAddressVersion, cidrs []string) error {
+	var mismatched []string
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			continue
+		}
+		if (ipAddressVersion == IPv4 && !p.Addr().Is4()) || (ipAddressVersion == IPv6 && !p.Addr().Is6()) {
+			mismatched = append(mismatched, c)
+		}
+	}
+	if len(mismatched) > 0 {
+		return &AddressFamilyMismatchError{IPAddressVersion: ipAddressVersion, CIDRs: mismatched}
+	}
+	return nil
+}
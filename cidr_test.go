@@ -0,0 +1,290 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeCIDRs_Invalid(t *testing.T) {
+	ctx := context.Background()
+	t.Run("single cidr", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		err := AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.256/32")
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.EqualError(t, err, `ipset: invalid cidr: "192.0.2.256/32"`)
+		assert.Equal(t, 0, fake.GetCalls)
+	})
+	t.Run("all invalid cidrs are reported", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		_, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "foo", "192.0.2.2/33", "192.0.2.3/32"})
+		var invalidErr *InvalidCIDRError
+		assert.True(t, errors.As(err, &invalidErr))
+		assert.Equal(t, []string{"foo", "192.0.2.2/33"}, invalidErr.CIDRs)
+		assert.Equal(t, 0, fake.GetCalls)
+	})
+	t.Run("prefix length not allowed by WAF", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		_, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "0.0.0.0/0", "::/0"})
+		var prefixErr *PrefixLengthError
+		if assert.True(t, errors.As(err, &prefixErr)) {
+			assert.Equal(t, []string{"0.0.0.0/0", "::/0"}, prefixErr.CIDRs)
+		}
+		assert.ErrorIs(t, err, ErrInvalidPrefixLength)
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.EqualError(t, err, `ipset: invalid prefix length: "0.0.0.0/0" (allowed /1 to /32), "::/0" (allowed /1 to /128)`)
+		assert.Equal(t, 0, fake.GetCalls)
+
+		err = AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "0.0.0.0/0"})
+		var batchErr *BatchError
+		if assert.True(t, errors.As(err, &batchErr)) {
+			assert.ErrorIs(t, batchErr.Failed["0.0.0.0/0"], ErrInvalidPrefixLength)
+		}
+		assert.ErrorIs(t, AppendPrefix(ctx, aws.StringValue(ipSet.Id), ipSetName, netip.MustParsePrefix("::/0")), ErrInvalidPrefixLength)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestNormalizeCIDR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "203.0.113.7", want: "203.0.113.7/32"},
+		{in: "203.0.113.7/32", want: "203.0.113.7/32"},
+		{in: "203.0.113.0/24", want: "203.0.113.0/24"},
+		{in: "2001:db8::1", want: "2001:db8::1/128"},
+		{in: "2001:db8::/32", want: "2001:db8::/32"},
+		{in: "192.0.2.5/24", want: "192.0.2.0/24"},
+		{in: "2001:0db8:0:0:0:0:0:1", want: "2001:db8::1/128"},
+		{in: "2001:db8::1/32", want: "2001:db8::/32"},
+		{in: "2001:DB8::ABCD", want: "2001:db8::abcd/128"},
+		{in: "2001:Db8:0:0:0:0:0:aBcD/128", want: "2001:db8::abcd/128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := normalizeCIDR(tt.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAppendToIPSet_BareIPAddress(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "203.0.113.7/32")
+	changed, err := AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "203.0.113.7")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "203.0.113.8"))
+	assert.Equal(t, []string{"203.0.113.7/32", "203.0.113.8/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+}
+
+func TestAppendToIPSet_EquivalentCIDR(t *testing.T) {
+	ctx := context.Background()
+	t.Run("equivalent cidr already exists", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.0/24")
+		changed, err := AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.5/24")
+		assert.NoError(t, err)
+		assert.False(t, changed)
+	})
+	t.Run("mixed-case ipv6 cidr already exists", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6", "2001:db8::abcd/128")
+		for _, cidr := range []string{"2001:DB8::ABCD/128", "2001:db8::AbCd", "2001:0DB8:0000::abcd/128"} {
+			changed, err := AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+			assert.NoError(t, err)
+			assert.False(t, changed, cidr)
+		}
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("upper-case ipv6 address in the ip set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6", "2001:DB8::ABCD/128")
+		changed, err := RemoveFromIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "2001:db8::abcd")
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("existing addresses are normalized on update", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6", "2001:0db8:0:0:0:0:0:1/128", "2001:db8::1/128")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "2001:db8::2"))
+		assert.Equal(t, []string{"2001:db8::1/128", "2001:db8::2/128"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestRemoveFromIPSet_EquivalentCIDR(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6", "2001:0db8:0:0:0:0:0:1/128")
+	changed, err := RemoveFromIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "2001:db8::1")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+}
+
+func TestSortCIDRs(t *testing.T) {
+	cidrs := []string{"2001:db8::1/128", "10.0.0.10/32", "foo", "10.0.0.0/8", "10.0.0.2/32", "10.0.0.0/16"}
+	sortCIDRs(cidrs)
+	assert.Equal(t, []string{"10.0.0.0/8", "10.0.0.0/16", "10.0.0.2/32", "10.0.0.10/32", "2001:db8::1/128", "foo"}, cidrs)
+}
+
+func TestAggregateCIDRs(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{name: "adjacent halves", in: []string{"10.0.0.128/25", "10.0.0.0/25"}, want: []string{"10.0.0.0/24"}},
+		{name: "contained", in: []string{"10.0.0.1/32", "10.0.0.0/8", "10.1.0.0/16"}, want: []string{"10.0.0.0/8"}},
+		{name: "cascading merge", in: []string{"192.0.2.0/32", "192.0.2.1/32", "192.0.2.2/31"}, want: []string{"192.0.2.0/30"}},
+		{name: "adjacent but not siblings", in: []string{"10.0.0.128/25", "10.0.1.0/25"}, want: []string{"10.0.0.128/25", "10.0.1.0/25"}},
+		{name: "not adjacent", in: []string{"10.0.0.0/25", "10.0.1.0/25"}, want: []string{"10.0.0.0/25", "10.0.1.0/25"}},
+		{name: "ipv6", in: []string{"2001:db8::/33", "2001:db8:8000::/33", "2001:db8::1/128"}, want: []string{"2001:db8::/32"}},
+		{name: "families are not merged", in: []string{"0.0.0.0/2", "64.0.0.0/2", "::/1"}, want: []string{"0.0.0.0/1", "::/1"}},
+		{name: "not merged into /0", in: []string{"0.0.0.0/1", "128.0.0.0/1"}, want: []string{"0.0.0.0/1", "128.0.0.0/1"}},
+		{name: "unparsable kept", in: []string{"foo", "10.0.0.0/8"}, want: []string{"10.0.0.0/8", "foo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, aggregateCIDRs(tt.in))
+		})
+	}
+}
+
+func TestWithSortedAddresses(t *testing.T) {
+	ctx := context.Background()
+	t.Run("sorted by ip address", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.10/32", "192.0.2.0/24")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"10.0.0.2", "10.0.0.0/24"}, WithSortedAddresses()))
+		assert.Equal(t, []string{"10.0.0.0/24", "10.0.0.2/32", "10.0.0.10/32", "192.0.2.0/24"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("append order by default", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.10/32")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "10.0.0.2"))
+		assert.Equal(t, []string{"10.0.0.10/32", "10.0.0.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestWithAggregation(t *testing.T) {
+	ctx := context.Background()
+	t.Run("append merges with existing addresses", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "198.51.100.1/32", "10.0.0.0/25")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"10.0.0.128/25", "198.51.100.1"}, WithAggregation()))
+		assert.Equal(t, []string{"198.51.100.1/32", "10.0.0.0/24"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("append contained cidr", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "10.1.2.3", WithAggregation()))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/25", "192.0.2.1/32")
+		change, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"10.0.0.0/25", "10.0.0.128/25", "10.0.0.7"}, WithAggregation())
+		assert.NoError(t, err)
+		assert.Equal(t, &Change{Added: []string{"10.0.0.0/24"}, Removed: []string{"10.0.0.0/25", "192.0.2.1/32"}, Size: 1}, change)
+		assert.Equal(t, []string{"10.0.0.0/24"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("the limit is checked after aggregation", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		cidrs := make([]string, 0, MaxAddressesPerIPSet*2)
+		for i := 0; i < MaxAddressesPerIPSet*2; i++ {
+			cidrs = append(cidrs, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+		}
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, cidrs, WithAggregation()))
+		assert.Equal(t, []string{"10.0.0.0/10", "10.64.0.0/13", "10.72.0.0/14", "10.76.0.0/15", "10.78.0.0/19"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestWithCoverCheck(t *testing.T) {
+	ctx := context.Background()
+	t.Run("append covered cidr", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8")
+		changed, err := AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "10.1.2.3", WithCoverCheck())
+		assert.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("append uncovered cidrs only", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"10.1.2.3", "0.0.0.0/1", "192.0.2.1"}, WithCoverCheck()))
+		assert.Equal(t, []string{"10.0.0.0/8", "0.0.0.0/1", "192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("without cover check", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "10.1.2.3"))
+		assert.Equal(t, []string{"10.0.0.0/8", "10.1.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("remove covered cidr", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8", "192.0.2.1/32")
+		err := RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "10.1.2.3"}, WithCoverCheck())
+		var coveredErr *CIDRCoveredError
+		assert.True(t, errors.As(err, &coveredErr))
+		assert.EqualError(t, coveredErr, "ipset: cidr covered by a broader prefix: 10.1.2.3/32 is covered by 10.0.0.0/8")
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("remove exact cidr inside a covering prefix", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8", "10.1.2.3/32")
+		assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "10.1.2.3", WithCoverCheck()))
+		assert.Equal(t, []string{"10.0.0.0/8"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestAddressFamilyMismatch(t *testing.T) {
+	ctx := context.Background()
+	t.Run("ipv6 cidr to ipv4 ip set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "2001:db8::1/128"})
+		var mismatchErr *AddressFamilyMismatchError
+		assert.True(t, errors.As(err, &mismatchErr))
+		assert.EqualError(t, mismatchErr, `ipset: address family mismatch: ip set is IPV4: "2001:db8::1/128"`)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("ipv4 cidr to ipv6 ip set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+		err := RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1/32")
+		var mismatchErr *AddressFamilyMismatchError
+		assert.True(t, errors.As(err, &mismatchErr))
+		assert.Equal(t, IPv6, mismatchErr.IPAddressVersion)
+		assert.Equal(t, []string{"192.0.2.1/32"}, mismatchErr.CIDRs)
+	})
+	t.Run("set and plan", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6", "2001:db8::1/128")
+		_, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"2001:db8::2", "192.0.2.1"})
+		assert.EqualError(t, err, `ipset: address family mismatch: ip set is IPV6: "192.0.2.1/32"`)
+		_, err = Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1"})
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("ipv6 cidr to ipv6 ip set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "2001:db8::1"))
+		assert.Equal(t, []string{"2001:db8::1/128"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
@@ -0,0 +1,997 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
+)
+
+// Client updates WAF IP sets through its WAFV2API
+type Client struct {
+	api      func(scope Scope) (wafv2iface.WAFV2API, error)
+	opts     []Option
+	ids      *idCache
+	ipSets   *ipSetCache
+	lists    *listCache
+	recent   *recentCache
+	quotas   *quotaCache
+	expiries *expiries
+}
+
+// defaultClient is used by the package-level functions. It uses the package-level Session
+var defaultClient = &Client{
+	api: func(scope Scope) (wafv2iface.WAFV2API, error) {
+		if scope == ScopeCloudFront {
+			return newCloudFrontWAFv2()
+		}
+		return newWAFv2()
+	},
+	ids:      newIDCache(),
+	ipSets:   newIPSetCache(),
+	lists:    newListCache(),
+	recent:   newRecentCache(),
+	quotas:   newQuotaCache(),
+	expiries: newExpiries(),
+}
+
+// NewClient creates a new Client using api.
+// opts are applied to every operation of the client and can be overridden per operation.
+// If api is a *wafv2.WAFV2 of a region other than us-east-1, the operations of ScopeCloudFront return ErrCloudFrontRegion
+// instead of the WAFNonexistentItemException returned by WAF. Use NewCloudFrontClient to manage IP sets of ScopeCloudFront
+func NewClient(api wafv2iface.WAFV2API, opts ...Option) *Client {
+	return &Client{
+		api: func(scope Scope) (wafv2iface.WAFV2API, error) {
+			if err := checkCloudFrontRegion(api, scope); err != nil {
+				return nil, err
+			}
+			return api, nil
+		},
+		opts:     opts,
+		ids:      newIDCache(),
+		ipSets:   newIPSetCache(),
+		lists:    newListCache(),
+		recent:   newRecentCache(),
+		quotas:   newQuotaCache(),
+		expiries: newExpiries(),
+	}
+}
+
+// NewCloudFrontClient creates a new Client managing the IP sets of ScopeCloudFront with the WAFV2 client of sess,
+// using CloudFrontRegion regardless of the region of sess
+func NewCloudFrontClient(sess *session.Session, opts ...Option) *Client {
+	return NewClient(wafv2.New(cloudFrontSession(sess)), append([]Option{WithScope(ScopeCloudFront)}, opts...)...)
+}
+
+// checkCloudFrontRegion returns ErrCloudFrontRegion if api is a *wafv2.WAFV2 of a region other than CloudFrontRegion for ScopeCloudFront
+func checkCloudFrontRegion(api wafv2iface.WAFV2API, scope Scope) error {
+	c, ok := api.(*wafv2.WAFV2)
+	if !ok || scope != ScopeCloudFront {
+		return nil
+	}
+	if region := aws.StringValue(c.Client.Config.Region); region != CloudFrontRegion {
+		return fmt.Errorf("%w: the region of the client is %q", ErrCloudFrontRegion, region)
+	}
+	return nil
+}
+
+// options returns the validated options of an operation
+func (c *Client) options(opts []Option) (*options, error) {
+	all := make([]Option, 0, len(c.opts)+len(opts))
+	all = append(all, c.opts...)
+	all = append(all, opts...)
+	o := newOptions(all)
+	if err := o.scope.validate(); err != nil {
+		return nil, err
+	}
+	o.ipSets = c.ipSets
+	return o, nil
+}
+
+func (c *Client) update(ctx context.Context, op string, fn updateIPSetFunc, ipSetID, ipSetName string, cidrs []string, opts []Option) (change *Change, err error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var attempts int
+	ctx, span := startSpan(ctx, o, "ipset."+op,
+		Attribute{Key: "ipset.id", Value: ipSetID},
+		Attribute{Key: "ipset.name", Value: ipSetName},
+		Attribute{Key: "ipset.scope", Value: string(o.scope)},
+	)
+	defer func() {
+		span.End(err)
+		o.metrics.ObserveUpdate(op, attempts, time.Since(start), err)
+		err = withCorrelationID(ctx, err)
+	}()
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	cidrs, err = normalizeCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	dedupWindow := o.dedupWindow > 0 && (op == "append" || op == "remove") && !o.dryRun
+	if dedupWindow {
+		if size, ok := c.recent.lookup(o.scope, ipSetID, ipSetName, op, cidrs); ok {
+			change = &Change{Size: size}
+			if o.onChange != nil {
+				o.onChange(change)
+			}
+			return change, nil
+		}
+	}
+	limit := c.addressLimit(ctx, o)
+	// dedupeFn is fn with the dedupe check, used when WAF rejects an append of a duplicated address
+	dedupe := *o
+	dedupe.noDedupe = false
+	dedupeFn := limitAddresses(updateFuncOf(op, fn, &dedupe), limit)
+	fn = limitAddresses(updateFuncOf(op, fn, o), limit)
+	if op == "append" && o.errorOnDuplicate {
+		dedupeFn = rejectPresent(dedupeFn)
+		fn = rejectPresent(fn)
+	}
+	if op == "remove" && o.errorOnMissing {
+		fn = rejectMissing(fn)
+	}
+	if op != "append" && op != "clear" && o.minAddresses > 0 {
+		fn = guardMinAddresses(fn, o.minAddresses)
+	}
+	if op == "append" && o.maxAddresses > 0 {
+		max := o.maxAddresses
+		if max > limit {
+			max = limit
+		}
+		dedupeFn = capAddresses(dedupeFn, max, o.evict)
+		fn = capAddresses(fn, max, o.evict)
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return nil, err
+	}
+	var deduped bool
+	err = retry(ctx, o, func() (err error) {
+		attempts++
+		ctx, span := o.tracer.Start(ctx, "ipset.attempt", Attribute{Key: "attempt", Value: attempts})
+		defer func() {
+			span.End(err)
+		}()
+		change, err = updateIPSet(ctx, api, o, fn, ipSetID, ipSetName, cidrs)
+		if op == "append" && !deduped && isDuplicateAddressError(err) {
+			// another writer or WithoutDedupeCheck has appended some of the cidrs, so read the IP set again
+			// and append only the missing ones. It is done once so that a persistent rejection is returned,
+			// and counted as a part of the attempt so that the attempts match the ones of RetryEvent
+			deduped = true
+			fn = dedupeFn
+			change, err = updateIPSet(ctx, api, o, fn, ipSetID, ipSetName, cidrs)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if o.verify && !o.dryRun && change.Changed() {
+		if err := verifyChange(ctx, api, o, ipSetID, ipSetName, change); err != nil {
+			return nil, contextError(ctx, err)
+		}
+	}
+	// the CIDRs remembered for WithDedupWindow may have been changed by the operation, e.g. evicted by WithMaxAddresses
+	if !o.dryRun && (op == "append" && len(change.Removed) > 0 || op != "append" && op != "remove" && change.Changed()) {
+		c.recent.forget(o.scope, ipSetID, ipSetName)
+	}
+	if dedupWindow {
+		c.recent.record(o.scope, ipSetID, ipSetName, op, cidrs, change.Size, o.dedupWindow)
+	}
+	if o.onChange != nil {
+		o.onChange(change)
+	}
+	if err := recordMetadata(ctx, o, change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// AppendToIPSet appends cidr to the WAF IP set.
+// No update is made if cidr already exists
+func (c *Client) AppendToIPSet(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) error {
+	_, err := c.AppendToIPSetChanged(ctx, ipSetID, ipSetName, cidr, opts...)
+	return err
+}
+
+// AppendPrefix appends p to the WAF IP set as AppendToIPSet does. The host bits of p are masked
+func (c *Client) AppendPrefix(ctx context.Context, ipSetID, ipSetName string, p netip.Prefix, opts ...Option) error {
+	cidr, err := prefixCIDR(p)
+	if err != nil {
+		return err
+	}
+	return c.AppendToIPSet(ctx, ipSetID, ipSetName, cidr, opts...)
+}
+
+// AppendToIPSetChanged appends cidr to the WAF IP set and reports whether the IP set was modified.
+// It returns false without updating the IP set if cidr already exists
+func (c *Client) AppendToIPSetChanged(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) (bool, error) {
+	change, err := c.update(ctx, "append", appendToIPSet, ipSetID, ipSetName, []string{cidr}, opts)
+	if err != nil {
+		return false, err
+	}
+	return change.Changed(), nil
+}
+
+// AppendIfAbsent appends cidr to the WAF IP set.
+// It returns ErrCIDRAlreadyPresent without updating the IP set if cidr already exists
+func (c *Client) AppendIfAbsent(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) error {
+	changed, err := c.AppendToIPSetChanged(ctx, ipSetID, ipSetName, cidr, opts...)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return fmt.Errorf("%w: %s", ErrCIDRAlreadyPresent, cidr)
+	}
+	return nil
+}
+
+// AppendCIDRs appends all the valid cidrs to the WAF IP set in a single update.
+// CIDRs that already exist in the IP set are skipped, and no update is made if all of them exist.
+// The invalid cidrs, or all of them if the update fails, are reported in a *BatchError
+func (c *Client) AppendCIDRs(ctx context.Context, ipSetID, ipSetName string, cidrs []string, opts ...Option) error {
+	return c.batch(ctx, "append", appendToIPSet, ipSetID, ipSetName, cidrs, validateCIDRs(cidrs), opts)
+}
+
+// AppendToIPSetConcurrent appends many cidrs to the WAF IP set in a single update as AppendCIDRs does,
+// validating and normalizing the cidrs by a pool of concurrency goroutines. A concurrency less than 1 is treated as 1.
+//
+// Only the validation is parallel: the valid cidrs are appended by a single UpdateIPSet retried on WAFOptimisticLockException.
+// All the writers of an IP set compete for the same lock token, so parallel UpdateIPSet calls would mostly fail
+// with WAFOptimisticLockException and multiply the GetIPSet and UpdateIPSet calls, while a single update contends once.
+// The pool pays off for large inputs only, since the validation of a cidr is cheap compared to the goroutines.
+// The invalid cidrs do not prevent the valid ones from being appended, and the failures are reported in a *BatchError
+func (c *Client) AppendToIPSetConcurrent(ctx context.Context, ipSetID, ipSetName string, cidrs []string, concurrency int, opts ...Option) error {
+	return c.batch(ctx, "append", appendToIPSet, ipSetID, ipSetName, cidrs, validateCIDRsConcurrently(cidrs, concurrency), opts)
+}
+
+// batch applies the cidrs without validation errors by a single update of op.
+// It returns a *BatchError reporting the invalid cidrs and, if the update fails, the valid ones
+func (c *Client) batch(ctx context.Context, op string, fn updateIPSetFunc, ipSetID, ipSetName string, cidrs []string, errs []error, opts []Option) error {
+	_, err := c.batchChange(ctx, op, fn, ipSetID, ipSetName, cidrs, errs, opts)
+	return err
+}
+
+// batchChange is batch returning the change of the update too, nil if no update is made or the update fails
+func (c *Client) batchChange(ctx context.Context, op string, fn updateIPSetFunc, ipSetID, ipSetName string, cidrs []string, errs []error, opts []Option) (*Change, error) {
+	applying := make([]string, 0, len(cidrs))
+	failed := make(map[string]error)
+	for i, cidr := range cidrs {
+		if errs[i] == nil {
+			applying = append(applying, cidr)
+		} else {
+			failed[cidr] = errs[i]
+		}
+	}
+	var change *Change
+	var succeeded []string
+	if len(applying) > 0 {
+		var err error
+		if change, err = c.update(ctx, op, fn, ipSetID, ipSetName, applying, opts); err != nil {
+			for _, cidr := range applying {
+				failed[cidr] = err
+			}
+		} else {
+			succeeded = applying
+		}
+	}
+	if len(failed) == 0 {
+		return change, nil
+	}
+	return change, &BatchError{Succeeded: succeeded, Failed: failed}
+}
+
+// validateCIDRs returns the validation error of each of cidrs, or nil for the valid ones
+func validateCIDRs(cidrs []string) []error {
+	errs := make([]error, len(cidrs))
+	for i, cidr := range cidrs {
+		_, errs[i] = normalizeCIDRs([]string{cidr})
+	}
+	return errs
+}
+
+// validateCIDRsConcurrently is validateCIDRs run by concurrency goroutines
+func validateCIDRsConcurrently(cidrs []string, concurrency int) []error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(cidrs) {
+		concurrency = len(cidrs)
+	}
+	errs := make([]error, len(cidrs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				_, errs[i] = normalizeCIDRs([]string{cidrs[i]})
+			}
+		}()
+	}
+	for i := range cidrs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// RemoveFromIPSet removes cidr from the WAF IP set.
+// No update is made if cidr does not exist, so it never competes for the lock token with other writers
+func (c *Client) RemoveFromIPSet(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) error {
+	_, err := c.RemoveFromIPSetChanged(ctx, ipSetID, ipSetName, cidr, opts...)
+	return err
+}
+
+// RemovePrefix removes p from the WAF IP set as RemoveFromIPSet does. The host bits of p are masked
+func (c *Client) RemovePrefix(ctx context.Context, ipSetID, ipSetName string, p netip.Prefix, opts ...Option) error {
+	cidr, err := prefixCIDR(p)
+	if err != nil {
+		return err
+	}
+	return c.RemoveFromIPSet(ctx, ipSetID, ipSetName, cidr, opts...)
+}
+
+// RemoveFromIPSetChanged removes cidr from the WAF IP set and reports whether the IP set was modified.
+// It returns false without updating the IP set if cidr does not exist
+func (c *Client) RemoveFromIPSetChanged(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) (bool, error) {
+	change, err := c.update(ctx, "remove", removeFromIPSet, ipSetID, ipSetName, []string{cidr}, opts)
+	if err != nil {
+		return false, err
+	}
+	return change.Changed(), nil
+}
+
+// RemoveCIDRs removes all the valid cidrs from the WAF IP set in a single update.
+// CIDRs that do not exist in the IP set are ignored, and no update is made if none of them exist.
+// The invalid cidrs, or all of them if the update fails, are reported in a *BatchError
+func (c *Client) RemoveCIDRs(ctx context.Context, ipSetID, ipSetName string, cidrs []string, opts ...Option) error {
+	return c.batch(ctx, "remove", removeFromIPSet, ipSetID, ipSetName, cidrs, validateCIDRs(cidrs), opts)
+}
+
+// MoveCIDR moves cidr from the source IP set to the destination IP set, e.g. from a monitoring IP set to a blocking one.
+// It appends cidr to the destination first and then removes it from the source,
+// so cidr is always in at least one of the IP sets during the move. Both of the updates are retried as usual.
+// It returns a *MoveError reporting which of them failed
+func (c *Client) MoveCIDR(ctx context.Context, fromID, fromName, toID, toName, cidr string, opts ...Option) error {
+	if err := c.AppendToIPSet(ctx, toID, toName, cidr, opts...); err != nil {
+		return &MoveError{Err: err}
+	}
+	if err := c.RemoveFromIPSet(ctx, fromID, fromName, cidr, opts...); err != nil {
+		return &MoveError{Appended: true, Err: err}
+	}
+	return nil
+}
+
+// ApplyChanges appends add to and removes remove from the WAF IP set in a single update,
+// e.g. for an event that blocks some addresses and unblocks others. Both of them are applied again
+// to the addresses read again on WAFOptimisticLockException, so no other writer can interleave between them.
+// A CIDR in both add and remove is removed. No update is made if the IP set already reflects both of them.
+// The returned ChangesResult tells the CIDRs actually appended and removed from the no-ops, e.g. for the audit logs
+func (c *Client) ApplyChanges(ctx context.Context, ipSetID, ipSetName string, add, remove []string, opts ...Option) (*ChangesResult, error) {
+	fn, appending, remove, err := changesFunc(add, remove)
+	if err != nil {
+		return nil, err
+	}
+	change, err := c.update(ctx, "change", fn, ipSetID, ipSetName, append(appending[:len(appending):len(appending)], remove...), opts)
+	if err != nil {
+		return nil, err
+	}
+	return newChangesResult(appending, remove, change), nil
+}
+
+// changesFunc returns the updateIPSetFunc removing remove and then appending the rest of add,
+// and the normalized CIDRs it appends and removes
+func changesFunc(add, remove []string) (fn updateIPSetFunc, appending, removing []string, err error) {
+	add, err = normalizeCIDRs(add)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remove, err = normalizeCIDRs(remove)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	removed := addressSet(remove)
+	appending = make([]string, 0, len(add))
+	for _, a := range add {
+		if _, ok := removed[a]; !ok {
+			appending = append(appending, a)
+		}
+	}
+	fn = func(addresses, _ []string) ([]string, *Change, error) {
+		next, removed, err := removeFromIPSet(addresses, remove)
+		if err != nil {
+			return nil, nil, err
+		}
+		next, added, err := appendToIPSet(next, appending)
+		if err != nil {
+			return nil, nil, err
+		}
+		return next, &Change{Added: added.Added, Removed: removed.Removed}, nil
+	}
+	return fn, appending, remove, nil
+}
+
+// newChangesResult sorts the CIDRs appending and removing by ApplyChanges with the change made
+func newChangesResult(appending, removing []string, change *Change) *ChangesResult {
+	added, removed := addressSet(change.Added), addressSet(change.Removed)
+	seen := make(map[string]struct{}, len(appending)+len(removing))
+	r := &ChangesResult{}
+	for _, a := range appending {
+		if _, ok := seen[a]; ok {
+			continue
+		}
+		seen[a] = struct{}{}
+		if _, ok := added[a]; ok {
+			r.Added = append(r.Added, a)
+		} else {
+			r.AlreadyPresent = append(r.AlreadyPresent, a)
+		}
+	}
+	for _, a := range removing {
+		if _, ok := seen[a]; ok {
+			continue
+		}
+		seen[a] = struct{}{}
+		if _, ok := removed[a]; ok {
+			r.Removed = append(r.Removed, a)
+		} else {
+			r.NotPresent = append(r.NotPresent, a)
+		}
+	}
+	return r
+}
+
+// SetAddresses replaces the addresses of the WAF IP set with cidrs in a single update, and returns the change.
+// No update is made if the IP set already has exactly cidrs
+func (c *Client) SetAddresses(ctx context.Context, ipSetID, ipSetName string, cidrs []string, opts ...Option) (*Change, error) {
+	return c.update(ctx, "set", setAddresses, ipSetID, ipSetName, cidrs, opts)
+}
+
+// AppendWithTTL appends cidr to the WAF IP set and schedules its removal after ttl.
+// The returned cancel cancels the removal, leaving cidr in the IP set; it does nothing once the removal has started.
+// Appending the same CIDR again with AppendWithTTL replaces the scheduled removal, so the CIDR is removed ttl after the last append.
+// If cidr is already in the IP set but not by AppendWithTTL, e.g. as a permanent block, no removal is scheduled
+// so that cidr stays in the IP set, and the returned cancel does nothing.
+// The removal is run by an in-memory timer with opts and context.Background, so it is lost if the process exits before the ttl,
+// and a failure of the removal is not reported. Use a persistent scheduler if the removal must survive restarts
+func (c *Client) AppendWithTTL(ctx context.Context, ipSetID, ipSetName, cidr string, ttl time.Duration, opts ...Option) (cancel func(), err error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	cidrs, err := normalizeCIDRs([]string{cidr})
+	if err != nil {
+		return nil, err
+	}
+	key := c.expiries.key(o.scope, ipSetID, cidrs[0])
+	seq, scheduled, err := c.expiries.reserve(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("ipset: wait for removal: %w", err)
+	}
+	changed, err := c.AppendToIPSetChanged(ctx, ipSetID, ipSetName, cidr, opts...)
+	if err != nil || !changed && !scheduled {
+		c.expiries.release(key, seq)
+		if err != nil {
+			return nil, err
+		}
+		// added by something else than AppendWithTTL, so it is not ours to remove
+		return func() {}, nil
+	}
+	return c.expiries.schedule(key, seq, ttl, func() {
+		_ = c.RemoveFromIPSet(context.Background(), ipSetID, ipSetName, cidr, opts...)
+	}), nil
+}
+
+// Plan computes the change that SetAddresses(desired) would make to the WAF IP set, without updating the IP set.
+// The plan can be reviewed and then applied by Apply
+func (c *Client) Plan(ctx context.Context, ipSetID, ipSetName string, desired []string, opts ...Option) (*ChangePlan, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	fn := updateFuncOf("set", setAddresses, o)
+	change, err := c.update(ctx, "plan", fn, ipSetID, ipSetName, desired, append(opts[:len(opts):len(opts)], WithDryRun()))
+	if err != nil {
+		return nil, err
+	}
+	return &ChangePlan{
+		IPSetID:   ipSetID,
+		IPSetName: ipSetName,
+		Scope:     o.scope,
+		Add:       change.Added,
+		Remove:    change.Removed,
+		Size:      change.Size,
+		fn:        fn,
+		desired:   desired,
+	}, nil
+}
+
+// Apply makes the change of plan to the IP set in a single update.
+// The change is computed again from the current addresses, and Apply returns ErrStalePlan without updating the IP set
+// if it differs from plan because the IP set has been modified since the plan was made
+func (c *Client) Apply(ctx context.Context, plan *ChangePlan, opts ...Option) error {
+	fn := func(addresses, cidrs []string) ([]string, *Change, error) {
+		next, change, err := plan.fn(addresses, cidrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !sameCIDRs(change.Added, plan.Add) || !sameCIDRs(change.Removed, plan.Remove) {
+			return nil, nil, ErrStalePlan
+		}
+		return next, change, nil
+	}
+	_, err := c.update(ctx, "apply", fn, plan.IPSetID, plan.IPSetName, plan.desired, append(opts[:len(opts):len(opts)], WithScope(plan.Scope)))
+	return err
+}
+
+// ClearIPSet removes all the addresses from the WAF IP set in a single update.
+// No update is made if the IP set is already empty
+func (c *Client) ClearIPSet(ctx context.Context, ipSetID, ipSetName string, opts ...Option) error {
+	_, err := c.update(ctx, "clear", setAddresses, ipSetID, ipSetName, nil, opts)
+	return err
+}
+
+// ContainsCIDR reports whether cidr exists in the WAF IP set
+func (c *Client) ContainsCIDR(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) (bool, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return false, err
+	}
+	normalized, err := normalizeCIDRs([]string{cidr})
+	if err != nil {
+		return false, err
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return false, err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range canonicalAddresses(current.IPSet.Addresses) {
+		if a == normalized[0] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListAddresses returns the addresses of the WAF IP set.
+// The addresses are in the canonical form, deduplicated and sorted by IP address
+func (c *Client) ListAddresses(ctx context.Context, ipSetID, ipSetName string, opts ...Option) ([]string, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return nil, err
+	}
+	addresses := canonicalAddresses(current.IPSet.Addresses)
+	sortCIDRs(addresses)
+	return addresses, nil
+}
+
+// DiffIPSets returns the addresses only in the IP set a and the ones only in the IP set b, both of scope,
+// e.g. to compare a staging blocklist with the production one.
+// The addresses are compared in the canonical form and sorted as ListAddresses. The scope of opts is ignored
+func (c *Client) DiffIPSets(ctx context.Context, aID, aName, bID, bName string, scope Scope, opts ...Option) (onlyInA, onlyInB []string, err error) {
+	opts = append(opts[:len(opts):len(opts)], WithScope(scope))
+	a, err := c.ListAddresses(ctx, aID, aName, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := c.ListAddresses(ctx, bID, bName, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	inA, inB := addressSet(a), addressSet(b)
+	for _, x := range a {
+		if _, ok := inB[x]; !ok {
+			onlyInA = append(onlyInA, x)
+		}
+	}
+	for _, x := range b {
+		if _, ok := inA[x]; !ok {
+			onlyInB = append(onlyInB, x)
+		}
+	}
+	return onlyInA, onlyInB, nil
+}
+
+// DescribeIPSet returns the metadata of the WAF IP set
+func (c *Client) DescribeIPSet(ctx context.Context, ipSetID, ipSetName string, opts ...Option) (*IPSetInfo, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return nil, err
+	}
+	return &IPSetInfo{
+		Name:             aws.StringValue(current.IPSet.Name),
+		ID:               aws.StringValue(current.IPSet.Id),
+		ARN:              aws.StringValue(current.IPSet.ARN),
+		IPAddressVersion: IPAddressVersion(aws.StringValue(current.IPSet.IPAddressVersion)),
+		Description:      aws.StringValue(current.IPSet.Description),
+		AddressCount:     len(current.IPSet.Addresses),
+	}, nil
+}
+
+// GetIPSetARN returns the ARN of the WAF IP set in scope, e.g. to reference it in a rule statement.
+// It returns ErrIPSetNotFound if the IP set does not exist
+func (c *Client) GetIPSetARN(ctx context.Context, ipSetID, ipSetName string, scope Scope) (string, error) {
+	o, err := c.options([]Option{WithScope(scope)})
+	if err != nil {
+		return "", err
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return "", err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(current.IPSet.ARN), nil
+}
+
+// Preflight checks that the WAF IP set exists in scope and that the client is allowed to get it,
+// e.g. for a readiness probe. It returns an error matching ErrIPSetNotFound or ErrAccessDenied accordingly.
+// It only reads the IP set, so the permission of UpdateIPSet is not checked unless WithPreflightUpdate is given.
+// The scope of opts is ignored
+func (c *Client) Preflight(ctx context.Context, ipSetID, ipSetName string, scope Scope, opts ...Option) error {
+	o, err := c.options(append(opts[:len(opts):len(opts)], WithScope(scope)))
+	if err != nil {
+		return err
+	}
+	// the IP set must be read from WAF to check the permission
+	o.getCacheTTL = 0
+	api, err := c.api(scope)
+	if err != nil {
+		return err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return fmt.Errorf("ipset: preflight: %w", err)
+	}
+	if !o.preflightUpdate {
+		return nil
+	}
+	in := updateInput(current, scope, aws.StringValueSlice(current.IPSet.Addresses))
+	in.LockToken = aws.String(preflightLockToken)
+	if err := o.wait(ctx); err != nil {
+		return err
+	}
+	spanCtx, span := o.tracer.Start(ctx, "WAFV2.UpdateIPSet")
+	_, err = api.UpdateIPSetWithContext(spanCtx, in, o.requestOptions...)
+	span.End(err)
+	if err != nil && !IsOptimisticLock(err) {
+		return fmt.Errorf("ipset: preflight: update ip set %s: %w", ipSetRef(ipSetID, ipSetName, scope), awsError(err))
+	}
+	return nil
+}
+
+// preflightLockToken is the lock token of the update of Preflight, which is never issued by WAF
+const preflightLockToken = "00000000-0000-0000-0000-000000000000"
+
+// AddressCount returns the number of addresses of the WAF IP set.
+// WAF has no API to count the addresses, so it gets the IP set as ListAddresses does
+func (c *Client) AddressCount(ctx context.Context, ipSetID, ipSetName string, opts ...Option) (int, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return 0, err
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return 0, err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return 0, err
+	}
+	return len(current.IPSet.Addresses), nil
+}
+
+// ListIPSets returns the summaries of all the WAF IP sets in scope, reading all the pages of ListIPSets.
+// With WithListCacheTTL, the summaries are cached by scope and the cache is dropped when the client creates or deletes an IP set.
+// The lock tokens of the cached summaries are outdated by the updates made in the meantime. The scope of opts is ignored
+func (c *Client) ListIPSets(ctx context.Context, scope Scope, opts ...Option) ([]IPSetSummary, error) {
+	o, err := c.options(append(opts[:len(opts):len(opts)], WithScope(scope)))
+	if err != nil {
+		return nil, err
+	}
+	if o.listCacheTTL > 0 {
+		if ipSets, ok := c.lists.get(scope); ok {
+			return ipSets, nil
+		}
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return nil, err
+	}
+	out, err := listIPSets(ctx, api, o)
+	if err != nil {
+		return nil, err
+	}
+	ipSets := make([]IPSetSummary, len(out))
+	for i, s := range out {
+		ipSets[i] = IPSetSummary{
+			Name:        aws.StringValue(s.Name),
+			ID:          aws.StringValue(s.Id),
+			ARN:         aws.StringValue(s.ARN),
+			LockToken:   aws.StringValue(s.LockToken),
+			Description: aws.StringValue(s.Description),
+		}
+	}
+	c.lists.set(scope, ipSets, o.listCacheTTL)
+	return ipSets, nil
+}
+
+// FindIPSetIDByName returns the ID of the WAF IP set named name in scope.
+// It returns ErrIPSetNotFound if there is no such IP set
+func (c *Client) FindIPSetIDByName(ctx context.Context, name string, scope Scope) (string, error) {
+	o, err := c.options([]Option{WithScope(scope)})
+	if err != nil {
+		return "", err
+	}
+	return c.findIPSetID(ctx, o, name)
+}
+
+// findIPSetID returns the ID of the WAF IP set named name in the scope of o
+func (c *Client) findIPSetID(ctx context.Context, o *options, name string) (string, error) {
+	api, err := c.api(o.scope)
+	if err != nil {
+		return "", err
+	}
+	ipSets, err := listIPSets(ctx, api, o)
+	if err != nil {
+		return "", err
+	}
+	for _, is := range ipSets {
+		if aws.StringValue(is.Name) == name {
+			return aws.StringValue(is.Id), nil
+		}
+	}
+	return "", withCorrelationID(ctx, fmt.Errorf("%w: %s (scope=%s)", ErrIPSetNotFound, name, o.scope))
+}
+
+// AppendToIPSetByName appends cidr to the WAF IP set named ipSetName.
+// The IP set ID is resolved by FindIPSetIDByName and cached for the TTL set by WithIDCacheTTL
+func (c *Client) AppendToIPSetByName(ctx context.Context, ipSetName, cidr string, opts ...Option) error {
+	return c.byName(ctx, ipSetName, opts, func(ipSetID string) error {
+		return c.AppendToIPSet(ctx, ipSetID, ipSetName, cidr, opts...)
+	})
+}
+
+// RemoveFromIPSetByName removes cidr from the WAF IP set named ipSetName.
+// The IP set ID is resolved by FindIPSetIDByName and cached for the TTL set by WithIDCacheTTL
+func (c *Client) RemoveFromIPSetByName(ctx context.Context, ipSetName, cidr string, opts ...Option) error {
+	return c.byName(ctx, ipSetName, opts, func(ipSetID string) error {
+		return c.RemoveFromIPSet(ctx, ipSetID, ipSetName, cidr, opts...)
+	})
+}
+
+// byName calls fn with the ID of the IP set named ipSetName.
+// If the cached ID no longer exists, fn is called again with the re-resolved one
+func (c *Client) byName(ctx context.Context, ipSetName string, opts []Option, fn func(ipSetID string) error) error {
+	o, err := c.options(opts)
+	if err != nil {
+		return err
+	}
+	if id, ok := c.ids.get(o.scope, ipSetName); ok {
+		if err := fn(id); !errors.Is(err, ErrIPSetNotFound) {
+			return err
+		}
+		c.ids.delete(o.scope, ipSetName)
+	}
+	id, err := c.findIPSetID(ctx, o, ipSetName)
+	if err != nil {
+		return err
+	}
+	c.ids.set(o.scope, ipSetName, id, o.idCacheTTL)
+	return fn(id)
+}
+
+// contextError makes err also match the error of ctx if ctx is done.
+// The errors of aws-sdk-go caused by the context do not wrap it
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ctx.Err(), err)
+}
+
+// UpdateAddressesWithToken replaces the addresses of the WAF IP set with addresses using lockToken obtained by the caller,
+// and returns the next lock token. It neither reads the IP set nor retries, so callers can implement their own concurrency control.
+// If lockToken is stale, the returned error wraps the *wafv2.WAFOptimisticLockException.
+// Since the IP set is not read, its description cannot be kept as the other operations do:
+// pass WithDescription with the current description (e.g. Snapshot.Description), or the description is reset by WAF.
+// The scope of opts is ignored
+func (c *Client) UpdateAddressesWithToken(ctx context.Context, ipSetID, ipSetName string, scope Scope, lockToken string, addresses []string, opts ...Option) (string, error) {
+	o, err := c.options(append(opts[:len(opts):len(opts)], WithScope(scope)))
+	if err != nil {
+		return "", err
+	}
+	addresses, err = normalizeCIDRs(addresses)
+	if err != nil {
+		return "", err
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return "", err
+	}
+	if err := o.wait(ctx); err != nil {
+		return "", err
+	}
+	in := &wafv2.UpdateIPSetInput{
+		Id:        aws.String(ipSetID),
+		Name:      aws.String(ipSetName),
+		Scope:     aws.String(string(scope)),
+		LockToken: aws.String(lockToken),
+		Addresses: aws.StringSlice(addresses),
+	}
+	if o.description != nil && *o.description != "" {
+		in.Description = o.description
+	}
+	spanCtx, span := o.tracer.Start(ctx, "WAFV2.UpdateIPSet")
+	out, err := api.UpdateIPSetWithContext(spanCtx, in, o.requestOptions...)
+	span.End(err)
+	c.ipSets.delete(scope, ipSetID, ipSetName)
+	if err != nil {
+		return "", withCorrelationID(ctx, fmt.Errorf("ipset: update ip set %s: %w", ipSetRef(ipSetID, ipSetName, scope), awsError(err)))
+	}
+	return aws.StringValue(out.NextLockToken), nil
+}
+
+// EnsureIPSet creates the WAF IP set named name with tags if it does not exist, and returns its ID either way.
+// It is safe to call concurrently: if another caller creates the IP set first, the ID of that IP set is returned
+func (c *Client) EnsureIPSet(ctx context.Context, name string, scope Scope, ipVersion IPAddressVersion, tags map[string]string) (string, error) {
+	if err := ipVersion.validate(); err != nil {
+		return "", err
+	}
+	o, err := c.options([]Option{WithScope(scope)})
+	if err != nil {
+		return "", err
+	}
+	id, err := c.findIPSetID(ctx, o, name)
+	if err == nil || !errors.Is(err, ErrIPSetNotFound) {
+		return id, err
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return "", err
+	}
+	id, err = createIPSet(ctx, api, o, &wafv2.CreateIPSetInput{
+		Addresses:        []*string{},
+		IPAddressVersion: aws.String(string(ipVersion)),
+		Name:             aws.String(name),
+		Scope:            aws.String(string(scope)),
+		Tags:             toTags(tags),
+	})
+	c.lists.delete(scope)
+	if errors.Is(err, ErrIPSetExists) {
+		// created by another caller in the meantime
+		return c.findIPSetID(ctx, o, name)
+	}
+	return id, err
+}
+
+// DeleteIPSet deletes the WAF IP set in scope, reading its current lock token and retrying on WAFOptimisticLockException.
+// It returns ErrIPSetNotFound if the IP set does not exist, which teardown flows can ignore with errors.Is.
+// The scope of opts is ignored
+func (c *Client) DeleteIPSet(ctx context.Context, ipSetID, ipSetName string, scope Scope, opts ...Option) error {
+	o, err := c.options(append(opts[:len(opts):len(opts)], WithScope(scope)))
+	if err != nil {
+		return err
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return err
+	}
+	err = retry(ctx, o, func() error {
+		current, err := getIPSet(ctx, api, o, ipSetID, ipSetName)
+		if err != nil {
+			return err
+		}
+		if err := o.wait(ctx); err != nil {
+			return err
+		}
+		spanCtx, span := o.tracer.Start(ctx, "WAFV2.DeleteIPSet")
+		_, err = api.DeleteIPSetWithContext(spanCtx, &wafv2.DeleteIPSetInput{
+			Id:        aws.String(ipSetID),
+			Name:      aws.String(ipSetName),
+			Scope:     aws.String(string(o.scope)),
+			LockToken: current.LockToken,
+		}, o.requestOptions...)
+		span.End(err)
+		uncacheIPSet(o, ipSetID, ipSetName)
+		c.lists.delete(o.scope)
+		if err != nil {
+			return fmt.Errorf("ipset: delete ip set %s: %w", ipSetRef(ipSetID, ipSetName, o.scope), awsError(err))
+		}
+		return nil
+	})
+	if err != nil {
+		return withCorrelationID(ctx, contextError(ctx, err))
+	}
+	return nil
+}
+
+// CreateIPSet creates the WAF IP set named name with the addresses cidrs, and returns its ID.
+// An empty description leaves the description unset.
+// It returns an *AddressFamilyMismatchError listing the cidrs not of ipVersion without calling WAF,
+// and ErrIPSetExists if an IP set of the same name already exists in scope
+func (c *Client) CreateIPSet(ctx context.Context, name string, scope Scope, ipVersion IPAddressVersion, cidrs []string, description string) (string, error) {
+	o, err := c.options([]Option{WithScope(scope)})
+	if err != nil {
+		return "", err
+	}
+	if err := ipVersion.validate(); err != nil {
+		return "", err
+	}
+	cidrs, err = normalizeCIDRs(cidrs)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAddressFamily(ipVersion, cidrs); err != nil {
+		return "", err
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	addresses, _, err := limitAddresses(appendToIPSet, c.addressLimit(ctx, o))([]string{}, cidrs)
+	if err != nil {
+		return "", err
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return "", err
+	}
+	in := &wafv2.CreateIPSetInput{
+		Addresses:        aws.StringSlice(addresses),
+		IPAddressVersion: aws.String(string(ipVersion)),
+		Name:             aws.String(name),
+		Scope:            aws.String(string(scope)),
+	}
+	if description != "" {
+		in.Description = aws.String(description)
+	}
+	id, err := createIPSet(ctx, api, o, in)
+	c.lists.delete(scope)
+	return id, err
+}
@@ -0,0 +1,137 @@
+package ipset
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	t.Run("append and remove", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr))
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr))
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("client options can be overridden per operation", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		regional := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		cloudFront := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+		c := NewClient(fake, WithScope(ScopeCloudFront))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(cloudFront.Id), ipSetName, cidr))
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeCloudFront, aws.StringValue(cloudFront.Id)))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(regional.Id), ipSetName, cidr, WithScope(ScopeRegional)))
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, aws.StringValue(regional.Id)))
+	})
+}
+
+func TestClient_ByName(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	t.Run("cache ip set id", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake)
+		assert.NoError(t, c.AppendToIPSetByName(ctx, ipSetName, cidr))
+		assert.NoError(t, c.RemoveFromIPSetByName(ctx, ipSetName, cidr))
+		assert.Equal(t, 1, fake.ListCalls)
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("re-resolve ip set id if not found", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		old := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake)
+		assert.NoError(t, c.AppendToIPSetByName(ctx, ipSetName, cidr))
+		// the ip set is re-created with a new id
+		fake.removeIPSet(ScopeRegional, aws.StringValue(old.Id))
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		assert.NoError(t, c.AppendToIPSetByName(ctx, ipSetName, cidr))
+		assert.Equal(t, 2, fake.ListCalls)
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("cache disabled", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithIDCacheTTL(0))
+		assert.NoError(t, c.AppendToIPSetByName(ctx, ipSetName, cidr))
+		assert.NoError(t, c.AppendToIPSetByName(ctx, ipSetName, cidr))
+		assert.Equal(t, 2, fake.ListCalls)
+	})
+	t.Run("ip set not found", func(t *testing.T) {
+		c := NewClient(newFakeWAFV2API())
+		assert.ErrorIs(t, c.AppendToIPSetByName(ctx, ipSetName, cidr), ErrIPSetNotFound)
+	})
+}
+
+func TestSetClientFactory(t *testing.T) {
+	ctx := context.Background()
+	bk, bkCloudFront := newWAFv2, newCloudFrontWAFv2
+	t.Cleanup(func() {
+		newWAFv2, newCloudFrontWAFv2 = bk, bkCloudFront
+	})
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	cfSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+	SetClientFactory(func() wafv2iface.WAFV2API {
+		return fake
+	})
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+	assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(cfSet.Id), ipSetName, "192.0.2.1", WithScope(ScopeCloudFront)))
+	assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeCloudFront, aws.StringValue(cfSet.Id)))
+
+	SetClientFactory(nil)
+	assert.Equal(t, reflect.ValueOf(defaultWAFv2).Pointer(), reflect.ValueOf(newWAFv2).Pointer())
+	assert.Equal(t, reflect.ValueOf(defaultCloudFrontWAFv2).Pointer(), reflect.ValueOf(newCloudFrontWAFv2).Pointer())
+}
+
+func TestCloudFrontRegion(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	sess, err := NewSession(WithRegion("eu-west-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	region := func(t *testing.T, c *Client, scope Scope) string {
+		t.Helper()
+		api, err := c.api(scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aws.StringValue(api.(*wafv2.WAFV2).Client.Config.Region)
+	}
+	t.Run("client of another region", func(t *testing.T) {
+		c := NewClient(wafv2.New(sess))
+		err := c.AppendToIPSet(ctx, "id", ipSetName, "192.0.2.1", WithScope(ScopeCloudFront))
+		assert.ErrorIs(t, err, ErrCloudFrontRegion)
+		assert.EqualError(t, err, `ipset: cloudfront scope requires the us-east-1 region: the region of the client is "eu-west-1"`)
+		assert.Equal(t, "eu-west-1", region(t, c, ScopeRegional))
+	})
+	t.Run("cloudfront client", func(t *testing.T) {
+		assert.Equal(t, CloudFrontRegion, region(t, NewCloudFrontClient(sess), ScopeCloudFront))
+	})
+	t.Run("package-level functions", func(t *testing.T) {
+		resetSession := func() {
+			Session = nil
+			sessionOnce = sync.Once{}
+			sessionErr = nil
+		}
+		resetSession()
+		t.Cleanup(resetSession)
+		Session = sess
+		assert.Equal(t, CloudFrontRegion, region(t, defaultClient, ScopeCloudFront))
+		assert.Equal(t, "eu-west-1", region(t, defaultClient, ScopeRegional))
+	})
+}
@@ -0,0 +1,201 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CoalescingWriter buffers the appends and removes of CIDRs, and applies those of each IP set as one update,
+// flushInterval after the first buffered one or as soon as maxBatch CIDRs are buffered for the IP set.
+// It cuts the GetIPSet and UpdateIPSet calls, and the optimistic lock conflicts, of many goroutines updating the same IP set
+type CoalescingWriter struct {
+	client   *Client
+	interval time.Duration
+	maxBatch int
+	opts     []Option
+
+	mu      sync.Mutex
+	closed  bool
+	batches map[batchKey]*batch
+	// updating serializes the updates of each IP set, so that the batches do not conflict with each other
+	updating map[batchKey]chan struct{}
+	// applying counts the batches being applied
+	applying sync.WaitGroup
+}
+
+type batchKey struct {
+	ipSetID   string
+	ipSetName string
+}
+
+// batch is the buffered changes of an IP set
+type batch struct {
+	// appending maps the buffered CIDRs to true if they are appended and false if removed
+	appending map[string]bool
+	results   []chan error
+	timer     *time.Timer
+}
+
+// NewCoalescingWriter creates a CoalescingWriter updating the IP sets with client.
+// A maxBatch less than 1 does not limit the number of CIDRs of a batch.
+// opts are applied to every update of the writer
+func NewCoalescingWriter(client *Client, flushInterval time.Duration, maxBatch int, opts ...Option) *CoalescingWriter {
+	return &CoalescingWriter{
+		client:   client,
+		interval: flushInterval,
+		maxBatch: maxBatch,
+		opts:     opts,
+		batches:  make(map[batchKey]*batch),
+		updating: make(map[batchKey]chan struct{}),
+	}
+}
+
+// Append buffers the append of cidrs to the WAF IP set. The returned channel receives the result of the update
+// applying them, the error of cidrs if they are invalid, or ErrWriterClosed if the writer is closed.
+// An append buffered after a remove of the same CIDR replaces the remove, and vice versa
+func (w *CoalescingWriter) Append(ipSetID, ipSetName string, cidrs ...string) <-chan error {
+	return w.add(batchKey{ipSetID: ipSetID, ipSetName: ipSetName}, cidrs, true)
+}
+
+// Remove buffers the remove of cidrs from the WAF IP set. The returned channel receives the result of the update
+// applying them, the error of cidrs if they are invalid, or ErrWriterClosed if the writer is closed
+func (w *CoalescingWriter) Remove(ipSetID, ipSetName string, cidrs ...string) <-chan error {
+	return w.add(batchKey{ipSetID: ipSetID, ipSetName: ipSetName}, cidrs, false)
+}
+
+func (w *CoalescingWriter) add(key batchKey, cidrs []string, appending bool) <-chan error {
+	result := make(chan error, 1)
+	cidrs, err := normalizeCIDRs(cidrs)
+	if err != nil {
+		result <- err
+		return result
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		result <- ErrWriterClosed
+		return result
+	}
+	b, ok := w.batches[key]
+	if !ok {
+		b = &batch{appending: make(map[string]bool)}
+		w.batches[key] = b
+		b.timer = time.AfterFunc(w.interval, func() {
+			if w.take(key, b) {
+				w.apply(context.Background(), key, b)
+			}
+		})
+	}
+	for _, cidr := range cidrs {
+		b.appending[cidr] = appending
+	}
+	b.results = append(b.results, result)
+	if w.maxBatch > 0 && len(b.appending) >= w.maxBatch {
+		b.timer.Stop()
+		delete(w.batches, key)
+		w.applying.Add(1)
+		go w.apply(context.Background(), key, b)
+	}
+	return result
+}
+
+// Flush applies all the buffered changes, and waits for them and the updates in progress
+// until they are done or ctx is done. The channels of the buffered changes receive the results as usual.
+// It returns the errors of the buffered changes joined, or the error of ctx
+func (w *CoalescingWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	batches := w.batches
+	w.batches = make(map[batchKey]*batch)
+	for _, b := range batches {
+		b.timer.Stop()
+	}
+	w.applying.Add(len(batches))
+	w.mu.Unlock()
+
+	errs := make(chan error, len(batches))
+	for key, b := range batches {
+		key, b := key, b
+		go func() {
+			errs <- w.apply(ctx, key, b)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		w.applying.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var err error
+	for range batches {
+		err = errors.Join(err, <-errs)
+	}
+	return err
+}
+
+// Close stops the writer from buffering changes, and then flushes it as Flush does.
+// The appends and removes after Close receive ErrWriterClosed
+func (w *CoalescingWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return w.Flush(ctx)
+}
+
+// take removes b from the buffered batches, and reports whether it was still buffered
+func (w *CoalescingWriter) take(key batchKey, b *batch) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.batches[key] != b {
+		return false
+	}
+	delete(w.batches, key)
+	w.applying.Add(1)
+	return true
+}
+
+// apply updates the IP set of key with b, sends the result to the channels of b and returns it.
+// The caller must have added b to w.applying
+func (w *CoalescingWriter) apply(ctx context.Context, key batchKey, b *batch) (err error) {
+	defer w.applying.Done()
+	defer func() {
+		for _, result := range b.results {
+			result <- err
+		}
+	}()
+	w.mu.Lock()
+	updating, ok := w.updating[key]
+	if !ok {
+		updating = make(chan struct{}, 1)
+		w.updating[key] = updating
+	}
+	w.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case updating <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-updating }()
+
+	var add, remove []string
+	for cidr, appending := range b.appending {
+		if appending {
+			add = append(add, cidr)
+		} else {
+			remove = append(remove, cidr)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+	_, err = w.client.ApplyChanges(ctx, key.ipSetID, key.ipSetName, add, remove, w.opts...)
+	return err
+}
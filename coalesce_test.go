@@ -0,0 +1,157 @@
+package ipset
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kei2100/idempotent-aws-waf-ipset/ipsettest"
+)
+
+func TestCoalescingWriter(t *testing.T) {
+	t.Run("merged update", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		w := NewCoalescingWriter(NewClient(fake), 20*time.Millisecond, 0)
+		var results []<-chan error
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for i := 2; i <= 9; i++ {
+			cidr := "192.0.2." + strconv.Itoa(i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result := w.Append(aws.StringValue(ipSet.Id), ipSetName, cidr)
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		results = append(results, w.Remove(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		for _, result := range results {
+			assert.NoError(t, <-result)
+		}
+		assert.Len(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)), 8)
+		assert.NotContains(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)), "192.0.2.1/32")
+		assert.Equal(t, 1, fake.GetCalls)
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("the last one wins", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		w := NewCoalescingWriter(NewClient(fake), 10*time.Millisecond, 0)
+		r1 := w.Remove(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		r2 := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1/32", "192.0.2.2")
+		r3 := w.Remove(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2")
+		assert.NoError(t, <-r1)
+		assert.NoError(t, <-r2)
+		assert.NoError(t, <-r3)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("max batch", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		w := NewCoalescingWriter(NewClient(fake), time.Hour, 2)
+		r1 := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		r2 := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2")
+		assert.NoError(t, <-r1)
+		assert.NoError(t, <-r2)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("ip sets are batched separately", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		a := fake.addIPSet(ScopeRegional, "a", "IPV4")
+		b := fake.addIPSet(ScopeRegional, "b", "IPV4")
+		w := NewCoalescingWriter(NewClient(fake), 10*time.Millisecond, 0)
+		ra := w.Append(aws.StringValue(a.Id), "a", "192.0.2.1")
+		rb := w.Append(aws.StringValue(b.Id), "b", "192.0.2.2")
+		assert.NoError(t, <-ra)
+		assert.NoError(t, <-rb)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(a.Id)))
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(b.Id)))
+	})
+	t.Run("invalid cidr", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		w := NewCoalescingWriter(NewClient(fake), 10*time.Millisecond, 0)
+		assert.ErrorIs(t, <-w.Append(aws.StringValue(ipSet.Id), ipSetName, "foo"), ErrInvalidCIDR)
+		assert.Empty(t, w.batches)
+	})
+	t.Run("update error", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+		w := NewCoalescingWriter(NewClient(fake), 10*time.Millisecond, 0)
+		r1 := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		r2 := w.Append(aws.StringValue(ipSet.Id), ipSetName, "2001:db8::1")
+		// the whole batch fails
+		assert.ErrorIs(t, <-r1, ErrAddressFamilyMismatch)
+		assert.ErrorIs(t, <-r2, ErrAddressFamilyMismatch)
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("flush", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		a := fake.addIPSet(ScopeRegional, "a", "IPV4")
+		b := fake.addIPSet(ScopeRegional, "b", "IPV6")
+		w := NewCoalescingWriter(NewClient(fake), time.Hour, 0)
+		ra := w.Append(aws.StringValue(a.Id), "a", "192.0.2.1")
+		rb := w.Append(aws.StringValue(b.Id), "b", "192.0.2.2")
+		err := w.Flush(context.Background())
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		assert.NoError(t, <-ra)
+		assert.ErrorIs(t, <-rb, ErrAddressFamilyMismatch)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(a.Id)))
+		// the writer keeps buffering after Flush
+		assert.NoError(t, w.Flush(context.Background()))
+		ra = w.Append(aws.StringValue(a.Id), "a", "192.0.2.3")
+		assert.NoError(t, w.Flush(context.Background()))
+		assert.NoError(t, <-ra)
+		assert.Equal(t, 2, fake.UpdateCalls)
+	})
+	t.Run("close", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		w := NewCoalescingWriter(NewClient(fake), time.Hour, 0)
+		r := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.NoError(t, w.Close(context.Background()))
+		assert.NoError(t, <-r)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.ErrorIs(t, <-w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2"), ErrWriterClosed)
+		assert.ErrorIs(t, <-w.Remove(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"), ErrWriterClosed)
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("close waits for the update in progress", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		updating := make(chan struct{})
+		fake.BeforeUpdate = func(*ipsettest.IPSet) {
+			close(updating)
+			time.Sleep(20 * time.Millisecond)
+		}
+		w := NewCoalescingWriter(NewClient(fake), time.Hour, 1)
+		r := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		<-updating
+		assert.NoError(t, w.Close(context.Background()))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.NoError(t, <-r)
+	})
+	t.Run("close with canceled context", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		w := NewCoalescingWriter(NewClient(fake), time.Hour, 0)
+		r := w.Append(aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, w.Close(ctx), context.Canceled)
+		// the pending append is resolved with the error of ctx
+		assert.ErrorIs(t, <-r, context.Canceled)
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
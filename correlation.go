@@ -0,0 +1,52 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type correlationIDKey struct{}
+
+// ContextWithCorrelationID returns a copy of ctx carrying id, e.g. the ID of the request that triggered a block.
+// The operations given the returned context report id in the CorrelationID of their RetryEvents
+// and append it to the messages of their errors, so that a change of an IP set can be traced back to its origin
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation ID set by ContextWithCorrelationID, and whether it is set
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// correlationError appends the correlation ID of the operation to the message of Err
+type correlationError struct {
+	id  string
+	err error
+}
+
+func (e *correlationError) Error() string {
+	return fmt.Sprintf("%v (correlation_id=%s)", e.err, e.id)
+}
+
+func (e *correlationError) Unwrap() error {
+	return e.err
+}
+
+// withCorrelationID adds the correlation ID of ctx to err if ctx has one and err does not have it yet
+func withCorrelationID(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	id, ok := CorrelationIDFromContext(ctx)
+	if !ok {
+		return err
+	}
+	var corrErr *correlationError
+	if errors.As(err, &corrErr) {
+		return err
+	}
+	return &correlationError{id: id, err: err}
+}
@@ -0,0 +1,61 @@
+package ipset
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextWithCorrelationID(t *testing.T) {
+	ctx := ContextWithCorrelationID(context.Background(), "req-1")
+	t.Run("from context", func(t *testing.T) {
+		id, ok := CorrelationIDFromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "req-1", id)
+		_, ok = CorrelationIDFromContext(context.Background())
+		assert.False(t, ok)
+		_, ok = CorrelationIDFromContext(ContextWithCorrelationID(ctx, ""))
+		assert.False(t, ok)
+	})
+	t.Run("errors", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+		c := NewClient(fake)
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		assert.True(t, strings.HasSuffix(err.Error(), " (correlation_id=req-1)"), err.Error())
+
+		// added once, by the innermost operation
+		_, _, err = c.DiffIPSets(ctx, aws.StringValue(ipSet.Id), ipSetName, "no-such-id", "other", ScopeRegional)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.Equal(t, 1, strings.Count(err.Error(), "correlation_id=req-1"), err.Error())
+
+		_, err = c.FindIPSetIDByName(ctx, "other", ScopeRegional)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.ErrorContains(t, err, "(correlation_id=req-1)")
+
+		// without a correlation ID, the errors are unchanged
+		err = c.AppendToIPSet(context.Background(), aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.NotContains(t, err.Error(), "correlation_id")
+	})
+	t.Run("logger", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeUpdate = fake.ConcurrentWrite(1)
+		var events []RetryEvent
+		c := NewClient(fake,
+			WithBackoff(ConstantBackoff(time.Millisecond, time.Millisecond)),
+			WithLogger(func(e RetryEvent) {
+				events = append(events, e)
+			}),
+		)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, "req-1", events[0].CorrelationID)
+		}
+	})
+}
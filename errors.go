@@ -0,0 +1,504 @@
+package ipset
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+// ErrIPSetNotFound is returned when the IP set does not exist.
+// It also matches the WAFNonexistentItemException returned by AWS
+var ErrIPSetNotFound = errors.New("ipset: ip set not found")
+
+// ErrIPSetExists is returned when creating an IP set whose name is already used in the scope.
+// It also matches the WAFDuplicateItemException returned by AWS
+var ErrIPSetExists = errors.New("ipset: ip set already exists")
+
+// ErrAccessDenied is returned when the credentials are not allowed to call the WAFV2 API.
+// It also matches the AccessDeniedException returned by AWS
+var ErrAccessDenied = errors.New("ipset: access denied")
+
+// ErrCloudFrontRegion is returned when an IP set of ScopeCloudFront is managed by a client of a region other than CloudFrontRegion
+var ErrCloudFrontRegion = errors.New("ipset: cloudfront scope requires the " + CloudFrontRegion + " region")
+
+// ErrStalePlan is returned by Apply when the IP set has been modified since the ChangePlan was made
+var ErrStalePlan = errors.New("ipset: stale plan: ip set has been modified since the plan was made")
+
+// ErrSnapshotDrift is returned by ApplyDelta when the IP set has been modified since the snapshot
+// and the update could not be made
+var ErrSnapshotDrift = errors.New("ipset: ip set has drifted since the snapshot")
+
+// ErrWriterClosed is received by the appends and removes of a CoalescingWriter after it is closed
+var ErrWriterClosed = errors.New("ipset: coalescing writer closed")
+
+// ErrOptimisticLockExhausted is the error that OptimisticLockExhaustedError matches with errors.Is
+var ErrOptimisticLockExhausted = errors.New("ipset: optimistic lock retries exhausted")
+
+// OptimisticLockExhaustedError is returned when the update still fails with WAFOptimisticLockException
+// after all the attempts of the RetryConfig
+type OptimisticLockExhaustedError struct {
+	// Attempts is the number of attempts made
+	Attempts int
+	// Err is the error of the last attempt
+	Err error
+}
+
+func (e *OptimisticLockExhaustedError) Error() string {
+	return fmt.Sprintf("ipset: optimistic lock retries exhausted after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Is reports whether target is ErrOptimisticLockExhausted
+func (e *OptimisticLockExhaustedError) Is(target error) bool {
+	return target == ErrOptimisticLockExhausted
+}
+
+func (e *OptimisticLockExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// ErrRetryBudgetExhausted is the error that RetryBudgetExhaustedError matches with errors.Is
+var ErrRetryBudgetExhausted = errors.New("ipset: retry budget exhausted")
+
+// RetryBudgetExhaustedError is returned when an operation runs out of the RetryBudget of WithRetryBudget
+type RetryBudgetExhaustedError struct {
+	// Err is the error of the last attempt, or nil if the operation was not started
+	Err error
+}
+
+func (e *RetryBudgetExhaustedError) Error() string {
+	if e.Err == nil {
+		return "ipset: retry budget exhausted: not started"
+	}
+	return fmt.Sprintf("ipset: retry budget exhausted: %v", e.Err)
+}
+
+// Is reports whether target is ErrRetryBudgetExhausted
+func (e *RetryBudgetExhaustedError) Is(target error) bool {
+	return target == ErrRetryBudgetExhausted
+}
+
+func (e *RetryBudgetExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// ipSetRef identifies the IP set in the error messages, such as "block-prod" (id=abc, scope=REGIONAL),
+// so that the errors of an operation on many IP sets tell which of them failed
+func ipSetRef(ipSetID, ipSetName string, scope Scope) string {
+	return fmt.Sprintf("%q (id=%s, scope=%s)", ipSetName, ipSetID, scope)
+}
+
+// errCodeAccessDenied is the error code returned by AWS when the IAM policy does not allow the call
+const errCodeAccessDenied = "AccessDeniedException"
+
+// awsError makes err returned by the WAFV2 API also match the corresponding error of this package,
+// keeping the original error available to errors.As
+func awsError(err error) error {
+	var notFound *wafv2.WAFNonexistentItemException
+	if errors.As(err, &notFound) {
+		return &mappedError{target: ErrIPSetNotFound, err: err}
+	}
+	var duplicate *wafv2.WAFDuplicateItemException
+	if errors.As(err, &duplicate) {
+		return &mappedError{target: ErrIPSetExists, err: err}
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == errCodeAccessDenied {
+		return &mappedError{target: ErrAccessDenied, err: err}
+	}
+	return err
+}
+
+// isDuplicateAddressError reports whether err is the WAFInvalidParameterException returned by WAF
+// when the addresses of an update have a duplicate, i.e. the field is IP_ADDRESS and the reason is a duplicate value.
+// The message is checked only if the response lacks the Field and Reason members
+func isDuplicateAddressError(err error) bool {
+	var invalid *wafv2.WAFInvalidParameterException
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	if invalid.Field != nil || invalid.Reason != nil {
+		return aws.StringValue(invalid.Field) == wafv2.ParameterExceptionFieldIpAddress &&
+			strings.Contains(strings.ToLower(aws.StringValue(invalid.Reason)), "duplicate")
+	}
+	// e.g. "Error reason: Duplicate value found., field: IP_ADDRESS"
+	msg := strings.ToLower(invalid.Message())
+	return strings.Contains(msg, "duplicate") && strings.Contains(msg, "field: "+strings.ToLower(wafv2.ParameterExceptionFieldIpAddress))
+}
+
+type mappedError struct {
+	target error
+	err    error
+}
+
+func (e *mappedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mappedError) Unwrap() []error {
+	return []error{e.target, e.err}
+}
+
+// ErrCIDRAlreadyPresent is returned by AppendIfAbsent and by the append operations with WithErrorOnDuplicate
+// when the CIDR already exists in the IP set
+var ErrCIDRAlreadyPresent = errors.New("ipset: cidr already present")
+
+// ErrCIDRNotPresent is returned by the remove operations with WithErrorOnMissing when the CIDR does not exist in the IP set
+var ErrCIDRNotPresent = errors.New("ipset: cidr not present")
+
+// ErrInvalidCIDR is the error that InvalidCIDRError matches with errors.Is
+var ErrInvalidCIDR = errors.New("ipset: invalid cidr")
+
+// InvalidCIDRError is returned when the given CIDRs are malformed
+type InvalidCIDRError struct {
+	// CIDRs are all the malformed CIDRs in the input
+	CIDRs []string
+}
+
+func (e *InvalidCIDRError) Error() string {
+	quoted := make([]string, len(e.CIDRs))
+	for i, c := range e.CIDRs {
+		quoted[i] = fmt.Sprintf("%q", c)
+	}
+	return fmt.Sprintf("ipset: invalid cidr: %s", strings.Join(quoted, ", "))
+}
+
+// Is reports whether target is ErrInvalidCIDR
+func (e *InvalidCIDRError) Is(target error) bool {
+	return target == ErrInvalidCIDR
+}
+
+// ErrInvalidPrefixLength is the error that PrefixLengthError matches with errors.Is
+var ErrInvalidPrefixLength = errors.New("ipset: invalid prefix length")
+
+// PrefixLengthError is returned when the prefix lengths of the given CIDRs are not allowed by WAF.
+// It matches ErrInvalidCIDR too with errors.Is
+type PrefixLengthError struct {
+	// CIDRs are all the CIDRs with a disallowed prefix length in the input
+	CIDRs []string
+}
+
+func (e *PrefixLengthError) Error() string {
+	details := make([]string, len(e.CIDRs))
+	for i, c := range e.CIDRs {
+		max := 32
+		if p, err := netip.ParsePrefix(c); err == nil && p.Addr().Is6() {
+			max = 128
+		}
+		details[i] = fmt.Sprintf("%q (allowed /%d to /%d)", c, MinPrefixLength, max)
+	}
+	return fmt.Sprintf("ipset: invalid prefix length: %s", strings.Join(details, ", "))
+}
+
+// Is reports whether target is ErrInvalidPrefixLength or ErrInvalidCIDR
+func (e *PrefixLengthError) Is(target error) bool {
+	return target == ErrInvalidPrefixLength || target == ErrInvalidCIDR
+}
+
+// ErrAddressFamilyMismatch is the error that AddressFamilyMismatchError matches with errors.Is
+var ErrAddressFamilyMismatch = errors.New("ipset: address family mismatch")
+
+// AddressFamilyMismatchError is returned when the given CIDRs do not match the IP address version of the IP set
+type AddressFamilyMismatchError struct {
+	// IPAddressVersion is the IP address version of the IP set
+	IPAddressVersion IPAddressVersion
+	// CIDRs are all the CIDRs that do not match IPAddressVersion
+	CIDRs []string
+}
+
+func (e *AddressFamilyMismatchError) Error() string {
+	quoted := make([]string, len(e.CIDRs))
+	for i, c := range e.CIDRs {
+		quoted[i] = fmt.Sprintf("%q", c)
+	}
+	return fmt.Sprintf("ipset: address family mismatch: ip set is %s: %s", e.IPAddressVersion, strings.Join(quoted, ", "))
+}
+
+// Is reports whether target is ErrAddressFamilyMismatch
+func (e *AddressFamilyMismatchError) Is(target error) bool {
+	return target == ErrAddressFamilyMismatch
+}
+
+// ImportError is returned by ImportAddresses when lines of the input are not valid CIDRs.
+// It matches ErrInvalidCIDR with errors.Is
+type ImportError struct {
+	// Lines are the numbers of the invalid lines, starting at 1
+	Lines []int
+	// CIDRs are the invalid CIDRs of Lines
+	CIDRs []string
+}
+
+func (e *ImportError) Error() string {
+	lines := make([]string, len(e.Lines))
+	for i, n := range e.Lines {
+		lines[i] = fmt.Sprintf("line %d: %q", n, e.CIDRs[i])
+	}
+	return fmt.Sprintf("ipset: invalid cidr: %s", strings.Join(lines, ", "))
+}
+
+// Is reports whether target is ErrInvalidCIDR
+func (e *ImportError) Is(target error) bool {
+	return target == ErrInvalidCIDR
+}
+
+// ErrIPSetFull is the error that IPSetFullError matches with errors.Is
+var ErrIPSetFull = errors.New("ipset: ip set is full")
+
+// IPSetFullError is returned when appending would exceed the maximum number of addresses in an IP set
+type IPSetFullError struct {
+	// Size is the current number of addresses in the IP set
+	Size int
+	// Limit is the maximum number of addresses in the IP set
+	Limit int
+	// Appending is the number of addresses that were going to be appended
+	Appending int
+}
+
+func (e *IPSetFullError) Error() string {
+	return fmt.Sprintf("ipset: ip set is full: appending %d addresses to %d exceeds the limit of %d (%d more fit)",
+		e.Appending, e.Size, e.Limit, e.Available())
+}
+
+// Available returns how many more addresses fit in the IP set
+func (e *IPSetFullError) Available() int {
+	if e.Limit < e.Size {
+		return 0
+	}
+	return e.Limit - e.Size
+}
+
+// Is reports whether target is ErrIPSetFull
+func (e *IPSetFullError) Is(target error) bool {
+	return target == ErrIPSetFull
+}
+
+// ErrWouldUnderflow is the error that UnderflowError matches with errors.Is
+var ErrWouldUnderflow = errors.New("ipset: ip set would underflow")
+
+// UnderflowError is returned with WithMinAddresses when an update would leave less addresses in the IP set than the minimum
+type UnderflowError struct {
+	// Size is the current number of addresses in the IP set
+	Size int
+	// Min is the minimum number of addresses of WithMinAddresses
+	Min int
+	// Removing is the number of addresses that were going to be removed
+	Removing int
+}
+
+func (e *UnderflowError) Error() string {
+	return fmt.Sprintf("ipset: ip set would underflow: removing %d of %d addresses goes below the minimum of %d", e.Removing, e.Size, e.Min)
+}
+
+// Is reports whether target is ErrWouldUnderflow
+func (e *UnderflowError) Is(target error) bool {
+	return target == ErrWouldUnderflow
+}
+
+// ErrCIDRCovered is the error that CIDRCoveredError matches with errors.Is
+var ErrCIDRCovered = errors.New("ipset: cidr covered by a broader prefix")
+
+// CIDRCoveredError is returned by the remove operations with WithCoverCheck
+// when a CIDR is not in the IP set by itself but covered by a broader prefix of the IP set
+type CIDRCoveredError struct {
+	// CIDR is the CIDR that was going to be removed
+	CIDR string
+	// CoveredBy is the prefix of the IP set that covers CIDR
+	CoveredBy string
+}
+
+func (e *CIDRCoveredError) Error() string {
+	return fmt.Sprintf("ipset: cidr covered by a broader prefix: %s is covered by %s", e.CIDR, e.CoveredBy)
+}
+
+// Is reports whether target is ErrCIDRCovered
+func (e *CIDRCoveredError) Is(target error) bool {
+	return target == ErrCIDRCovered
+}
+
+// MoveError is returned by MoveCIDR when one of its updates fails
+type MoveError struct {
+	// Appended reports whether the CIDR has been appended to the destination IP set.
+	// If true, the removal from the source IP set failed and the CIDR is in both of the IP sets
+	Appended bool
+	// Err is the error of the failed update
+	Err error
+}
+
+func (e *MoveError) Error() string {
+	if e.Appended {
+		return fmt.Sprintf("ipset: move cidr: remove from source: %v", e.Err)
+	}
+	return fmt.Sprintf("ipset: move cidr: append to destination: %v", e.Err)
+}
+
+func (e *MoveError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by the batch operations such as AppendCIDRs when some of the CIDRs fail.
+// It unwraps to the errors of all the failed CIDRs
+type BatchError struct {
+	// Succeeded are the CIDRs applied to the IP set, including the ones the IP set already had
+	Succeeded []string
+	// Failed maps the failed CIDRs to their errors
+	Failed map[string]error
+}
+
+func (e *BatchError) Error() string {
+	cidrs := e.failedCIDRs()
+	msg := fmt.Sprintf("ipset: %d of %d cidrs failed: %s: %v", len(cidrs), len(cidrs)+len(e.Succeeded), cidrs[0], e.Failed[cidrs[0]])
+	if len(cidrs) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(cidrs)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the failed CIDRs
+func (e *BatchError) Unwrap() []error {
+	cidrs := e.failedCIDRs()
+	errs := make([]error, len(cidrs))
+	for i, c := range cidrs {
+		errs[i] = e.Failed[c]
+	}
+	return errs
+}
+
+func (e *BatchError) failedCIDRs() []string {
+	cidrs := make([]string, 0, len(e.Failed))
+	for c := range e.Failed {
+		cidrs = append(cidrs, c)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// MultiError is returned by MultiClient when some of the targets fail.
+// It unwraps to the errors of all the failed targets
+type MultiError struct {
+	// Succeeded are the targets updated successfully, in no particular order
+	Succeeded []Target
+	// Failed maps the failed targets to their errors
+	Failed map[Target]error
+}
+
+func (e *MultiError) Error() string {
+	targets := e.FailedTargets()
+	msg := fmt.Sprintf("ipset: %d of %d targets failed: %s: %v", len(targets), len(targets)+len(e.Succeeded), targets[0], e.Failed[targets[0]])
+	if len(targets) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(targets)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the failed targets
+func (e *MultiError) Unwrap() []error {
+	targets := e.FailedTargets()
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		errs[i] = e.Failed[t]
+	}
+	return errs
+}
+
+// FailedTargets returns the failed targets sorted by Target.String, to retry them with NewMultiClient
+func (e *MultiError) FailedTargets() []Target {
+	targets := make([]Target, 0, len(e.Failed))
+	for t := range e.Failed {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].String() < targets[j].String()
+	})
+	return targets
+}
+
+// ManyError is returned by AppendMany when some of the IP sets fail, summarizing the failures of its ManyResult.
+// It unwraps to the errors of all the failed IP sets
+type ManyError struct {
+	// Succeeded are the IP sets updated successfully, in the order of their first entries
+	Succeeded []IPSetKey
+	// Failed maps the failed IP sets to their errors
+	Failed map[IPSetKey]error
+}
+
+func (e *ManyError) Error() string {
+	keys := e.FailedIPSets()
+	msg := fmt.Sprintf("ipset: %d of %d ip sets failed: %s: %v", len(keys), len(keys)+len(e.Succeeded), keys[0], e.Failed[keys[0]])
+	if len(keys) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(keys)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the failed IP sets
+func (e *ManyError) Unwrap() []error {
+	keys := e.FailedIPSets()
+	errs := make([]error, len(keys))
+	for i, k := range keys {
+		errs[i] = e.Failed[k]
+	}
+	return errs
+}
+
+// FailedIPSets returns the failed IP sets sorted by IPSetKey.String
+func (e *ManyError) FailedIPSets() []IPSetKey {
+	keys := make([]IPSetKey, 0, len(e.Failed))
+	for k := range e.Failed {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// ErrVerificationFailed is the error that VerificationError matches with errors.Is
+var ErrVerificationFailed = errors.New("ipset: verification failed")
+
+// VerificationError is returned with WithVerify when the IP set read after the update does not reflect the change
+type VerificationError struct {
+	// Missing are the added addresses not found in the IP set
+	Missing []string
+	// Unexpected are the removed addresses still found in the IP set
+	Unexpected []string
+}
+
+func (e *VerificationError) Error() string {
+	var details []string
+	if len(e.Missing) > 0 {
+		details = append(details, fmt.Sprintf("missing %s", strings.Join(e.Missing, ", ")))
+	}
+	if len(e.Unexpected) > 0 {
+		details = append(details, fmt.Sprintf("unexpected %s", strings.Join(e.Unexpected, ", ")))
+	}
+	return fmt.Sprintf("ipset: verification failed: %s", strings.Join(details, "; "))
+}
+
+// Is reports whether target is ErrVerificationFailed
+func (e *VerificationError) Is(target error) bool {
+	return target == ErrVerificationFailed
+}
+
+// MetadataError is returned with a required MetadataStore when it fails to record some of the changed addresses.
+// The IP set has been updated, and it unwraps to the errors of the store
+type MetadataError struct {
+	Errs []error
+}
+
+func (e *MetadataError) Error() string {
+	msg := e.Errs[0].Error()
+	if len(e.Errs) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Errs)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the store
+func (e *MetadataError) Unwrap() []error {
+	return e.Errs
+}
@@ -0,0 +1,62 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrIPSetNotFound(t *testing.T) {
+	ctx := context.Background()
+	useFakeWAFV2API(t)
+	err := AppendToIPSet(ctx, "no-such-id", ipSetName, "192.0.2.44/32")
+	assert.ErrorIs(t, err, ErrIPSetNotFound)
+	var notFound *wafv2.WAFNonexistentItemException
+	assert.True(t, errors.As(err, &notFound))
+	assert.EqualError(t, err, `ipset: get ip set "`+ipSetName+`" (id=no-such-id, scope=REGIONAL): WAFNonexistentItemException: ip set not found`)
+}
+
+func TestErrorMessages(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+	ref := `"` + ipSetName + `" (id=` + aws.StringValue(ipSet.Id) + `, scope=CLOUDFRONT)`
+	t.Run("update", func(t *testing.T) {
+		c := NewClient(&deniedAPI{fakeWAFV2API: fake, update: true}, WithScope(ScopeCloudFront))
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.EqualError(t, err, "ipset: update ip set "+ref+": "+accessDenied.Error())
+		assert.ErrorIs(t, err, ErrAccessDenied)
+	})
+	t.Run("delete", func(t *testing.T) {
+		c := NewClient(&deniedAPI{fakeWAFV2API: fake, get: true})
+		err := c.DeleteIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeCloudFront)
+		assert.EqualError(t, err, "ipset: get ip set "+ref+": "+accessDenied.Error())
+	})
+	t.Run("create", func(t *testing.T) {
+		_, err := NewClient(fake).CreateIPSet(ctx, ipSetName, ScopeCloudFront, IPv4, nil, "")
+		assert.ErrorIs(t, err, ErrIPSetExists)
+		assert.ErrorContains(t, err, `ipset: create ip set "`+ipSetName+`" (scope=CLOUDFRONT): `)
+	})
+}
+
+func TestErrOptimisticLockExhausted(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	fake.BeforeUpdate = fake.ConcurrentWrite(100)
+	c := NewClient(fake, WithRetryConfig(RetryConfig{MaxAttempts: 2}))
+	err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32")
+	assert.ErrorIs(t, err, ErrOptimisticLockExhausted)
+	var exhaustedErr *OptimisticLockExhaustedError
+	assert.True(t, errors.As(err, &exhaustedErr))
+	assert.Equal(t, 2, exhaustedErr.Attempts)
+	var lockErr *wafv2.WAFOptimisticLockException
+	assert.True(t, errors.As(err, &lockErr))
+	// a single lock error is not ErrOptimisticLockExhausted
+	fake.BeforeUpdate = fake.ConcurrentWrite(1)
+	assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32"))
+}
@@ -0,0 +1,111 @@
+package ipset
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// expiries holds the removals scheduled by AppendWithTTL, keyed by the scope, the IP set and the CIDR
+type expiries struct {
+	mu      sync.Mutex
+	seq     int
+	entries map[string]*expiry
+}
+
+type expiry struct {
+	// seq identifies the AppendWithTTL call owning the entry
+	seq   int
+	timer *time.Timer
+	// removing is closed when the removal in progress finishes
+	removing chan struct{}
+}
+
+func newExpiries() *expiries {
+	return &expiries{entries: make(map[string]*expiry)}
+}
+
+func (e *expiries) key(scope Scope, ipSetID, cidr string) string {
+	return string(scope) + "/" + ipSetID + "/" + cidr
+}
+
+// reserve cancels the removal scheduled for key, waits for the removal of key in progress,
+// and returns the sequence number to schedule the next removal of key with.
+// scheduled reports whether a removal was scheduled for key
+func (e *expiries) reserve(ctx context.Context, key string) (seq int, scheduled bool, err error) {
+	e.mu.Lock()
+	e.seq++
+	seq = e.seq
+	x, ok := e.entries[key]
+	if !ok {
+		x = &expiry{}
+		e.entries[key] = x
+	}
+	if x.timer != nil {
+		x.timer.Stop()
+		x.timer = nil
+		scheduled = true
+	}
+	x.seq = seq
+	removing := x.removing
+	e.mu.Unlock()
+	if removing != nil {
+		select {
+		case <-removing:
+		case <-ctx.Done():
+			e.release(key, seq)
+			return 0, false, ctx.Err()
+		}
+	}
+	return seq, scheduled, nil
+}
+
+// release drops the entry of key reserved with seq if no removal is scheduled
+func (e *expiries) release(key string, seq int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if x, ok := e.entries[key]; ok && x.seq == seq && x.timer == nil && x.removing == nil {
+		delete(e.entries, key)
+	}
+}
+
+// schedule calls remove after ttl unless key is reserved again or the returned cancel is called before
+func (e *expiries) schedule(key string, seq int, ttl time.Duration, remove func()) (cancel func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	x, ok := e.entries[key]
+	if !ok || x.seq != seq {
+		// superseded by a later AppendWithTTL
+		return func() {}
+	}
+	x.timer = time.AfterFunc(ttl, func() {
+		e.mu.Lock()
+		if x.seq != seq || x.timer == nil {
+			e.mu.Unlock()
+			return
+		}
+		x.timer = nil
+		done := make(chan struct{})
+		x.removing = done
+		e.mu.Unlock()
+
+		remove()
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		x.removing = nil
+		close(done)
+		if x.seq == seq {
+			delete(e.entries, key)
+		}
+	})
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if x.seq == seq && x.timer != nil {
+			x.timer.Stop()
+			x.timer = nil
+			delete(e.entries, key)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package ipset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendWithTTL(t *testing.T) {
+	ctx := context.Background()
+	t.Run("removed after ttl", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(fake)
+		_, err := c.AppendWithTTL(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", 10*time.Millisecond)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Eventually(t, func() bool {
+			return len(fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id))) == 1
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("canceled", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake)
+		cancel, err := c.AppendWithTTL(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", 10*time.Millisecond)
+		assert.NoError(t, err)
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("the last append wins", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake)
+		cancel1, err := c.AppendWithTTL(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", 10*time.Millisecond)
+		assert.NoError(t, err)
+		// the same CIDR in another form
+		cancel2, err := c.AppendWithTTL(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2/32", time.Hour)
+		assert.NoError(t, err)
+		t.Cleanup(cancel2)
+		// the first removal and its cancel are superseded
+		cancel1()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Len(t, c.expiries.entries, 1)
+	})
+	t.Run("already in the ip set", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(fake)
+		cancel, err := c.AppendWithTTL(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", 10*time.Millisecond)
+		assert.NoError(t, err)
+		cancel()
+		assert.Empty(t, c.expiries.entries)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("append error", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+		c := NewClient(fake)
+		_, err := c.AppendWithTTL(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", time.Hour)
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		assert.Empty(t, c.expiries.entries)
+	})
+}
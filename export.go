@@ -0,0 +1,241 @@
+package ipset
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+// ExportAddresses writes the addresses of the WAF IP set to w, one CIDR per line.
+// The addresses are in the order of ListAddresses
+func (c *Client) ExportAddresses(ctx context.Context, ipSetID, ipSetName string, w io.Writer, opts ...Option) error {
+	addresses, err := c.ListAddresses(ctx, ipSetID, ipSetName, opts...)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, a := range addresses {
+		bw.WriteString(a)
+		bw.WriteByte('\n')
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("ipset: write addresses: %w", err)
+	}
+	return nil
+}
+
+// ExportMatching returns the addresses of all the WAF IP sets in scope whose names start with namePrefix, keyed by the name.
+// The addresses are in the order of ListAddresses, and an empty namePrefix matches all the IP sets of scope.
+// The scope of opts is ignored
+func (c *Client) ExportMatching(ctx context.Context, namePrefix string, scope Scope, opts ...Option) (map[string][]string, error) {
+	opts = append(opts[:len(opts):len(opts)], WithScope(scope))
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return nil, err
+	}
+	ipSets, err := listIPSets(ctx, api, o)
+	if err != nil {
+		return nil, err
+	}
+	exported := make(map[string][]string)
+	for _, is := range ipSets {
+		name := aws.StringValue(is.Name)
+		if !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+		addresses, err := c.ListAddresses(ctx, aws.StringValue(is.Id), name, opts...)
+		if err != nil {
+			return nil, err
+		}
+		exported[name] = addresses
+	}
+	return exported, nil
+}
+
+// ImportAddresses reads CIDRs from r, one per line, and appends them to the WAF IP set in a single update,
+// or replaces all the addresses of the IP set with them if replace is true.
+// Blank lines and lines starting with # are ignored. If any line is not a valid CIDR,
+// it returns an *ImportError reporting all the invalid lines without updating the IP set
+func (c *Client) ImportAddresses(ctx context.Context, ipSetID, ipSetName string, r io.Reader, replace bool, opts ...Option) error {
+	cidrs, err := readCIDRs(r)
+	if err != nil {
+		return err
+	}
+	if replace {
+		_, err := c.SetAddresses(ctx, ipSetID, ipSetName, cidrs, opts...)
+		return err
+	}
+	return c.AppendCIDRs(ctx, ipSetID, ipSetName, cidrs, opts...)
+}
+
+// readCIDRs reads the CIDRs of the lines of r, reporting the invalid lines by an *ImportError
+func readCIDRs(r io.Reader) ([]string, error) {
+	var cidrs []string
+	invalid := &ImportError{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := normalizeCIDRs([]string{line}); err != nil {
+			invalid.Lines = append(invalid.Lines, n)
+			invalid.CIDRs = append(invalid.CIDRs, line)
+			continue
+		}
+		cidrs = append(cidrs, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("ipset: read addresses: %w", err)
+	}
+	if len(invalid.Lines) > 0 {
+		return nil, invalid
+	}
+	return cidrs, nil
+}
+
+// Snapshot is the state of an IP set at a point in time, captured by CaptureSnapshot
+type Snapshot struct {
+	Name             string           `json:"name"`
+	ID               string           `json:"id"`
+	Scope            Scope            `json:"scope"`
+	IPAddressVersion IPAddressVersion `json:"ip_address_version"`
+	// Description is the description of the IP set, empty if it has none
+	Description string `json:"description,omitempty"`
+	// Addresses are in the order of ListAddresses
+	Addresses []string `json:"addresses"`
+	// LockToken is the lock token of the IP set at the capture
+	LockToken  string    `json:"lock_token"`
+	CapturedAt time.Time `json:"captured_at"`
+}
+
+// CaptureSnapshot returns the current state of the WAF IP set
+func (c *Client) CaptureSnapshot(ctx context.Context, ipSetID, ipSetName string, opts ...Option) (*Snapshot, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	api, err := c.api(o.scope)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return nil, err
+	}
+	addresses := canonicalAddresses(current.IPSet.Addresses)
+	sortCIDRs(addresses)
+	return &Snapshot{
+		Name:             aws.StringValue(current.IPSet.Name),
+		ID:               aws.StringValue(current.IPSet.Id),
+		Scope:            o.scope,
+		IPAddressVersion: IPAddressVersion(aws.StringValue(current.IPSet.IPAddressVersion)),
+		Description:      aws.StringValue(current.IPSet.Description),
+		Addresses:        append([]string{}, addresses...),
+		LockToken:        aws.StringValue(current.LockToken),
+		CapturedAt:       time.Now(),
+	}, nil
+}
+
+// CopyIPSet copies the addresses of the source IP set to the destination IP set, both of scope,
+// e.g. to seed the blocklist of a new environment. If replace is true, the addresses of the destination are replaced
+// by SetAddresses, and otherwise the addresses of the source are appended to the destination, keeping its own ones.
+// It returns an error matching ErrAddressFamilyMismatch if the IP address versions of the IP sets differ.
+// The scope of opts is ignored
+func (c *Client) CopyIPSet(ctx context.Context, srcID, srcName, dstID, dstName string, scope Scope, replace bool, opts ...Option) error {
+	opts = append(opts[:len(opts):len(opts)], WithScope(scope))
+	o, err := c.options(opts)
+	if err != nil {
+		return err
+	}
+	api, err := c.api(scope)
+	if err != nil {
+		return err
+	}
+	src, err := readIPSet(ctx, api, o, srcID, srcName)
+	if err != nil {
+		return err
+	}
+	dst, err := readIPSet(ctx, api, o, dstID, dstName)
+	if err != nil {
+		return err
+	}
+	srcVersion, dstVersion := aws.StringValue(src.IPSet.IPAddressVersion), aws.StringValue(dst.IPSet.IPAddressVersion)
+	if srcVersion != dstVersion {
+		return fmt.Errorf("%w: copying the %s ip set %q to the %s ip set %q", ErrAddressFamilyMismatch, srcVersion, srcName, dstVersion, dstName)
+	}
+	addresses := canonicalAddresses(src.IPSet.Addresses)
+	if replace {
+		_, err = c.SetAddresses(ctx, dstID, dstName, addresses, opts...)
+		return err
+	}
+	_, err = c.update(ctx, "append", appendToIPSet, dstID, dstName, addresses, opts)
+	return err
+}
+
+// ApplyDelta updates the IP set of prev to desired by appending and removing only the difference between prev and desired.
+// The first attempt uses the addresses and the lock token of prev without reading the IP set,
+// which is a single UpdateIPSet call if the IP set has not been modified since prev was captured.
+// If it has drifted, the update fails with WAFOptimisticLockException and the difference is applied
+// to the addresses read again, keeping the changes made by others since prev.
+// Pass WithRetryConfig(RetryConfig{MaxAttempts: 1}) to fail on the drift instead.
+// ApplyDelta returns an error matching ErrSnapshotDrift when the IP set has drifted and all the attempts have failed
+func (c *Client) ApplyDelta(ctx context.Context, prev *Snapshot, desired []string, opts ...Option) error {
+	desired, err := normalizeCIDRs(desired)
+	if err != nil {
+		return err
+	}
+	var add, remove []string
+	previous := addressSet(prev.Addresses)
+	for _, d := range desired {
+		if _, ok := previous[d]; !ok {
+			add = append(add, d)
+		}
+	}
+	wanted := addressSet(desired)
+	for _, p := range prev.Addresses {
+		if _, ok := wanted[p]; !ok {
+			remove = append(remove, p)
+		}
+	}
+	fn, appending, remove, err := changesFunc(add, remove)
+	if err != nil {
+		return err
+	}
+	cidrs := append(appending[:len(appending):len(appending)], remove...)
+	prefetched := &wafv2.GetIPSetOutput{
+		IPSet: &wafv2.IPSet{
+			Id:               aws.String(prev.ID),
+			Name:             aws.String(prev.Name),
+			IPAddressVersion: aws.String(string(prev.IPAddressVersion)),
+			Addresses:        aws.StringSlice(prev.Addresses),
+		},
+		LockToken: aws.String(prev.LockToken),
+	}
+	if prev.Description != "" {
+		prefetched.IPSet.Description = aws.String(prev.Description)
+	}
+	_, err = c.update(ctx, "delta", fn, prev.ID, prev.Name, cidrs, append(opts[:len(opts):len(opts)], WithScope(prev.Scope), withPrefetched(prefetched)))
+	if errors.Is(err, ErrOptimisticLockExhausted) {
+		return fmt.Errorf("%w: %w", ErrSnapshotDrift, err)
+	}
+	return err
+}
+
+// RestoreSnapshot replaces all the addresses of the IP set of snap with the addresses of snap by SetAddresses.
+// The IP set is updated even if it has been modified since the capture, and the lock token of snap is not used
+func (c *Client) RestoreSnapshot(ctx context.Context, snap *Snapshot, opts ...Option) error {
+	_, err := c.SetAddresses(ctx, snap.ID, snap.Name, snap.Addresses, append(opts[:len(opts):len(opts)], WithScope(snap.Scope))...)
+	return err
+}
@@ -0,0 +1,200 @@
+package ipset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportAddresses(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.10/32", "192.0.2.2/32")
+	var buf bytes.Buffer
+	assert.NoError(t, ExportAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, &buf))
+	assert.Equal(t, "192.0.2.2/32\n192.0.2.10/32\n", buf.String())
+	t.Run("empty", func(t *testing.T) {
+		ipSet := fake.addIPSet(ScopeRegional, "empty", "IPV4")
+		var buf bytes.Buffer
+		assert.NoError(t, ExportAddresses(ctx, aws.StringValue(ipSet.Id), "empty", &buf))
+		assert.Empty(t, buf.String())
+	})
+}
+
+func TestExportMatching(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	want := make(map[string][]string)
+	// more than a page of ListIPSets
+	for i := 0; i < 120; i++ {
+		name := fmt.Sprintf("block-team%03d-prod", i)
+		fake.addIPSet(ScopeRegional, name, "IPV4", fmt.Sprintf("192.0.2.%d/32", i))
+		want[name] = []string{fmt.Sprintf("192.0.2.%d/32", i)}
+	}
+	fake.addIPSet(ScopeRegional, "block-team000-staging", "IPV4", "198.51.100.10/32", "198.51.100.2/32")
+	want["block-team000-staging"] = []string{"198.51.100.2/32", "198.51.100.10/32"}
+	fake.addIPSet(ScopeRegional, "allow-team000-prod", "IPV4")
+	fake.addIPSet(ScopeCloudFront, "block-cloudfront", "IPV4")
+
+	exported, err := ExportMatching(ctx, "block-", ScopeRegional)
+	assert.NoError(t, err)
+	assert.Equal(t, want, exported)
+	assert.Equal(t, 2, fake.ListCalls)
+
+	t.Run("no match", func(t *testing.T) {
+		exported, err := ExportMatching(ctx, "deny-", ScopeRegional)
+		assert.NoError(t, err)
+		assert.Empty(t, exported)
+	})
+}
+
+func TestCopyIPSet(t *testing.T) {
+	ctx := context.Background()
+	t.Run("merge", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		src := fake.addIPSet(ScopeRegional, "prod", "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		dst := fake.addIPSet(ScopeRegional, "staging", "IPV4", "192.0.2.2/32", "198.51.100.1/32")
+		assert.NoError(t, CopyIPSet(ctx, aws.StringValue(src.Id), "prod", aws.StringValue(dst.Id), "staging", ScopeRegional, false))
+		assert.Equal(t, []string{"192.0.2.2/32", "198.51.100.1/32", "192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(dst.Id)))
+		// copying again is a no-op
+		assert.NoError(t, CopyIPSet(ctx, aws.StringValue(src.Id), "prod", aws.StringValue(dst.Id), "staging", ScopeRegional, false))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("replace", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		src := fake.addIPSet(ScopeCloudFront, "prod", "IPV6", "2001:db8::1/128")
+		dst := fake.addIPSet(ScopeCloudFront, "staging", "IPV6", "2001:db8::2/128")
+		assert.NoError(t, CopyIPSet(ctx, aws.StringValue(src.Id), "prod", aws.StringValue(dst.Id), "staging", ScopeCloudFront, true))
+		assert.Equal(t, []string{"2001:db8::1/128"}, fake.addresses(ScopeCloudFront, aws.StringValue(dst.Id)))
+	})
+	t.Run("address family mismatch", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		src := fake.addIPSet(ScopeRegional, "prod", "IPV4")
+		dst := fake.addIPSet(ScopeRegional, "staging", "IPV6")
+		err := CopyIPSet(ctx, aws.StringValue(src.Id), "prod", aws.StringValue(dst.Id), "staging", ScopeRegional, true)
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		assert.EqualError(t, err, `ipset: address family mismatch: copying the IPV4 ip set "prod" to the IPV6 ip set "staging"`)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+}
+
+func TestApplyDelta(t *testing.T) {
+	ctx := context.Background()
+	t.Run("not modified since the snapshot", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		fake.ipSet(ScopeCloudFront, aws.StringValue(ipSet.Id)).IPSet.Description = aws.String("blocklist")
+		prev, err := CaptureSnapshot(ctx, aws.StringValue(ipSet.Id), ipSetName, WithScope(ScopeCloudFront))
+		assert.NoError(t, err)
+		assert.NoError(t, ApplyDelta(ctx, prev, []string{"192.0.2.2", "192.0.2.3"}))
+		assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeCloudFront, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, "blocklist", aws.StringValue(fake.ipSet(ScopeCloudFront, aws.StringValue(ipSet.Id)).IPSet.Description))
+		assert.Equal(t, 1, fake.GetCalls, "only by CaptureSnapshot")
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("drifted", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		prev, err := CaptureSnapshot(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.NoError(t, err)
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "198.51.100.1"))
+		assert.NoError(t, ApplyDelta(ctx, prev, []string{"192.0.2.2", "192.0.2.3"}))
+		// the address appended by another writer is kept
+		assert.Equal(t, []string{"192.0.2.2/32", "198.51.100.1/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		// the append, the update with the lock token of prev, and the one after reading the IP set again
+		assert.Equal(t, 3, fake.UpdateCalls)
+	})
+	t.Run("fail on drift", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		prev, err := CaptureSnapshot(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.NoError(t, err)
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "198.51.100.1"))
+		err = ApplyDelta(ctx, prev, []string{"192.0.2.3"}, WithRetryConfig(RetryConfig{MaxAttempts: 1}))
+		assert.ErrorIs(t, err, ErrSnapshotDrift)
+		assert.ErrorIs(t, err, ErrOptimisticLockExhausted)
+		assert.Equal(t, []string{"192.0.2.1/32", "198.51.100.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestImportAddresses(t *testing.T) {
+	ctx := context.Background()
+	input := "# blocklist\n192.0.2.2\n\n  198.51.100.0/24  \n"
+	t.Run("merge", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, ImportAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, strings.NewReader(input), false))
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32", "198.51.100.0/24"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("replace", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, ImportAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, strings.NewReader(input), true))
+		assert.Equal(t, []string{"192.0.2.2/32", "198.51.100.0/24"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("round trip", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		src := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "198.51.100.0/24")
+		dst := fake.addIPSet(ScopeRegional, "restored", "IPV4")
+		var buf bytes.Buffer
+		assert.NoError(t, ExportAddresses(ctx, aws.StringValue(src.Id), ipSetName, &buf))
+		assert.NoError(t, ImportAddresses(ctx, aws.StringValue(dst.Id), "restored", &buf, true))
+		assert.Equal(t, fake.addresses(ScopeRegional, aws.StringValue(src.Id)), fake.addresses(ScopeRegional, aws.StringValue(dst.Id)))
+	})
+	t.Run("invalid lines", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		err := ImportAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, strings.NewReader("192.0.2.1\nnot-a-cidr\n192.0.2.0/33\n"), false)
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		var importErr *ImportError
+		if assert.True(t, errors.As(err, &importErr)) {
+			assert.Equal(t, []int{2, 3}, importErr.Lines)
+		}
+		assert.EqualError(t, err, `ipset: invalid cidr: line 2: "not-a-cidr", line 3: "192.0.2.0/33"`)
+		assert.Equal(t, 0, fake.GetCalls)
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4", "192.0.2.10/32", "192.0.2.2/32")
+	snap, err := CaptureSnapshot(ctx, aws.StringValue(ipSet.Id), ipSetName, WithScope(ScopeCloudFront))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ipSetName, snap.Name)
+	assert.Equal(t, aws.StringValue(ipSet.Id), snap.ID)
+	assert.Equal(t, ScopeCloudFront, snap.Scope)
+	assert.Equal(t, IPv4, snap.IPAddressVersion)
+	assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.10/32"}, snap.Addresses)
+	assert.Equal(t, fake.ipSet(ScopeCloudFront, aws.StringValue(ipSet.Id)).LockToken, snap.LockToken)
+	assert.False(t, snap.CapturedAt.IsZero())
+
+	b, err := json.Marshal(snap)
+	assert.NoError(t, err)
+	var decoded Snapshot
+	assert.NoError(t, json.Unmarshal(b, &decoded))
+	assert.True(t, snap.CapturedAt.Equal(decoded.CapturedAt))
+	decoded.CapturedAt = snap.CapturedAt
+	assert.Equal(t, *snap, decoded)
+
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "198.51.100.1", WithScope(ScopeCloudFront)))
+	assert.NoError(t, RestoreSnapshot(ctx, &decoded))
+	assert.Equal(t, []string{"192.0.2.10/32", "192.0.2.2/32"}, fake.addresses(ScopeCloudFront, aws.StringValue(ipSet.Id)))
+	t.Run("empty ip set", func(t *testing.T) {
+		ipSet := fake.addIPSet(ScopeRegional, "empty", "IPV6")
+		snap, err := CaptureSnapshot(ctx, aws.StringValue(ipSet.Id), "empty")
+		assert.NoError(t, err)
+		b, err := json.Marshal(snap)
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), `"addresses":[]`)
+	})
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,107 +15,777 @@ import (
 	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
 )
 
-var newWAFv2 = func() wafv2iface.WAFV2API {
-	return wafv2.New(Session)
+// MaxAddressesPerIPSet is the maximum number of addresses in a WAF IP set.
+// It is the limit of the IP sets unless WithMaxAddressesFromQuota is given
+const MaxAddressesPerIPSet = 10000
+
+var (
+	newWAFv2           = defaultWAFv2
+	newCloudFrontWAFv2 = defaultCloudFrontWAFv2
+)
+
+func defaultWAFv2() (wafv2iface.WAFV2API, error) {
+	sess, err := defaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return wafv2.New(sess), nil
+}
+
+// defaultCloudFrontWAFv2 returns the WAFV2API of the Session for ScopeCloudFront, which is always of CloudFrontRegion
+func defaultCloudFrontWAFv2() (wafv2iface.WAFV2API, error) {
+	sess, err := defaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return wafv2.New(cloudFrontSession(sess)), nil
 }
 
-var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+// SetClientFactory sets the function creating the WAFV2API used by the package-level functions,
+// e.g. to use a mock or a client of another endpoint. The factory is used for all the scopes,
+// so it must return a client of CloudFrontRegion to use ScopeCloudFront.
+// A nil factory restores the default using Session, which uses CloudFrontRegion for ScopeCloudFront regardless of the region of Session.
+// It is not safe to call concurrently with the package-level functions
+func SetClientFactory(factory func() wafv2iface.WAFV2API) {
+	if factory == nil {
+		newWAFv2 = defaultWAFv2
+		newCloudFrontWAFv2 = defaultCloudFrontWAFv2
+		return
+	}
+	newWAFv2 = func() (wafv2iface.WAFV2API, error) {
+		return factory(), nil
+	}
+	newCloudFrontWAFv2 = newWAFv2
+}
 
-type updateIPSetFunc func(ctx context.Context, ipSetID, ipSetName, cidr string) error
+// AppendToIPSet appends cidr to the WAF IP set.
+// No update is made if cidr already exists
+func AppendToIPSet(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) error {
+	return defaultClient.AppendToIPSet(ctx, ipSetID, ipSetName, cidr, opts...)
+}
 
-// AppendToIPSet appends cidr to the WAF IP set
-func AppendToIPSet(ctx context.Context, ipSetID, ipSetName, cidr string) error {
-	return retryOptimisticLockErr(ctx, appendToIPSet, ipSetID, ipSetName, cidr)
+// AppendPrefix appends p to the WAF IP set.
+// No update is made if p already exists
+func AppendPrefix(ctx context.Context, ipSetID, ipSetName string, p netip.Prefix, opts ...Option) error {
+	return defaultClient.AppendPrefix(ctx, ipSetID, ipSetName, p, opts...)
 }
 
-// RemoveFromIPSet removes cidr from the WAF IP set
-func RemoveFromIPSet(ctx context.Context, ipSetID, ipSetName, cidr string) error {
-	return retryOptimisticLockErr(ctx, removeFromIPSet, ipSetID, ipSetName, cidr)
+// AppendToIPSetChanged appends cidr to the WAF IP set and reports whether the IP set was modified.
+// It returns false without updating the IP set if cidr already exists
+func AppendToIPSetChanged(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) (bool, error) {
+	return defaultClient.AppendToIPSetChanged(ctx, ipSetID, ipSetName, cidr, opts...)
 }
 
-func retryOptimisticLockErr(ctx context.Context, fn updateIPSetFunc, ipSetID, ipSetName, cidr string) error {
-	var err error
-	var attempts int
-	for {
-		if attempts > 3 {
-			return err
+// AppendIfAbsent appends cidr to the WAF IP set.
+// It returns ErrCIDRAlreadyPresent without updating the IP set if cidr already exists
+func AppendIfAbsent(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) error {
+	return defaultClient.AppendIfAbsent(ctx, ipSetID, ipSetName, cidr, opts...)
+}
+
+// AppendCIDRs appends all the valid cidrs to the WAF IP set in a single update.
+// CIDRs that already exist in the IP set are skipped, and no update is made if all of them exist.
+// The invalid cidrs, or all of them if the update fails, are reported in a *BatchError
+func AppendCIDRs(ctx context.Context, ipSetID, ipSetName string, cidrs []string, opts ...Option) error {
+	return defaultClient.AppendCIDRs(ctx, ipSetID, ipSetName, cidrs, opts...)
+}
+
+// AppendMany appends the CIDRs of entries to their IP sets, updating each IP set once.
+// See Client.AppendMany for the details
+func AppendMany(ctx context.Context, entries []Entry, opts ...Option) (*ManyResult, error) {
+	return defaultClient.AppendMany(ctx, entries, opts...)
+}
+
+// AppendToIPSetConcurrent appends many cidrs to the WAF IP set in a single update as AppendCIDRs does,
+// validating them by concurrency goroutines. See Client.AppendToIPSetConcurrent for the details
+func AppendToIPSetConcurrent(ctx context.Context, ipSetID, ipSetName string, cidrs []string, concurrency int, opts ...Option) error {
+	return defaultClient.AppendToIPSetConcurrent(ctx, ipSetID, ipSetName, cidrs, concurrency, opts...)
+}
+
+// RemoveFromIPSet removes cidr from the WAF IP set.
+// No update is made if cidr does not exist, so it never competes for the lock token with other writers
+func RemoveFromIPSet(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) error {
+	return defaultClient.RemoveFromIPSet(ctx, ipSetID, ipSetName, cidr, opts...)
+}
+
+// RemovePrefix removes p from the WAF IP set.
+// No update is made if p does not exist
+func RemovePrefix(ctx context.Context, ipSetID, ipSetName string, p netip.Prefix, opts ...Option) error {
+	return defaultClient.RemovePrefix(ctx, ipSetID, ipSetName, p, opts...)
+}
+
+// RemoveFromIPSetChanged removes cidr from the WAF IP set and reports whether the IP set was modified.
+// It returns false without updating the IP set if cidr does not exist
+func RemoveFromIPSetChanged(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) (bool, error) {
+	return defaultClient.RemoveFromIPSetChanged(ctx, ipSetID, ipSetName, cidr, opts...)
+}
+
+// MoveCIDR moves cidr from the source IP set to the destination IP set, appending it to the destination first.
+// See Client.MoveCIDR for the details
+func MoveCIDR(ctx context.Context, fromID, fromName, toID, toName, cidr string, opts ...Option) error {
+	return defaultClient.MoveCIDR(ctx, fromID, fromName, toID, toName, cidr, opts...)
+}
+
+// RemoveCIDRs removes all the valid cidrs from the WAF IP set in a single update.
+// CIDRs that do not exist in the IP set are ignored, and no update is made if none of them exist.
+// The invalid cidrs, or all of them if the update fails, are reported in a *BatchError
+func RemoveCIDRs(ctx context.Context, ipSetID, ipSetName string, cidrs []string, opts ...Option) error {
+	return defaultClient.RemoveCIDRs(ctx, ipSetID, ipSetName, cidrs, opts...)
+}
+
+// ContainsCIDR reports whether cidr exists in the WAF IP set
+func ContainsCIDR(ctx context.Context, ipSetID, ipSetName, cidr string, opts ...Option) (bool, error) {
+	return defaultClient.ContainsCIDR(ctx, ipSetID, ipSetName, cidr, opts...)
+}
+
+// ExportAddresses writes the addresses of the WAF IP set to w, one CIDR per line
+func ExportAddresses(ctx context.Context, ipSetID, ipSetName string, w io.Writer, opts ...Option) error {
+	return defaultClient.ExportAddresses(ctx, ipSetID, ipSetName, w, opts...)
+}
+
+// ImportAddresses reads CIDRs from r, one per line, and appends them to the WAF IP set,
+// or replaces all the addresses of the IP set with them if replace is true
+func ImportAddresses(ctx context.Context, ipSetID, ipSetName string, r io.Reader, replace bool, opts ...Option) error {
+	return defaultClient.ImportAddresses(ctx, ipSetID, ipSetName, r, replace, opts...)
+}
+
+// ExportMatching returns the addresses of all the WAF IP sets in scope whose names start with namePrefix, keyed by the name
+func ExportMatching(ctx context.Context, namePrefix string, scope Scope, opts ...Option) (map[string][]string, error) {
+	return defaultClient.ExportMatching(ctx, namePrefix, scope, opts...)
+}
+
+// CopyIPSet copies the addresses of the source IP set to the destination IP set, both of scope.
+// See Client.CopyIPSet for the details
+func CopyIPSet(ctx context.Context, srcID, srcName, dstID, dstName string, scope Scope, replace bool, opts ...Option) error {
+	return defaultClient.CopyIPSet(ctx, srcID, srcName, dstID, dstName, scope, replace, opts...)
+}
+
+// ApplyDelta updates the IP set of prev to desired by appending and removing only the difference between prev and desired.
+// See Client.ApplyDelta for the details
+func ApplyDelta(ctx context.Context, prev *Snapshot, desired []string, opts ...Option) error {
+	return defaultClient.ApplyDelta(ctx, prev, desired, opts...)
+}
+
+// CaptureSnapshot returns the current state of the WAF IP set
+func CaptureSnapshot(ctx context.Context, ipSetID, ipSetName string, opts ...Option) (*Snapshot, error) {
+	return defaultClient.CaptureSnapshot(ctx, ipSetID, ipSetName, opts...)
+}
+
+// RestoreSnapshot replaces all the addresses of the IP set of snap with the addresses of snap
+func RestoreSnapshot(ctx context.Context, snap *Snapshot, opts ...Option) error {
+	return defaultClient.RestoreSnapshot(ctx, snap, opts...)
+}
+
+// Preflight checks that the WAF IP set exists in scope and that the client is allowed to get it,
+// and to update it with WithPreflightUpdate. See Client.Preflight for the details
+func Preflight(ctx context.Context, ipSetID, ipSetName string, scope Scope, opts ...Option) error {
+	return defaultClient.Preflight(ctx, ipSetID, ipSetName, scope, opts...)
+}
+
+// AddressCount returns the number of addresses of the WAF IP set
+func AddressCount(ctx context.Context, ipSetID, ipSetName string, opts ...Option) (int, error) {
+	return defaultClient.AddressCount(ctx, ipSetID, ipSetName, opts...)
+}
+
+// ListAddresses returns the addresses of the WAF IP set.
+// The addresses are in the canonical form, deduplicated and sorted by IP address
+func ListAddresses(ctx context.Context, ipSetID, ipSetName string, opts ...Option) ([]string, error) {
+	return defaultClient.ListAddresses(ctx, ipSetID, ipSetName, opts...)
+}
+
+// DiffIPSets returns the addresses only in the IP set a and the ones only in the IP set b, both of scope.
+// See Client.DiffIPSets for the details
+func DiffIPSets(ctx context.Context, aID, aName, bID, bName string, scope Scope, opts ...Option) (onlyInA, onlyInB []string, err error) {
+	return defaultClient.DiffIPSets(ctx, aID, aName, bID, bName, scope, opts...)
+}
+
+// DescribeIPSet returns the metadata of the WAF IP set
+func DescribeIPSet(ctx context.Context, ipSetID, ipSetName string, opts ...Option) (*IPSetInfo, error) {
+	return defaultClient.DescribeIPSet(ctx, ipSetID, ipSetName, opts...)
+}
+
+// ListIPSets returns the summaries of all the WAF IP sets in scope. See Client.ListIPSets for the details
+func ListIPSets(ctx context.Context, scope Scope, opts ...Option) ([]IPSetSummary, error) {
+	return defaultClient.ListIPSets(ctx, scope, opts...)
+}
+
+// GetIPSetARN returns the ARN of the WAF IP set in scope, e.g. to reference it in a rule statement.
+// It returns ErrIPSetNotFound if the IP set does not exist
+func GetIPSetARN(ctx context.Context, ipSetID, ipSetName string, scope Scope) (string, error) {
+	return defaultClient.GetIPSetARN(ctx, ipSetID, ipSetName, scope)
+}
+
+// FindIPSetIDByName returns the ID of the WAF IP set named name in scope.
+// It returns ErrIPSetNotFound if there is no such IP set
+func FindIPSetIDByName(ctx context.Context, name string, scope Scope) (string, error) {
+	return defaultClient.FindIPSetIDByName(ctx, name, scope)
+}
+
+// AppendToIPSetByName appends cidr to the WAF IP set named ipSetName.
+// The IP set ID is resolved by FindIPSetIDByName and cached for the TTL set by WithIDCacheTTL
+func AppendToIPSetByName(ctx context.Context, ipSetName, cidr string, opts ...Option) error {
+	return defaultClient.AppendToIPSetByName(ctx, ipSetName, cidr, opts...)
+}
+
+// RemoveFromIPSetByName removes cidr from the WAF IP set named ipSetName.
+// The IP set ID is resolved by FindIPSetIDByName and cached for the TTL set by WithIDCacheTTL
+func RemoveFromIPSetByName(ctx context.Context, ipSetName, cidr string, opts ...Option) error {
+	return defaultClient.RemoveFromIPSetByName(ctx, ipSetName, cidr, opts...)
+}
+
+// SetAddresses replaces the addresses of the WAF IP set with cidrs in a single update, and returns the change.
+// No update is made if the IP set already has exactly cidrs
+func SetAddresses(ctx context.Context, ipSetID, ipSetName string, cidrs []string, opts ...Option) (*Change, error) {
+	return defaultClient.SetAddresses(ctx, ipSetID, ipSetName, cidrs, opts...)
+}
+
+// AppendWithTTL appends cidr to the WAF IP set and schedules its removal after ttl.
+// The returned cancel cancels the removal. The removal is run by an in-memory timer and does not survive restarts
+func AppendWithTTL(ctx context.Context, ipSetID, ipSetName, cidr string, ttl time.Duration, opts ...Option) (cancel func(), err error) {
+	return defaultClient.AppendWithTTL(ctx, ipSetID, ipSetName, cidr, ttl, opts...)
+}
+
+// Plan computes the change that SetAddresses(desired) would make to the WAF IP set, without updating the IP set.
+// The plan can be reviewed and then applied by Apply
+func Plan(ctx context.Context, ipSetID, ipSetName string, desired []string, opts ...Option) (*ChangePlan, error) {
+	return defaultClient.Plan(ctx, ipSetID, ipSetName, desired, opts...)
+}
+
+// Apply makes the change of plan to the IP set in a single update.
+// It returns ErrStalePlan without updating the IP set if the IP set has been modified since the plan was made
+func Apply(ctx context.Context, plan *ChangePlan, opts ...Option) error {
+	return defaultClient.Apply(ctx, plan, opts...)
+}
+
+// ApplyChanges appends add to and removes remove from the WAF IP set in a single update, and returns what it changed.
+// See Client.ApplyChanges for the details
+func ApplyChanges(ctx context.Context, ipSetID, ipSetName string, add, remove []string, opts ...Option) (*ChangesResult, error) {
+	return defaultClient.ApplyChanges(ctx, ipSetID, ipSetName, add, remove, opts...)
+}
+
+// ClearIPSet removes all the addresses from the WAF IP set in a single update.
+// No update is made if the IP set is already empty
+func ClearIPSet(ctx context.Context, ipSetID, ipSetName string, opts ...Option) error {
+	return defaultClient.ClearIPSet(ctx, ipSetID, ipSetName, opts...)
+}
+
+// Change describes the change of the addresses of an IP set
+type Change struct {
+	// Added are the addresses appended to the IP set
+	Added []string
+	// Removed are the addresses removed from the IP set
+	Removed []string
+	// Size is the number of addresses of the IP set after the change
+	Size int
+}
+
+// Changed reports whether the addresses of the IP set are changed
+func (c *Change) Changed() bool {
+	return len(c.Added) > 0 || len(c.Removed) > 0
+}
+
+// ChangesResult is the result of ApplyChanges. Each of the normalized CIDRs to append and remove is in one of its fields,
+// and a CIDR both to append and to remove is in Removed or NotPresent
+type ChangesResult struct {
+	// Added are the CIDRs appended to the IP set
+	Added []string
+	// AlreadyPresent are the CIDRs to append that were already in the IP set
+	AlreadyPresent []string
+	// Removed are the CIDRs removed from the IP set
+	Removed []string
+	// NotPresent are the CIDRs to remove that were not in the IP set
+	NotPresent []string
+}
+
+// UpdateAddressesWithToken replaces the addresses of the WAF IP set with addresses using lockToken obtained by the caller,
+// and returns the next lock token. See Client.UpdateAddressesWithToken for the details
+func UpdateAddressesWithToken(ctx context.Context, ipSetID, ipSetName string, scope Scope, lockToken string, addresses []string, opts ...Option) (string, error) {
+	return defaultClient.UpdateAddressesWithToken(ctx, ipSetID, ipSetName, scope, lockToken, addresses, opts...)
+}
+
+// CreateIPSet creates the WAF IP set named name with the addresses cidrs, and returns its ID.
+// An empty description leaves the description unset.
+// It returns ErrIPSetExists if an IP set of the same name already exists in scope
+func CreateIPSet(ctx context.Context, name string, scope Scope, ipVersion IPAddressVersion, cidrs []string, description string) (string, error) {
+	return defaultClient.CreateIPSet(ctx, name, scope, ipVersion, cidrs, description)
+}
+
+// DeleteIPSet deletes the WAF IP set in scope, reading its current lock token and retrying on WAFOptimisticLockException.
+// It returns ErrIPSetNotFound if the IP set does not exist, which teardown flows can ignore with errors.Is
+func DeleteIPSet(ctx context.Context, ipSetID, ipSetName string, scope Scope, opts ...Option) error {
+	return defaultClient.DeleteIPSet(ctx, ipSetID, ipSetName, scope, opts...)
+}
+
+// IPSetSummary is the summary of an IP set returned by ListIPSets
+type IPSetSummary struct {
+	Name        string
+	ID          string
+	ARN         string
+	LockToken   string
+	Description string
+}
+
+// IPSetInfo is the metadata of an IP set
+type IPSetInfo struct {
+	Name             string
+	ID               string
+	ARN              string
+	IPAddressVersion IPAddressVersion
+	Description      string
+	// AddressCount is the number of addresses in the IP set
+	AddressCount int
+}
+
+// ChangePlan is the change to the addresses of an IP set computed by Plan
+type ChangePlan struct {
+	IPSetID   string
+	IPSetName string
+	Scope     Scope
+	// Add are the addresses to be appended to the IP set
+	Add []string
+	// Remove are the addresses to be removed from the IP set
+	Remove []string
+	// Size is the number of addresses of the IP set after the change
+	Size int
+
+	fn      updateIPSetFunc
+	desired []string
+}
+
+// Changed reports whether the plan changes the addresses of the IP set
+func (p *ChangePlan) Changed() bool {
+	return len(p.Add) > 0 || len(p.Remove) > 0
+}
+
+// EnsureIPSet creates the WAF IP set named name with tags if it does not exist, and returns its ID either way.
+// It is safe to call concurrently: if another caller creates the IP set first, the ID of that IP set is returned
+func EnsureIPSet(ctx context.Context, name string, scope Scope, ipVersion IPAddressVersion, tags map[string]string) (string, error) {
+	return defaultClient.EnsureIPSet(ctx, name, scope, ipVersion, tags)
+}
+
+// updateIPSetFunc computes the new addresses of the IP set from its current addresses and cidrs
+type updateIPSetFunc func(addresses, cidrs []string) ([]string, *Change, error)
+
+var appendToIPSet updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	// append cidrs to ip set if not exists
+	change := &Change{}
+	exists := addressSet(addresses)
+	for _, cidr := range cidrs {
+		if _, ok := exists[cidr]; !ok {
+			exists[cidr] = struct{}{}
+			addresses = append(addresses, cidr)
+			change.Added = append(change.Added, cidr)
+		}
+	}
+	return addresses, change, nil
+}
+
+var removeFromIPSet updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	// remove cidrs from IP set if exists
+	change := &Change{}
+	removing := make(map[string]struct{}, len(cidrs))
+	exists := addressSet(addresses)
+	for _, cidr := range cidrs {
+		if _, ok := exists[cidr]; ok {
+			delete(exists, cidr)
+			removing[cidr] = struct{}{}
+			change.Removed = append(change.Removed, cidr)
+		}
+	}
+	next := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		if _, ok := removing[a]; !ok {
+			next = append(next, a)
+		}
+	}
+	return next, change, nil
+}
+
+var setAddresses updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	// remove addresses not in cidrs, then append cidrs not in addresses
+	change := &Change{}
+	desired := addressSet(cidrs)
+	next := make([]string, 0, len(cidrs))
+	exists := make(map[string]struct{}, len(addresses))
+	for _, a := range addresses {
+		if _, ok := desired[a]; ok {
+			next = append(next, a)
+			exists[a] = struct{}{}
+		} else {
+			change.Removed = append(change.Removed, a)
+		}
+	}
+	for _, cidr := range cidrs {
+		if _, ok := exists[cidr]; !ok {
+			exists[cidr] = struct{}{}
+			next = append(next, cidr)
+			change.Added = append(change.Added, cidr)
+		}
+	}
+	return next, change, nil
+}
+
+// addressSet returns the set of addresses for the membership checks
+func addressSet(addresses []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(addresses))
+	for _, a := range addresses {
+		set[a] = struct{}{}
+	}
+	return set
+}
+
+// aggregateAppend is appendToIPSet used with WithAggregation.
+// It aggregates the current addresses together with cidrs
+var aggregateAppend updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	all := make([]string, 0, len(addresses)+len(cidrs))
+	all = append(all, addresses...)
+	all = append(all, cidrs...)
+	return setAddresses(addresses, aggregateCIDRs(all))
+}
+
+// aggregateSet is setAddresses used with WithAggregation
+var aggregateSet updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	return setAddresses(addresses, aggregateCIDRs(cidrs))
+}
+
+// coverAppend is appendToIPSet used with WithCoverCheck. It skips cidrs covered by a broader prefix
+var coverAppend updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	uncovered := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, ok := coveringPrefix(addresses, cidr); !ok {
+			uncovered = append(uncovered, cidr)
+		}
+	}
+	return appendToIPSet(addresses, uncovered)
+}
+
+// appendWithoutDedupe is appendToIPSet used with WithoutDedupeCheck. It appends cidrs without checking their existence
+// in the IP set, but a cidr given more than once is appended once
+var appendWithoutDedupe updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	seen := make(map[string]struct{}, len(cidrs))
+	change := &Change{Added: make([]string, 0, len(cidrs))}
+	for _, cidr := range cidrs {
+		if _, ok := seen[cidr]; !ok {
+			seen[cidr] = struct{}{}
+			change.Added = append(change.Added, cidr)
+		}
+	}
+	return append(addresses[:len(addresses):len(addresses)], change.Added...), change, nil
+}
+
+// coverRemove is removeFromIPSet used with WithCoverCheck.
+// It returns a *CIDRCoveredError if a cidr does not exist but is covered by a broader prefix
+var coverRemove updateIPSetFunc = func(addresses, cidrs []string) ([]string, *Change, error) {
+	exists := addressSet(addresses)
+	for _, cidr := range cidrs {
+		if _, ok := exists[cidr]; ok {
+			continue
+		}
+		if prefix, ok := coveringPrefix(addresses, cidr); ok {
+			return nil, nil, &CIDRCoveredError{CIDR: cidr, CoveredBy: prefix}
+		}
+	}
+	return removeFromIPSet(addresses, cidrs)
+}
+
+// updateFuncOf returns the updateIPSetFunc of op, replacing fn by the variant selected by o
+func updateFuncOf(op string, fn updateIPSetFunc, o *options) updateIPSetFunc {
+	switch {
+	case op == "append" && o.aggregate:
+		return aggregateAppend
+	case op == "append" && o.coverCheck:
+		return coverAppend
+	case op == "append" && o.noDedupe:
+		return appendWithoutDedupe
+	case op == "remove" && o.coverCheck:
+		return coverRemove
+	case op == "set" && o.aggregate:
+		return aggregateSet
+	}
+	return fn
+}
+
+// limitAddresses wraps fn to return an *IPSetFullError if fn appends addresses beyond limit.
+// The changes only removing addresses are not limited, so that an IP set beyond limit can still shrink
+func limitAddresses(fn updateIPSetFunc, limit int) updateIPSetFunc {
+	return func(addresses, cidrs []string) ([]string, *Change, error) {
+		next, change, err := fn(addresses, cidrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(next) > limit && len(change.Added) > 0 {
+			return nil, nil, &IPSetFullError{Size: len(addresses), Limit: limit, Appending: len(change.Added)}
 		}
-		err = fn(ctx, ipSetID, ipSetName, cidr)
+		return next, change, nil
+	}
+}
+
+// rejectPresent wraps fn of an append operation to return ErrCIDRAlreadyPresent if any of cidrs already exists
+func rejectPresent(fn updateIPSetFunc) updateIPSetFunc {
+	return func(addresses, cidrs []string) ([]string, *Change, error) {
+		exists := addressSet(addresses)
+		var present []string
+		for _, cidr := range cidrs {
+			if _, ok := exists[cidr]; ok {
+				present = append(present, cidr)
+			}
+		}
+		if len(present) > 0 {
+			return nil, nil, fmt.Errorf("%w: %s", ErrCIDRAlreadyPresent, strings.Join(present, ", "))
+		}
+		return fn(addresses, cidrs)
+	}
+}
+
+// rejectMissing wraps fn of a remove operation to return ErrCIDRNotPresent if any of cidrs does not exist.
+// The errors of fn, such as the *CIDRCoveredError of WithCoverCheck, are returned first
+func rejectMissing(fn updateIPSetFunc) updateIPSetFunc {
+	return func(addresses, cidrs []string) ([]string, *Change, error) {
+		next, change, err := fn(addresses, cidrs)
 		if err != nil {
-			var lockErr *wafv2.WAFOptimisticLockException
-			if !errors.As(err, &lockErr) {
-				return err
+			return nil, nil, err
+		}
+		exists := addressSet(addresses)
+		var missing []string
+		for _, cidr := range cidrs {
+			if _, ok := exists[cidr]; !ok {
+				missing = append(missing, cidr)
 			}
-			attempts++
-			time.Sleep(time.Duration(100+random.Int63n(101)) * time.Millisecond)
-			continue
 		}
-		return nil
+		if len(missing) > 0 {
+			return nil, nil, fmt.Errorf("%w: %s", ErrCIDRNotPresent, strings.Join(missing, ", "))
+		}
+		return next, change, nil
 	}
 }
 
-var appendToIPSet updateIPSetFunc = func(ctx context.Context, ipSetID, ipSetName, cidr string) error {
-	api := newWAFv2()
-	// append cidr to ip set if not exists
-	current, err := api.GetIPSetWithContext(ctx, &wafv2.GetIPSetInput{
-		Id:    aws.String(ipSetID),
-		Name:  aws.String(ipSetName),
-		Scope: aws.String("REGIONAL"),
-	})
+// guardMinAddresses wraps fn to return an *UnderflowError if it removes addresses leaving less than min of them
+func guardMinAddresses(fn updateIPSetFunc, min int) updateIPSetFunc {
+	return func(addresses, cidrs []string) ([]string, *Change, error) {
+		next, change, err := fn(addresses, cidrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(change.Removed) > 0 && len(next) < min {
+			return nil, nil, &UnderflowError{Size: len(addresses), Min: min, Removing: len(change.Removed)}
+		}
+		return next, change, nil
+	}
+}
+
+// capAddresses wraps fn of an append operation to keep the IP set within max addresses,
+// evicting the current addresses chosen by evict when the IP set would exceed max
+func capAddresses(fn updateIPSetFunc, max int, evict EvictFunc) updateIPSetFunc {
+	return func(addresses, cidrs []string) ([]string, *Change, error) {
+		next, change, err := fn(addresses, cidrs)
+		var fullErr *IPSetFullError
+		var excess int
+		switch {
+		case errors.As(err, &fullErr):
+			excess = fullErr.Size + fullErr.Appending - max
+		case err != nil:
+			return nil, nil, err
+		default:
+			excess = len(next) - max
+		}
+		if excess <= 0 {
+			return next, change, err
+		}
+		// the addresses being appended again are not evicted
+		appending := addressSet(cidrs)
+		candidates := make([]string, 0, len(addresses))
+		for _, a := range addresses {
+			if _, ok := appending[a]; !ok {
+				candidates = append(candidates, a)
+			}
+		}
+		evicting := make(map[string]struct{})
+		if evict != nil {
+			evictable := addressSet(candidates)
+			for _, a := range evict(candidates, excess) {
+				if _, ok := evictable[a]; ok {
+					evicting[a] = struct{}{}
+				}
+			}
+		}
+		remaining := make([]string, 0, len(addresses))
+		var evicted []string
+		for _, a := range addresses {
+			if _, ok := evicting[a]; ok {
+				evicted = append(evicted, a)
+			} else {
+				remaining = append(remaining, a)
+			}
+		}
+		next, change, err = fn(remaining, cidrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(next) > max {
+			return nil, nil, &IPSetFullError{Size: len(addresses), Limit: max, Appending: len(change.Added)}
+		}
+		change.Removed = append(evicted, change.Removed...)
+		return next, change, nil
+	}
+}
+
+// updateIPSet reads the IP set, computes the new addresses by fn, and updates the IP set if the addresses are changed
+func updateIPSet(ctx context.Context, api wafv2iface.WAFV2API, o *options, fn updateIPSetFunc, ipSetID, ipSetName string, cidrs []string) (*Change, error) {
+	current, err := getIPSet(ctx, api, o, ipSetID, ipSetName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAddressFamily(IPAddressVersion(aws.StringValue(current.IPSet.IPAddressVersion)), cidrs); err != nil {
+		return nil, err
+	}
+	addresses, change, err := fn(canonicalAddresses(current.IPSet.Addresses), cidrs)
 	if err != nil {
-		return fmt.Errorf("ipset: get ip set: %w", err)
+		return nil, err
 	}
-	var alreadyExists bool
-	for _, a := range current.IPSet.Addresses {
-		if aws.StringValue(a) == cidr {
-			alreadyExists = true
+	change.Size = len(addresses)
+	if o.sorted {
+		sortCIDRs(addresses)
+	}
+	in := updateInput(current, o.scope, addresses)
+	if o.description != nil {
+		in.Description = nil
+		if *o.description != "" {
+			in.Description = o.description
 		}
 	}
-	if !alreadyExists {
-		current.IPSet.Addresses = append(current.IPSet.Addresses, aws.String(cidr))
+	descriptionChanged := aws.StringValue(in.Description) != aws.StringValue(current.IPSet.Description)
+	if (!change.Changed() && !descriptionChanged && !o.forceUpdate) || o.dryRun {
+		return change, nil
 	}
 	// update ip set
-	_, err = api.UpdateIPSetWithContext(ctx, &wafv2.UpdateIPSetInput{
-		Id:        aws.String(ipSetID),
-		Name:      aws.String(ipSetName),
-		Scope:     aws.String("REGIONAL"),
-		LockToken: current.LockToken,
-		Addresses: current.IPSet.Addresses,
+	if err := o.wait(ctx); err != nil {
+		return nil, err
+	}
+	spanCtx, span := o.tracer.Start(ctx, "WAFV2.UpdateIPSet")
+	_, err = api.UpdateIPSetWithContext(spanCtx, in, o.requestOptions...)
+	span.End(err)
+	// the cached IP set is outdated by the update, or may be stale if the update failed
+	uncacheIPSet(o, ipSetID, ipSetName)
+	if err != nil {
+		return nil, fmt.Errorf("ipset: update ip set %s: %w", ipSetRef(ipSetID, ipSetName, o.scope), awsError(err))
+	}
+	return change, nil
+}
+
+// updateInput builds the input of UpdateIPSet replacing the addresses of the fetched IP set.
+// UpdateIPSet resets the mutable fields that are not specified, so all of them are copied from the fetched IP set
+func updateInput(current *wafv2.GetIPSetOutput, scope Scope, addresses []string) *wafv2.UpdateIPSetInput {
+	return &wafv2.UpdateIPSetInput{
+		Id:          current.IPSet.Id,
+		Name:        current.IPSet.Name,
+		Scope:       aws.String(string(scope)),
+		LockToken:   current.LockToken,
+		Addresses:   aws.StringSlice(addresses),
+		Description: current.IPSet.Description,
+	}
+}
+
+// readIPSet gets the IP set for the operations that only read it, such as ListAddresses.
+// The transient errors are retried by the transient retry configuration as the updates do,
+// and the other errors such as ErrIPSetNotFound and ErrAccessDenied are returned at once
+func readIPSet(ctx context.Context, api wafv2iface.WAFV2API, o *options, ipSetID, ipSetName string) (*wafv2.GetIPSetOutput, error) {
+	var out *wafv2.GetIPSetOutput
+	err := retry(ctx, o, func() (err error) {
+		out, err = getIPSet(ctx, api, o, ipSetID, ipSetName)
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("ipset: update ip set: %w", err)
+		return nil, withCorrelationID(ctx, contextError(ctx, err))
 	}
-	return nil
+	return out, nil
 }
 
-var removeFromIPSet updateIPSetFunc = func(ctx context.Context, ipSetID, ipSetName, cidr string) error {
-	api := newWAFv2()
-	// remove cidr from IP set if exists
-	current, err := api.GetIPSetWithContext(ctx, &wafv2.GetIPSetInput{
+func getIPSet(ctx context.Context, api wafv2iface.WAFV2API, o *options, ipSetID, ipSetName string) (*wafv2.GetIPSetOutput, error) {
+	if out := o.prefetched; out != nil {
+		o.prefetched = nil
+		return out, nil
+	}
+	cached := o.getCacheTTL > 0 && o.ipSets != nil
+	if cached {
+		if out, ok := o.ipSets.get(o.scope, ipSetID, ipSetName); ok {
+			return out, nil
+		}
+	}
+	if err := o.wait(ctx); err != nil {
+		return nil, err
+	}
+	spanCtx, span := o.tracer.Start(ctx, "WAFV2.GetIPSet")
+	out, err := api.GetIPSetWithContext(spanCtx, &wafv2.GetIPSetInput{
 		Id:    aws.String(ipSetID),
 		Name:  aws.String(ipSetName),
-		Scope: aws.String("REGIONAL"),
-	})
+		Scope: aws.String(string(o.scope)),
+	}, o.requestOptions...)
+	span.End(err)
 	if err != nil {
-		return fmt.Errorf("ipset: get ip set: %w", err)
+		return nil, fmt.Errorf("ipset: get ip set %s: %w", ipSetRef(ipSetID, ipSetName, o.scope), awsError(err))
 	}
-	for i, a := range current.IPSet.Addresses {
-		if aws.StringValue(a) == cidr {
-			n := copy(current.IPSet.Addresses[i:], current.IPSet.Addresses[i+1:])
-			current.IPSet.Addresses = current.IPSet.Addresses[:i+n]
-			break
-		}
+	if cached {
+		o.ipSets.set(o.scope, ipSetID, ipSetName, out, o.getCacheTTL)
 	}
-	// update ip set
-	_, err = api.UpdateIPSetWithContext(ctx, &wafv2.UpdateIPSetInput{
-		Id:        aws.String(ipSetID),
-		Name:      aws.String(ipSetName),
-		Scope:     aws.String("REGIONAL"),
-		LockToken: current.LockToken,
-		Addresses: current.IPSet.Addresses,
-	})
+	return out, nil
+}
+
+// uncacheIPSet drops the IP set cached by getIPSet
+func uncacheIPSet(o *options, ipSetID, ipSetName string) {
+	if o.ipSets != nil {
+		o.ipSets.delete(o.scope, ipSetID, ipSetName)
+	}
+}
+
+func createIPSet(ctx context.Context, api wafv2iface.WAFV2API, o *options, in *wafv2.CreateIPSetInput) (string, error) {
+	if err := o.wait(ctx); err != nil {
+		return "", err
+	}
+	spanCtx, span := o.tracer.Start(ctx, "WAFV2.CreateIPSet")
+	out, err := api.CreateIPSetWithContext(spanCtx, in, o.requestOptions...)
+	span.End(err)
 	if err != nil {
-		return fmt.Errorf("ipset: update ip set: %w", err)
+		return "", withCorrelationID(ctx, fmt.Errorf("ipset: create ip set %q (scope=%s): %w", aws.StringValue(in.Name), aws.StringValue(in.Scope), awsError(err)))
+	}
+	return aws.StringValue(out.Summary.Id), nil
+}
+
+func listIPSets(ctx context.Context, api wafv2iface.WAFV2API, o *options) ([]*wafv2.IPSetSummary, error) {
+	var nextMarker *string
+	ipSets := make([]*wafv2.IPSetSummary, 0)
+	for {
+		if err := o.wait(ctx); err != nil {
+			return nil, err
+		}
+		spanCtx, span := o.tracer.Start(ctx, "WAFV2.ListIPSets")
+		out, err := api.ListIPSetsWithContext(spanCtx, &wafv2.ListIPSetsInput{
+			Limit:      aws.Int64(100),
+			NextMarker: nextMarker,
+			Scope:      aws.String(string(o.scope)),
+		}, o.requestOptions...)
+		span.End(err)
+		if err != nil {
+			return nil, withCorrelationID(ctx, fmt.Errorf("ipset: list ip sets: %w", awsError(err)))
+		}
+		ipSets = append(ipSets, out.IPSets...)
+		nextMarker = out.NextMarker
+		if aws.StringValue(nextMarker) == "" {
+			return ipSets, nil
+		}
+	}
+}
+
+func toTags(tags map[string]string) []*wafv2.Tag {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	wafTags := make([]*wafv2.Tag, len(keys))
+	for i, k := range keys {
+		wafTags[i] = &wafv2.Tag{Key: aws.String(k), Value: aws.String(tags[k])}
 	}
-	return nil
+	return wafTags
 }
@@ -3,13 +3,23 @@ package ipset
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/wafv2"
 	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/kei2100/idempotent-aws-waf-ipset/ipsettest"
 )
 
 const ipSetName = "test-ip-set"
@@ -49,8 +59,11 @@ func TestAppendToIPSet(t *testing.T) {
 			newWAFv2 = bk
 		})
 		var lockErrTriggered bool
-		newWAFv2 = func() wafv2iface.WAFV2API {
-			api := bk()
+		newWAFv2 = func() (wafv2iface.WAFV2API, error) {
+			api, err := bk()
+			if err != nil {
+				return nil, err
+			}
 			mockAPI := MockWAFV2API{WAFV2API: api}
 			mockAPI.MockUpdateIPSetWithContext = func(ctx aws.Context, in *wafv2.UpdateIPSetInput, opts ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
 				if !lockErrTriggered {
@@ -64,7 +77,7 @@ func TestAppendToIPSet(t *testing.T) {
 				}
 				return out, err
 			}
-			return &mockAPI
+			return &mockAPI, nil
 		}
 		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr))
 		assert.True(t, existsCIDR(t, ipSet, cidr))
@@ -72,6 +85,428 @@ func TestAppendToIPSet(t *testing.T) {
 	})
 }
 
+func TestAppendToIPSet_Scope(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	t.Run("cloudfront scope", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr, WithScope(ScopeCloudFront)))
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeCloudFront, aws.StringValue(ipSet.Id)))
+		// the regional scope does not have the ip set
+		err := AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+		var notFound *wafv2.WAFNonexistentItemException
+		assert.True(t, errors.As(err, &notFound))
+	})
+	t.Run("invalid scope", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		err := AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr, WithScope("GLOBAL"))
+		assert.EqualError(t, err, `ipset: invalid scope "GLOBAL"`)
+		assert.Equal(t, 0, fake.GetCalls)
+	})
+}
+
+func TestAppendToIPSetChanged(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	changed, err := AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 1, fake.UpdateCalls)
+	// cidr already exists
+	changed, err = AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, fake.UpdateCalls)
+}
+
+func TestAppendIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	assert.NoError(t, AppendIfAbsent(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr))
+	assert.Equal(t, 1, fake.UpdateCalls)
+	// cidr already exists
+	err := AppendIfAbsent(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44")
+	assert.ErrorIs(t, err, ErrCIDRAlreadyPresent)
+	assert.Equal(t, 1, fake.UpdateCalls)
+	assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+}
+
+func TestWithErrorOnDuplicate(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+	err := AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithErrorOnDuplicate())
+	assert.ErrorIs(t, err, ErrCIDRAlreadyPresent)
+	assert.EqualError(t, err, "ipset: cidr already present: 192.0.2.1/32")
+	assert.Equal(t, 0, fake.UpdateCalls)
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", WithErrorOnDuplicate()))
+	assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	t.Run("appended by another writer", func(t *testing.T) {
+		fake.BeforeUpdate = fake.ConcurrentWrite(1, "192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32")
+		err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.3", "192.0.2.4"}, WithErrorOnDuplicate())
+		assert.ErrorIs(t, err, ErrCIDRAlreadyPresent)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestWithErrorOnMissing(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "10.0.0.0/8")
+	err := RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"}, WithErrorOnMissing())
+	assert.ErrorIs(t, err, ErrCIDRNotPresent)
+	assert.ErrorContains(t, err, "ipset: cidr not present: 192.0.2.2/32")
+	assert.Equal(t, 0, fake.UpdateCalls)
+	assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithErrorOnMissing()))
+	assert.Equal(t, []string{"10.0.0.0/8"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	t.Run("covered", func(t *testing.T) {
+		err := RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "10.1.2.3", WithErrorOnMissing(), WithCoverCheck())
+		assert.ErrorIs(t, err, ErrCIDRCovered)
+	})
+}
+
+func TestAppendPrefix(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+	assert.NoError(t, AppendPrefix(ctx, aws.StringValue(ipSet.Id), ipSetName, netip.MustParsePrefix("2001:DB8::5/64")))
+	assert.Equal(t, []string{"2001:db8::/64"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	// already exists
+	assert.NoError(t, AppendPrefix(ctx, aws.StringValue(ipSet.Id), ipSetName, netip.MustParsePrefix("2001:db8::/64")))
+	assert.Equal(t, 1, fake.UpdateCalls)
+
+	assert.NoError(t, RemovePrefix(ctx, aws.StringValue(ipSet.Id), ipSetName, netip.MustParsePrefix("2001:db8::/64")))
+	assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	t.Run("invalid prefix", func(t *testing.T) {
+		assert.ErrorIs(t, AppendPrefix(ctx, aws.StringValue(ipSet.Id), ipSetName, netip.Prefix{}), ErrInvalidCIDR)
+		assert.ErrorIs(t, RemovePrefix(ctx, aws.StringValue(ipSet.Id), ipSetName, netip.Prefix{}), ErrInvalidCIDR)
+	})
+}
+
+func TestMoveCIDR(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	fake := useFakeWAFV2API(t)
+	monitor := fake.addIPSet(ScopeRegional, "monitor", "IPV4", cidr)
+	block := fake.addIPSet(ScopeRegional, "block", "IPV4")
+	monitorID, blockID := aws.StringValue(monitor.Id), aws.StringValue(block.Id)
+	// the hook runs while the fake is locked, so the destination IP set is read directly
+	blockSet := fake.ipSet(ScopeRegional, blockID)
+	var blockedBeforeRemoval bool
+	fake.BeforeUpdate = func(s *ipsettest.IPSet) {
+		if aws.StringValue(s.IPSet.Id) == monitorID {
+			blockedBeforeRemoval = assert.ObjectsAreEqual([]string{cidr}, aws.StringValueSlice(blockSet.IPSet.Addresses))
+		}
+	}
+	assert.NoError(t, MoveCIDR(ctx, monitorID, "monitor", blockID, "block", "192.0.2.44"))
+	assert.True(t, blockedBeforeRemoval, "appended to the destination before the removal from the source")
+	assert.Empty(t, fake.addresses(ScopeRegional, monitorID))
+	assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, blockID))
+	fake.BeforeUpdate = nil
+
+	t.Run("append fails", func(t *testing.T) {
+		err := MoveCIDR(ctx, blockID, "block", "missing", "missing", cidr)
+		var moveErr *MoveError
+		if assert.True(t, errors.As(err, &moveErr)) {
+			assert.False(t, moveErr.Appended)
+		}
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.ErrorContains(t, err, "ipset: move cidr: append to destination: ")
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, blockID))
+	})
+	t.Run("remove fails", func(t *testing.T) {
+		err := MoveCIDR(ctx, "missing", "missing", monitorID, "monitor", cidr)
+		var moveErr *MoveError
+		if assert.True(t, errors.As(err, &moveErr)) {
+			assert.True(t, moveErr.Appended)
+		}
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.ErrorContains(t, err, "ipset: move cidr: remove from source: ")
+		assert.Equal(t, []string{cidr}, fake.addresses(ScopeRegional, monitorID))
+	})
+}
+
+func TestRemoveFromIPSetChanged(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", cidr)
+	changed, err := RemoveFromIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 1, fake.UpdateCalls)
+	// cidr not exists
+	changed, err = RemoveFromIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, fake.UpdateCalls)
+}
+
+func TestContainsCIDR(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.44/32", "198.51.100.0/24")
+	for cidr, want := range map[string]bool{
+		"192.0.2.44/32":    true,
+		"192.0.2.44":       true,
+		"198.51.100.10/24": true,
+		"192.0.2.45/32":    false,
+	} {
+		got, err := ContainsCIDR(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, cidr)
+	}
+	_, err := ContainsCIDR(ctx, aws.StringValue(ipSet.Id), ipSetName, "foo")
+	assert.ErrorIs(t, err, ErrInvalidCIDR)
+	assert.Equal(t, 0, fake.UpdateCalls)
+}
+
+func TestListAddresses(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.10/32", "192.0.2.2/32", "198.51.100.5/24", "198.51.100.0/24")
+	addresses, err := ListAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.10/32", "198.51.100.0/24"}, addresses)
+	// the returned slice is a copy
+	addresses[0] = "203.0.113.1/32"
+	assert.Equal(t, "192.0.2.10/32", fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id))[0])
+}
+
+// deniedAPI fails the calls of WAFV2 with AccessDeniedException as an IAM policy without them
+type deniedAPI struct {
+	*fakeWAFV2API
+	get, update bool
+}
+
+var accessDenied = awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized to perform: wafv2:UpdateIPSet", nil), 400, "request-id")
+
+func (a *deniedAPI) GetIPSetWithContext(ctx aws.Context, in *wafv2.GetIPSetInput, opts ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	if a.get {
+		return nil, accessDenied
+	}
+	return a.fakeWAFV2API.GetIPSetWithContext(ctx, in, opts...)
+}
+
+func (a *deniedAPI) UpdateIPSetWithContext(ctx aws.Context, in *wafv2.UpdateIPSetInput, opts ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
+	if a.update {
+		return nil, accessDenied
+	}
+	return a.fakeWAFV2API.UpdateIPSetWithContext(ctx, in, opts...)
+}
+
+func TestPreflight(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+	ipSet.LockToken = aws.String(fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).LockToken)
+	assert.NoError(t, Preflight(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional))
+	// the IP set is only read by default
+	assert.Equal(t, 0, fake.UpdateCalls)
+	assert.NoError(t, Preflight(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, WithPreflightUpdate()))
+	// the update is rejected without modifying the IP set
+	assert.Equal(t, 1, fake.UpdateCalls)
+	assert.Equal(t, aws.StringValue(ipSet.LockToken), fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).LockToken)
+	assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+
+	t.Run("not found", func(t *testing.T) {
+		err := Preflight(ctx, "no-such-id", ipSetName, ScopeRegional)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.NotErrorIs(t, err, ErrAccessDenied)
+	})
+	for name, api := range map[string]*deniedAPI{
+		"get denied":    {fakeWAFV2API: fake, get: true},
+		"update denied": {fakeWAFV2API: fake, update: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := NewClient(api).Preflight(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, WithPreflightUpdate())
+			assert.ErrorIs(t, err, ErrAccessDenied)
+			assert.NotErrorIs(t, err, ErrIPSetNotFound)
+			var reqErr awserr.RequestFailure
+			assert.True(t, errors.As(err, &reqErr))
+		})
+	}
+	t.Run("update not checked by default", func(t *testing.T) {
+		api := &deniedAPI{fakeWAFV2API: fake, update: true}
+		assert.NoError(t, NewClient(api).Preflight(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional))
+	})
+}
+
+func TestAddressCount(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+	n, err := AddressCount(ctx, aws.StringValue(ipSet.Id), ipSetName)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	t.Run("not found", func(t *testing.T) {
+		_, err := AddressCount(ctx, aws.StringValue(ipSet.Id), ipSetName, WithScope(ScopeCloudFront))
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+	})
+}
+
+func TestDescribeIPSet(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV6", "2001:db8::1/128", "2001:db8::/32")
+	fake.ipSet(ScopeCloudFront, aws.StringValue(ipSet.Id)).IPSet.Description = aws.String("blocked by the admin")
+	info, err := DescribeIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, WithScope(ScopeCloudFront))
+	assert.NoError(t, err)
+	assert.Equal(t, &IPSetInfo{
+		Name:             ipSetName,
+		ID:               aws.StringValue(ipSet.Id),
+		ARN:              aws.StringValue(ipSet.ARN),
+		IPAddressVersion: IPv6,
+		Description:      "blocked by the admin",
+		AddressCount:     2,
+	}, info)
+	t.Run("not found", func(t *testing.T) {
+		_, err := DescribeIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+	})
+}
+
+func TestDiffIPSets(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	staging := fake.addIPSet(ScopeCloudFront, "staging", "IPV4", "192.0.2.10/32", "192.0.2.2/32", "198.51.100.0/24")
+	prod := fake.addIPSet(ScopeCloudFront, "prod", "IPV4", "192.0.2.2/32", "203.0.113.5/32", "192.0.2.3/32")
+	// a non-canonical address is compared in the canonical form
+	fake.ipSet(ScopeCloudFront, aws.StringValue(prod.Id)).IPSet.Addresses = aws.StringSlice([]string{"192.0.2.2/32", "203.0.113.5/32", "192.0.2.3/32", "198.51.100.7/24"})
+	onlyInStaging, onlyInProd, err := DiffIPSets(ctx, aws.StringValue(staging.Id), "staging", aws.StringValue(prod.Id), "prod", ScopeCloudFront)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.10/32"}, onlyInStaging)
+	assert.Equal(t, []string{"192.0.2.3/32", "203.0.113.5/32"}, onlyInProd)
+	t.Run("not found", func(t *testing.T) {
+		_, _, err := DiffIPSets(ctx, aws.StringValue(staging.Id), "staging", "no-such-id", "prod", ScopeCloudFront)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+	})
+}
+
+func TestGetIPSetARN(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+	arn, err := GetIPSetARN(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeCloudFront)
+	assert.NoError(t, err)
+	assert.Equal(t, aws.StringValue(ipSet.ARN), arn)
+	t.Run("not found", func(t *testing.T) {
+		_, err := GetIPSetARN(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+	})
+}
+
+func TestListIPSets(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	var want []IPSetSummary
+	for i := 0; i < 150; i++ {
+		ipSet := fake.addIPSet(ScopeRegional, fmt.Sprintf("ip-set-%03d", i), "IPV4")
+		want = append(want, IPSetSummary{
+			Name:      aws.StringValue(ipSet.Name),
+			ID:        aws.StringValue(ipSet.Id),
+			ARN:       aws.StringValue(ipSet.ARN),
+			LockToken: fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).LockToken,
+		})
+	}
+	fake.addIPSet(ScopeCloudFront, "cloudfront", "IPV4")
+	c := NewClient(fake)
+	ipSets, err := c.ListIPSets(ctx, ScopeRegional)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, want, ipSets)
+	assert.Equal(t, 2, fake.ListCalls)
+
+	t.Run("cache", func(t *testing.T) {
+		c := NewClient(fake, WithListCacheTTL(time.Minute))
+		fake.ListCalls = 0
+		for i := 0; i < 2; i++ {
+			ipSets, err := c.ListIPSets(ctx, ScopeRegional)
+			assert.NoError(t, err)
+			assert.Len(t, ipSets, 150)
+		}
+		assert.Equal(t, 2, fake.ListCalls)
+		// dropped by an IP set created by the client
+		_, err := c.CreateIPSet(ctx, "created", ScopeRegional, IPv4, nil, "")
+		assert.NoError(t, err)
+		ipSets, err := c.ListIPSets(ctx, ScopeRegional)
+		assert.NoError(t, err)
+		assert.Len(t, ipSets, 151)
+		assert.Equal(t, 4, fake.ListCalls)
+		// cached by scope
+		ipSets, err = c.ListIPSets(ctx, ScopeCloudFront)
+		assert.NoError(t, err)
+		assert.Len(t, ipSets, 1)
+	})
+}
+
+func TestFindIPSetIDByName(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	for i := 0; i < 150; i++ {
+		fake.addIPSet(ScopeRegional, fmt.Sprintf("other-%d", i), "IPV4")
+	}
+	regional := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	cloudFront := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+	t.Run("paginate ip sets", func(t *testing.T) {
+		id, err := FindIPSetIDByName(ctx, ipSetName, ScopeRegional)
+		assert.NoError(t, err)
+		assert.Equal(t, aws.StringValue(regional.Id), id)
+	})
+	t.Run("same name in another scope", func(t *testing.T) {
+		id, err := FindIPSetIDByName(ctx, ipSetName, ScopeCloudFront)
+		assert.NoError(t, err)
+		assert.Equal(t, aws.StringValue(cloudFront.Id), id)
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, err := FindIPSetIDByName(ctx, "no-such-ip-set", ScopeRegional)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+	})
+}
+
+func TestRemoveFromIPSet_NotExists(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+	// a concurrent writer would make any update fail with the optimistic lock error
+	fake.BeforeUpdate = fake.ConcurrentWrite(100, "192.0.2.1/32", "192.0.2.2/32")
+	assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32"))
+	assert.Equal(t, 1, fake.GetCalls)
+	assert.Equal(t, 0, fake.UpdateCalls)
+}
+
+func TestAppendCIDRs(t *testing.T) {
+	ctx := context.Background()
+	t.Run("append cidrs in a single update", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		cidrs := []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32", "192.0.2.2/32"}
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, cidrs))
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("all cidrs already exist", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2/32", "192.0.2.1/32"}))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("re-read addresses on optimistic lock error", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeUpdate = fake.ConcurrentWrite(1, "198.51.100.1/32")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "192.0.2.2/32"}))
+		assert.Equal(t, []string{"198.51.100.1/32", "192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 2, fake.GetCalls)
+		assert.Equal(t, 2, fake.UpdateCalls)
+	})
+}
+
 func TestRemoveFromIPSet(t *testing.T) {
 	ctx := context.Background()
 	cidr := "192.0.2.44/32"
@@ -97,8 +532,11 @@ func TestRemoveFromIPSet(t *testing.T) {
 			newWAFv2 = bk
 		})
 		var lockErrTriggered bool
-		newWAFv2 = func() wafv2iface.WAFV2API {
-			api := bk()
+		newWAFv2 = func() (wafv2iface.WAFV2API, error) {
+			api, err := bk()
+			if err != nil {
+				return nil, err
+			}
 			mockAPI := MockWAFV2API{WAFV2API: api}
 			mockAPI.MockUpdateIPSetWithContext = func(ctx aws.Context, in *wafv2.UpdateIPSetInput, opts ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
 				if !lockErrTriggered {
@@ -112,7 +550,7 @@ func TestRemoveFromIPSet(t *testing.T) {
 				}
 				return out, err
 			}
-			return &mockAPI
+			return &mockAPI, nil
 		}
 		assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr))
 		assert.False(t, existsCIDR(t, ipSet, cidr))
@@ -120,9 +558,923 @@ func TestRemoveFromIPSet(t *testing.T) {
 	})
 }
 
+func TestAppendToIPSetConcurrent(t *testing.T) {
+	ctx := context.Background()
+	t.Run("append in a single update", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.1/32")
+		cidrs := make([]string, 0, 5000)
+		want := []string{"10.0.0.1/32"}
+		for i := 0; i < 5000; i++ {
+			cidrs = append(cidrs, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+			if i != 1 {
+				want = append(want, fmt.Sprintf("10.0.%d.%d/32", i/256, i%256))
+			}
+		}
+		assert.NoError(t, AppendToIPSetConcurrent(ctx, aws.StringValue(ipSet.Id), ipSetName, cidrs, 8))
+		assert.Equal(t, want, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("invalid cidrs are reported", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		err := AppendToIPSetConcurrent(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "foo", "192.0.2.2", "bar"}, 0)
+		var batchErr *BatchError
+		assert.True(t, errors.As(err, &batchErr))
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, batchErr.Succeeded)
+		assert.Len(t, batchErr.Failed, 2)
+		assert.ErrorIs(t, batchErr.Failed["foo"], ErrInvalidCIDR)
+		assert.ErrorIs(t, batchErr.Failed["bar"], ErrInvalidCIDR)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("invalid cidrs are reported by the workers", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		var cidrs, want []string
+		for i := 0; i < 1000; i++ {
+			if i%10 == 0 {
+				cidrs = append(cidrs, fmt.Sprintf("10.0.%d.%d/33", i/256, i%256))
+				continue
+			}
+			cidrs = append(cidrs, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+			want = append(want, fmt.Sprintf("10.0.%d.%d/32", i/256, i%256))
+		}
+		err := AppendToIPSetConcurrent(ctx, aws.StringValue(ipSet.Id), ipSetName, cidrs, 8)
+		var batchErr *BatchError
+		if assert.ErrorAs(t, err, &batchErr) {
+			assert.Len(t, batchErr.Succeeded, 900)
+			assert.Len(t, batchErr.Failed, 100)
+			for i := 0; i < 1000; i += 10 {
+				assert.ErrorIs(t, batchErr.Failed[cidrs[i]], ErrInvalidCIDR, cidrs[i])
+			}
+		}
+		assert.Equal(t, want, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("update error", func(t *testing.T) {
+		useFakeWAFV2API(t)
+		err := AppendToIPSetConcurrent(ctx, "no-such-id", ipSetName, []string{"192.0.2.1", "foo"}, 2)
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+	})
+}
+
+func TestBatchError(t *testing.T) {
+	ctx := context.Background()
+	t.Run("invalid cidrs do not prevent the valid ones", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.3/32")
+		err := RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "foo", "192.0.2.2/33", "192.0.2.3"})
+		var batchErr *BatchError
+		assert.True(t, errors.As(err, &batchErr))
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.3"}, batchErr.Succeeded)
+		assert.EqualError(t, err, `ipset: 2 of 4 cidrs failed: 192.0.2.2/33: ipset: invalid cidr: "192.0.2.2/33" (and 1 more)`)
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("update error fails all the valid cidrs", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.removeIPSet(ScopeRegional, aws.StringValue(ipSet.Id))
+		err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"})
+		var batchErr *BatchError
+		assert.True(t, errors.As(err, &batchErr))
+		assert.Empty(t, batchErr.Succeeded)
+		assert.ErrorIs(t, batchErr.Failed["192.0.2.1"], ErrIPSetNotFound)
+		assert.ErrorIs(t, batchErr.Failed["192.0.2.2"], ErrIPSetNotFound)
+	})
+	t.Run("all succeeded", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"}))
+	})
+}
+
+func TestWithoutDedupeCheck(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+	changed, err := AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", WithoutDedupeCheck())
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	// the existence is not checked, so the ip set is updated
+	changed, err = AppendToIPSetChanged(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", WithoutDedupeCheck())
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 2, fake.UpdateCalls)
+	t.Run("duplicated cidrs", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.2/32", "192.0.2.3"}, WithoutDedupeCheck()))
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+}
+
+func TestAppendCIDRs_IPSetFull(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	addresses := make([]string, MaxAddressesPerIPSet-2)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("10.0.%d.%d/32", i/256, i%256)
+	}
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", addresses...)
+	err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32", addresses[0]})
+	var fullErr *IPSetFullError
+	assert.True(t, errors.As(err, &fullErr))
+	assert.ErrorIs(t, err, ErrIPSetFull)
+	assert.Equal(t, MaxAddressesPerIPSet-2, fullErr.Size)
+	assert.Equal(t, 3, fullErr.Appending)
+	assert.Equal(t, 2, fullErr.Available())
+	assert.Equal(t, 0, fake.UpdateCalls)
+	// the addresses that fit can be appended
+	assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32", "192.0.2.2/32"}))
+}
+
+func TestWithDedupWindow(t *testing.T) {
+	ctx := context.Background()
+	t.Run("repeated append", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(fake, WithDedupWindow(time.Minute))
+		assert.NoError(t, c.AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.3"}))
+		var change *Change
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2/32", WithOnChange(func(c *Change) {
+			change = c
+		})))
+		assert.Equal(t, &Change{Size: 3}, change)
+		assert.Equal(t, 1, fake.GetCalls)
+		// a cidr not remembered
+		assert.NoError(t, c.AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.1"}))
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("remove after append", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithDedupWindow(time.Minute))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 3, fake.UpdateCalls)
+	})
+	t.Run("forgotten on set", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithDedupWindow(time.Minute))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.NoError(t, c.ClearIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("expired", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithDedupWindow(time.Millisecond))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("disabled by default", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+}
+
+func TestWithMaxAddresses(t *testing.T) {
+	ctx := context.Background()
+	t.Run("evict oldest", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32")
+		var change *Change
+		err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.4", "192.0.2.5"},
+			WithMaxAddresses(3, EvictOldest), WithOnChange(func(c *Change) {
+				change = c
+			}))
+		assert.NoError(t, err)
+		// 192.0.2.1/32 being appended again is kept
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.4/32", "192.0.2.5/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, &Change{Added: []string{"192.0.2.4/32", "192.0.2.5/32"}, Removed: []string{"192.0.2.2/32", "192.0.2.3/32"}, Size: 3}, change)
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("within the limit", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", WithMaxAddresses(2, EvictOldest)))
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("custom evict func", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "10.0.0.0/8", "192.0.2.1/32", "192.0.2.2/32")
+		// keep the prefixes and evict the single addresses
+		evictHosts := func(addresses []string, n int) []string {
+			var hosts []string
+			for _, a := range addresses {
+				if strings.HasSuffix(a, "/32") && len(hosts) < n {
+					hosts = append(hosts, a)
+				}
+			}
+			return hosts
+		}
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "198.51.100.0/24", WithMaxAddresses(3, evictHosts)))
+		assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.2/32", "198.51.100.0/24"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("not enough evicted", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.3", "192.0.2.4"}, WithMaxAddresses(2, nil))
+		var fullErr *IPSetFullError
+		if assert.True(t, errors.As(err, &fullErr)) {
+			assert.Equal(t, &IPSetFullError{Size: 2, Limit: 2, Appending: 2}, fullErr)
+		}
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("full ip set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", largeAddresses(0, MaxAddressesPerIPSet)...)
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithMaxAddresses(MaxAddressesPerIPSet, EvictOldest)))
+		addresses := fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id))
+		assert.Len(t, addresses, MaxAddressesPerIPSet)
+		assert.Equal(t, "192.0.2.1/32", addresses[len(addresses)-1])
+		assert.NotContains(t, addresses, largeAddresses(0, 1)[0])
+	})
+}
+
+func TestRemoveCIDRs(t *testing.T) {
+	ctx := context.Background()
+	t.Run("remove cidrs in a single update", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32")
+		cidrs := []string{"192.0.2.1/32", "192.0.2.3/32", "192.0.2.4/32"}
+		assert.NoError(t, RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, cidrs))
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("no cidrs exist", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2/32"}))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("re-read addresses on optimistic lock error", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32")
+		// another writer removes 192.0.2.3/32 concurrently
+		fake.BeforeUpdate = fake.ConcurrentWrite(1, "192.0.2.1/32", "192.0.2.2/32")
+		assert.NoError(t, RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32"}))
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 2, fake.UpdateCalls)
+	})
+}
+
+func TestApplyChanges(t *testing.T) {
+	ctx := context.Background()
+	t.Run("add and remove", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		result, err := ApplyChanges(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.3", "192.0.2.2", "192.0.2.4"}, []string{"192.0.2.1", "192.0.2.5", "192.0.2.4"})
+		assert.NoError(t, err)
+		// 192.0.2.4 is in both of them and removed
+		assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, &ChangesResult{
+			Added:          []string{"192.0.2.3/32"},
+			AlreadyPresent: []string{"192.0.2.2/32"},
+			Removed:        []string{"192.0.2.1/32"},
+			NotPresent:     []string{"192.0.2.5/32", "192.0.2.4/32"},
+		}, result)
+		assert.Equal(t, 1, fake.GetCalls)
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("already applied", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		result, err := ApplyChanges(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.1/32"}, []string{"192.0.2.2"})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, fake.UpdateCalls)
+		assert.Equal(t, &ChangesResult{AlreadyPresent: []string{"192.0.2.1/32"}, NotPresent: []string{"192.0.2.2/32"}}, result)
+	})
+	t.Run("reapply on optimistic lock error", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		fake.BeforeUpdate = fake.ConcurrentWrite(1, "192.0.2.1/32", "198.51.100.1/32")
+		result, err := ApplyChanges(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2"}, []string{"192.0.2.1"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"198.51.100.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, &ChangesResult{Added: []string{"192.0.2.2/32"}, Removed: []string{"192.0.2.1/32"}}, result)
+		assert.Equal(t, 2, fake.UpdateCalls)
+	})
+	t.Run("full ip set", func(t *testing.T) {
+		// the removals make room for the additions
+		addresses := make([]string, MaxAddressesPerIPSet)
+		for i := range addresses {
+			addresses[i] = netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String() + "/32"
+		}
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", addresses...)
+		_, err := ApplyChanges(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1"}, []string{addresses[0]})
+		assert.NoError(t, err)
+		assert.Len(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)), MaxAddressesPerIPSet)
+	})
+	t.Run("invalid cidr", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		_, err := ApplyChanges(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1"}, []string{"foo"})
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.Equal(t, 0, fake.GetCalls)
+	})
+}
+
+func TestSetAddresses(t *testing.T) {
+	ctx := context.Background()
+	t.Run("reconcile to cidrs", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		change, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.3/32", "192.0.2.3/32"})
+		assert.NoError(t, err)
+		assert.Equal(t, &Change{Added: []string{"192.0.2.3/32"}, Removed: []string{"192.0.2.1/32"}, Size: 2}, change)
+		assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("already in sync", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		change, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2/32", "192.0.2.1/32"})
+		assert.NoError(t, err)
+		assert.False(t, change.Changed())
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("recompute on optimistic lock error", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		fake.BeforeUpdate = fake.ConcurrentWrite(1, "192.0.2.1/32", "198.51.100.1/32")
+		change, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2/32"})
+		assert.NoError(t, err)
+		assert.Equal(t, &Change{Added: []string{"192.0.2.2/32"}, Removed: []string{"192.0.2.1/32", "198.51.100.1/32"}, Size: 1}, change)
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestWithMinAddresses(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32")
+	guard := WithMinAddresses(2)
+	_, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, nil, guard)
+	assert.ErrorIs(t, err, ErrWouldUnderflow)
+	assert.EqualError(t, err, "ipset: ip set would underflow: removing 3 of 3 addresses goes below the minimum of 2")
+	err = RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"}, guard)
+	assert.ErrorIs(t, err, ErrWouldUnderflow)
+	_, err = Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1"}, guard)
+	assert.ErrorIs(t, err, ErrWouldUnderflow)
+	assert.Equal(t, 0, fake.UpdateCalls)
+
+	assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", guard))
+	assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	t.Run("below the minimum already", func(t *testing.T) {
+		// an update that does not remove addresses is allowed
+		_, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.3", "192.0.2.4"}, WithMinAddresses(5))
+		assert.NoError(t, err)
+	})
+	t.Run("clear", func(t *testing.T) {
+		assert.NoError(t, ClearIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, guard))
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestSetAddresses_Large(t *testing.T) {
+	// half of the addresses are replaced. With the linear scans this took about 1e8 comparisons
+	n := MaxAddressesPerIPSet
+	current, desired := largeAddresses(0, n), largeAddresses(n/2, n)
+	next, change, err := setAddresses(current, desired)
+	assert.NoError(t, err)
+	assert.Equal(t, append(largeAddresses(n/2, n/2), largeAddresses(n, n/2)...), next)
+	assert.Len(t, change.Added, n/2)
+	assert.Len(t, change.Removed, n/2)
+
+	next, change, err = appendToIPSet(largeAddresses(0, n/2), largeAddresses(0, n))
+	assert.NoError(t, err)
+	assert.Equal(t, largeAddresses(0, n), next)
+	assert.Len(t, change.Added, n/2)
+
+	next, change, err = removeFromIPSet(largeAddresses(0, n), largeAddresses(n/2, n))
+	assert.NoError(t, err)
+	assert.Equal(t, largeAddresses(0, n/2), next)
+	assert.Len(t, change.Removed, n/2)
+}
+
+func BenchmarkSetAddresses(b *testing.B) {
+	for _, n := range []int{1000, 5000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			current, desired := largeAddresses(0, n), largeAddresses(n/2, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := setAddresses(current, desired); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// largeAddresses returns n distinct /32 addresses starting from the start-th one
+func largeAddresses(start, n int) []string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		j := start + i
+		addresses[i] = fmt.Sprintf("10.%d.%d.%d/32", j>>16&0xff, j>>8&0xff, j&0xff)
+	}
+	return addresses
+}
+
+func TestWithDryRun(t *testing.T) {
+	ctx := context.Background()
+	t.Run("append", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		var change *Change
+		err := AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"}, WithDryRun(), WithOnChange(func(c *Change) {
+			change = c
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, &Change{Added: []string{"192.0.2.2/32"}, Size: 2}, change)
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		change, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2/32"}, WithDryRun())
+		assert.NoError(t, err)
+		assert.Equal(t, &Change{Added: []string{"192.0.2.2/32"}, Removed: []string{"192.0.2.1/32"}, Size: 1}, change)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("errors are reported", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6")
+		err := RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithDryRun(), WithOnChange(func(*Change) {
+			t.Error("unexpected call")
+		}))
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+	})
+}
+
+func TestWithDescription(t *testing.T) {
+	ctx := context.Background()
+	t.Run("kept on append", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description = aws.String("blocked by the admin")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, "blocked by the admin", aws.StringValue(fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description))
+	})
+	t.Run("set", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithDescription("blocklist")))
+		assert.Equal(t, "blocklist", aws.StringValue(fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description))
+	})
+	t.Run("updated without address changes", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithDescription("blocklist")))
+		assert.Equal(t, "blocklist", aws.StringValue(fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description))
+		assert.Equal(t, 1, fake.UpdateCalls)
+		// the same description
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithDescription("blocklist")))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("removed", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description = aws.String("blocked by the admin")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithDescription("")))
+		assert.Nil(t, fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description)
+	})
+}
+
+func TestUpdateIPSet_PreservesFields(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV6", "2001:db8::1/128")
+	fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet.Description = aws.String("blocked by the admin")
+	before := fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet
+
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "2001:db8::2"))
+	after := fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).IPSet
+	assert.Equal(t, []string{"2001:db8::1/128", "2001:db8::2/128"}, aws.StringValueSlice(after.Addresses))
+	before.Addresses, after.Addresses = nil, nil
+	assert.Equal(t, before, after)
+}
+
+// requestOptionsAPI applies the request options passed to GetIPSet and UpdateIPSet to a request named after the call
+type requestOptionsAPI struct {
+	*fakeWAFV2API
+}
+
+func (a *requestOptionsAPI) GetIPSetWithContext(ctx aws.Context, in *wafv2.GetIPSetInput, opts ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	(&request.Request{Operation: &request.Operation{Name: "GetIPSet"}}).ApplyOptions(opts...)
+	return a.fakeWAFV2API.GetIPSetWithContext(ctx, in, opts...)
+}
+
+func (a *requestOptionsAPI) UpdateIPSetWithContext(ctx aws.Context, in *wafv2.UpdateIPSetInput, opts ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
+	(&request.Request{Operation: &request.Operation{Name: "UpdateIPSet"}}).ApplyOptions(opts...)
+	return a.fakeWAFV2API.UpdateIPSetWithContext(ctx, in, opts...)
+}
+
+func (a *requestOptionsAPI) ListIPSetsWithContext(ctx aws.Context, in *wafv2.ListIPSetsInput, opts ...request.Option) (*wafv2.ListIPSetsOutput, error) {
+	(&request.Request{Operation: &request.Operation{Name: "ListIPSets"}}).ApplyOptions(opts...)
+	return a.fakeWAFV2API.ListIPSetsWithContext(ctx, in, opts...)
+}
+
+func (a *requestOptionsAPI) DeleteIPSetWithContext(ctx aws.Context, in *wafv2.DeleteIPSetInput, opts ...request.Option) (*wafv2.DeleteIPSetOutput, error) {
+	(&request.Request{Operation: &request.Operation{Name: "DeleteIPSet"}}).ApplyOptions(opts...)
+	return a.fakeWAFV2API.DeleteIPSetWithContext(ctx, in, opts...)
+}
+
+func TestWithRequestOptions(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	var calls []string
+	record := func(prefix string) request.Option {
+		return func(r *request.Request) {
+			calls = append(calls, prefix+r.Operation.Name)
+		}
+	}
+	c := NewClient(&requestOptionsAPI{fakeWAFV2API: fake}, WithRequestOptions(record("client:")))
+	assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithRequestOptions(record("call:"))))
+	assert.Equal(t, []string{"client:GetIPSet", "call:GetIPSet", "client:UpdateIPSet", "call:UpdateIPSet"}, calls)
+
+	// the options of a call do not leak into the client
+	calls = nil
+	_, err := c.ListAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"client:GetIPSet"}, calls)
+
+	t.Run("operations without options", func(t *testing.T) {
+		calls = nil
+		_, err := c.FindIPSetIDByName(ctx, ipSetName, ScopeRegional)
+		assert.NoError(t, err)
+		current := fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id))
+		_, err = c.UpdateAddressesWithToken(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, current.LockToken, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, c.DeleteIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, WithRequestOptions(record("call:"))))
+		assert.Equal(t, []string{
+			"client:ListIPSets",
+			"client:UpdateIPSet",
+			"client:GetIPSet", "call:GetIPSet", "client:DeleteIPSet", "call:DeleteIPSet",
+		}, calls)
+	})
+}
+
+func TestWithUserAgent(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	var userAgents []string
+	record := WithRequestOptions(func(r *request.Request) {
+		r.HTTPRequest = &http.Request{Header: http.Header{"User-Agent": []string{"aws-sdk-go"}}}
+		r.Handlers.Build.Run(r)
+		userAgents = append(userAgents, r.HTTPRequest.Header.Get("User-Agent"))
+	})
+	c := NewClient(&requestOptionsAPI{fakeWAFV2API: fake}, WithUserAgent("blocklist-bot/1.0"))
+	assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", record))
+	assert.Equal(t, []string{"aws-sdk-go blocklist-bot/1.0", "aws-sdk-go blocklist-bot/1.0"}, userAgents)
+}
+
+func TestWithForceUpdate(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+	token := fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).LockToken
+	assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithForceUpdate()))
+	assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2", WithForceUpdate()))
+	assert.Equal(t, 2, fake.UpdateCalls)
+	assert.NotEqual(t, token, fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)).LockToken)
+	assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	t.Run("dry run", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithForceUpdate(), WithDryRun()))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+}
+
+func TestPlan(t *testing.T) {
+	ctx := context.Background()
+	t.Run("plan and apply", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+		plan, err := Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.3"})
+		assert.NoError(t, err)
+		assert.True(t, plan.Changed())
+		assert.Equal(t, []string{"192.0.2.3/32"}, plan.Add)
+		assert.Equal(t, []string{"192.0.2.1/32"}, plan.Remove)
+		assert.Equal(t, 2, plan.Size)
+		assert.Equal(t, 0, fake.UpdateCalls)
+
+		assert.NoError(t, Apply(ctx, plan))
+		assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 1, fake.UpdateCalls)
+	})
+	t.Run("no change", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		plan, err := Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32"})
+		assert.NoError(t, err)
+		assert.False(t, plan.Changed())
+		assert.NoError(t, Apply(ctx, plan))
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("stale plan", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		plan, err := Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2/32"})
+		assert.NoError(t, err)
+		// another writer modifies the IP set after the plan
+		assert.NoError(t, AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.3/32"))
+
+		assert.ErrorIs(t, Apply(ctx, plan), ErrStalePlan)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("scope of the plan", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+		plan, err := Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1/32"}, WithScope(ScopeCloudFront))
+		assert.NoError(t, err)
+		assert.Equal(t, ScopeCloudFront, plan.Scope)
+		assert.NoError(t, Apply(ctx, plan))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeCloudFront, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestWithGetCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	t.Run("plan and apply share the get", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(fake, WithGetCacheTTL(time.Minute))
+		plan, err := c.Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2"})
+		assert.NoError(t, err)
+		assert.NoError(t, c.Apply(ctx, plan))
+		assert.Equal(t, 1, fake.GetCalls)
+		assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		// dropped by the update
+		_, err = c.ListAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("disabled by default", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(fake)
+		plan, err := c.Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2"})
+		assert.NoError(t, err)
+		assert.NoError(t, c.Apply(ctx, plan))
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("stale cache", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(fake, WithGetCacheTTL(time.Minute), WithBackoff(ConstantBackoff(0, 0)))
+		plan, err := c.Plan(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2"})
+		assert.NoError(t, err)
+		// another writer modifies the IP set after the plan
+		s := fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id))
+		s.IPSet.Addresses = aws.StringSlice([]string{"192.0.2.3/32"})
+		s.Rotate()
+
+		// the update with the cached lock token fails, and the change computed again from the fresh IP set differs
+		assert.ErrorIs(t, c.Apply(ctx, plan), ErrStalePlan)
+		assert.Equal(t, 2, fake.GetCalls)
+		assert.Equal(t, 1, fake.UpdateCalls)
+		assert.Equal(t, []string{"192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestClearIPSet(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+	assert.NoError(t, ClearIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName))
+	assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	assert.Equal(t, 1, fake.UpdateCalls)
+	// already empty
+	assert.NoError(t, ClearIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName))
+	assert.Equal(t, 1, fake.UpdateCalls)
+}
+
+// TestConcurrentWriters runs writers appending and removing overlapping CIDRs concurrently.
+// The writers keep conflicting on the lock token, and every change must survive the retries
+func TestConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	const writers = 8
+	fake := newFakeWAFV2API()
+	var seed []string
+	for i := 0; i < writers*2; i++ {
+		seed = append(seed, fmt.Sprintf("198.51.100.%d/32", i))
+	}
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", seed...)
+	c := NewClient(slowGetAPI{fake}, WithRetryConfig(RetryConfig{MaxAttempts: 100}), WithBackoff(ConstantBackoff(0, time.Millisecond)))
+
+	want := map[string]struct{}{}
+	for _, s := range seed[writers+1:] {
+		want[s] = struct{}{}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		// writer w appends 192.0.2.w-(w+2) and removes 198.51.100.w-(w+1), overlapping with the next writer
+		appending := []string{fmt.Sprintf("192.0.2.%d", w), fmt.Sprintf("192.0.2.%d", w+1), fmt.Sprintf("192.0.2.%d", w+2)}
+		removing := []string{fmt.Sprintf("198.51.100.%d", w), fmt.Sprintf("198.51.100.%d", w+1)}
+		for _, a := range appending {
+			want[a+"/32"] = struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range appending {
+				assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, appending[i]))
+				if i < len(removing) {
+					assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, removing[i]))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := map[string]struct{}{}
+	for _, a := range fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)) {
+		got[a] = struct{}{}
+	}
+	assert.Equal(t, want, got)
+	// the writers conflicted and retried
+	assert.Greater(t, fake.UpdateCalls, writers*5)
+}
+
+// slowGetAPI delays GetIPSet so that concurrent writers conflict on the lock token
+type slowGetAPI struct {
+	*fakeWAFV2API
+}
+
+func (a slowGetAPI) GetIPSetWithContext(ctx aws.Context, in *wafv2.GetIPSetInput, opts ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	out, err := a.fakeWAFV2API.GetIPSetWithContext(ctx, in, opts...)
+	time.Sleep(time.Millisecond)
+	return out, err
+}
+
+func TestUpdateAddressesWithToken(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakeWAFV2API(t)
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+	token, err := UpdateAddressesWithToken(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, aws.StringValue(ipSet.LockToken), []string{"192.0.2.2", "192.0.2.3/32"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	assert.Equal(t, 0, fake.GetCalls)
+	t.Run("next token", func(t *testing.T) {
+		next, err := UpdateAddressesWithToken(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, token, nil)
+		assert.NoError(t, err)
+		assert.NotEqual(t, token, next)
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("stale token", func(t *testing.T) {
+		_, err := UpdateAddressesWithToken(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, token, []string{"192.0.2.4"})
+		var lockErr *wafv2.WAFOptimisticLockException
+		assert.True(t, errors.As(err, &lockErr))
+		assert.Equal(t, 3, fake.UpdateCalls)
+	})
+	t.Run("description", func(t *testing.T) {
+		s := fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id))
+		s.IPSet.Description = aws.String("blocklist")
+		snap, err := CaptureSnapshot(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.NoError(t, err)
+		assert.Equal(t, "blocklist", snap.Description)
+		token, err := UpdateAddressesWithToken(ctx, snap.ID, snap.Name, snap.Scope, snap.LockToken, []string{"192.0.2.5"}, WithDescription(snap.Description))
+		assert.NoError(t, err)
+		assert.Equal(t, "blocklist", aws.StringValue(s.IPSet.Description))
+		// reset without WithDescription
+		_, err = UpdateAddressesWithToken(ctx, snap.ID, snap.Name, snap.Scope, token, []string{"192.0.2.5"})
+		assert.NoError(t, err)
+		assert.Nil(t, s.IPSet.Description)
+	})
+}
+
+func TestEnsureIPSet(t *testing.T) {
+	ctx := context.Background()
+	t.Run("create with tags", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		id, err := EnsureIPSet(ctx, ipSetName, ScopeRegional, IPv4, map[string]string{"team": "sre", "env": "prod"})
+		assert.NoError(t, err)
+		s := fake.ipSet(ScopeRegional, id)
+		assert.Equal(t, "IPV4", aws.StringValue(s.IPSet.IPAddressVersion))
+		assert.Equal(t, []*wafv2.Tag{
+			{Key: aws.String("env"), Value: aws.String("prod")},
+			{Key: aws.String("team"), Value: aws.String("sre")},
+		}, s.Tags)
+	})
+	t.Run("already exists", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		id, err := EnsureIPSet(ctx, ipSetName, ScopeRegional, IPv4, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, aws.StringValue(ipSet.Id), id)
+		assert.Equal(t, 0, fake.CreateCalls)
+	})
+	t.Run("created concurrently", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		var other *wafv2.IPSetSummary
+		fake.BeforeCreate = func() {
+			other = fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		}
+		id, err := EnsureIPSet(ctx, ipSetName, ScopeRegional, IPv4, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, aws.StringValue(other.Id), id)
+		assert.Equal(t, 1, fake.CreateCalls)
+	})
+	t.Run("invalid ip address version", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		_, err := EnsureIPSet(ctx, ipSetName, ScopeRegional, "IPV5", nil)
+		assert.Error(t, err)
+		assert.Equal(t, 0, fake.ListCalls)
+	})
+}
+
+func TestCreateIPSet(t *testing.T) {
+	ctx := context.Background()
+	t.Run("create with addresses", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		id, err := CreateIPSet(ctx, ipSetName, ScopeCloudFront, IPv4, []string{"192.0.2.1", "192.0.2.1/32", "198.51.100.7/24"}, "seeded")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1/32", "198.51.100.0/24"}, fake.addresses(ScopeCloudFront, id))
+		assert.Equal(t, "seeded", aws.StringValue(fake.ipSet(ScopeCloudFront, id).IPSet.Description))
+	})
+	t.Run("empty description", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		id, err := CreateIPSet(ctx, ipSetName, ScopeRegional, IPv4, nil, "")
+		assert.NoError(t, err)
+		assert.Nil(t, fake.ipSet(ScopeRegional, id).IPSet.Description)
+	})
+	t.Run("already exists", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		_, err := CreateIPSet(ctx, ipSetName, ScopeRegional, IPv4, nil, "")
+		assert.ErrorIs(t, err, ErrIPSetExists)
+		var dupErr *wafv2.WAFDuplicateItemException
+		assert.True(t, errors.As(err, &dupErr))
+	})
+	t.Run("invalid cidrs", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		_, err := CreateIPSet(ctx, ipSetName, ScopeRegional, IPv4, []string{"foo"}, "")
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.Equal(t, 0, fake.CreateCalls)
+	})
+	t.Run("address family mismatch", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		_, err := CreateIPSet(ctx, ipSetName, ScopeRegional, IPv4, []string{"192.0.2.1", "2001:db8::1", "2001:db8::/32"}, "")
+		var familyErr *AddressFamilyMismatchError
+		if assert.ErrorAs(t, err, &familyErr) {
+			assert.Equal(t, []string{"2001:db8::1/128", "2001:db8::/32"}, familyErr.CIDRs)
+		}
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		_, err = CreateIPSet(ctx, ipSetName, ScopeRegional, IPv6, []string{"2001:db8::1", "192.0.2.1"}, "")
+		assert.ErrorIs(t, err, ErrAddressFamilyMismatch)
+		assert.Equal(t, 0, fake.CreateCalls)
+	})
+}
+
+func TestDeleteIPSet(t *testing.T) {
+	ctx := context.Background()
+	t.Run("delete", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, DeleteIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeCloudFront))
+		assert.Nil(t, fake.ipSet(ScopeCloudFront, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("retry on optimistic lock error", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeDelete = fake.ConcurrentWrite(1, "192.0.2.1/32")
+		assert.NoError(t, DeleteIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, WithBackoff(ConstantBackoff(0, 0))))
+		assert.Nil(t, fake.ipSet(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 2, fake.GetCalls)
+		assert.Equal(t, 2, fake.DeleteCalls)
+	})
+	t.Run("already deleted", func(t *testing.T) {
+		fake := useFakeWAFV2API(t)
+		err := DeleteIPSet(ctx, "no-such-id", ipSetName, ScopeRegional)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.Equal(t, 0, fake.DeleteCalls)
+	})
+}
+
 func existsCIDR(t *testing.T, ipSet *wafv2.IPSetSummary, cidr string) bool {
 	t.Helper()
-	api := newWAFv2()
+	api := mustNewWAFv2(t)
 	out, err := api.GetIPSet(&wafv2.GetIPSetInput{
 		Id:    ipSet.Id,
 		Name:  ipSet.Name,
@@ -140,6 +1492,15 @@ func existsCIDR(t *testing.T, ipSet *wafv2.IPSetSummary, cidr string) bool {
 	return false
 }
 
+func mustNewWAFv2(t *testing.T) wafv2iface.WAFV2API {
+	t.Helper()
+	api, err := newWAFv2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
 func setupIPSet(t *testing.T) *wafv2.IPSetSummary {
 	t.Helper()
 	for _, is := range listAllIPSets(t) {
@@ -149,7 +1510,7 @@ func setupIPSet(t *testing.T) *wafv2.IPSetSummary {
 			return is
 		}
 	}
-	api := newWAFv2()
+	api := mustNewWAFv2(t)
 	out, err := api.CreateIPSet(&wafv2.CreateIPSetInput{
 		Addresses:        []*string{},
 		IPAddressVersion: aws.String("IPV4"),
@@ -168,7 +1529,7 @@ func setCleanupIPSet(t *testing.T) {
 	t.Cleanup(func() {
 		for _, is := range listAllIPSets(t) {
 			if aws.StringValue(is.Name) == ipSetName {
-				api := newWAFv2()
+				api := mustNewWAFv2(t)
 				if _, err := api.DeleteIPSet(&wafv2.DeleteIPSetInput{
 					Id:        is.Id,
 					LockToken: is.LockToken,
@@ -185,7 +1546,7 @@ func setCleanupIPSet(t *testing.T) {
 
 func listAllIPSets(t *testing.T) []*wafv2.IPSetSummary {
 	t.Helper()
-	api := newWAFv2()
+	api := mustNewWAFv2(t)
 	var nextMarker *string = nil
 	ipSets := make([]*wafv2.IPSetSummary, 0)
 	for {
@@ -204,3 +1565,43 @@ func listAllIPSets(t *testing.T) []*wafv2.IPSetSummary {
 		}
 	}
 }
+
+// fakeWAFV2API is an ipsettest.Fake taking the Scope of this package
+type fakeWAFV2API struct {
+	*ipsettest.Fake
+}
+
+func newFakeWAFV2API() *fakeWAFV2API {
+	return &fakeWAFV2API{Fake: ipsettest.New()}
+}
+
+// useFakeWAFV2API replaces the WAFV2API of the package-level functions with a fakeWAFV2API
+func useFakeWAFV2API(t *testing.T) *fakeWAFV2API {
+	t.Helper()
+	fake := newFakeWAFV2API()
+	bk, bkCloudFront := newWAFv2, newCloudFrontWAFv2
+	t.Cleanup(func() {
+		newWAFv2, newCloudFrontWAFv2 = bk, bkCloudFront
+	})
+	newWAFv2 = func() (wafv2iface.WAFV2API, error) {
+		return fake, nil
+	}
+	newCloudFrontWAFv2 = newWAFv2
+	return fake
+}
+
+func (f *fakeWAFV2API) addIPSet(scope Scope, name, version string, addresses ...string) *wafv2.IPSetSummary {
+	return f.AddIPSet(string(scope), name, version, addresses...)
+}
+
+func (f *fakeWAFV2API) removeIPSet(scope Scope, id string) {
+	f.RemoveIPSet(string(scope), id)
+}
+
+func (f *fakeWAFV2API) ipSet(scope Scope, id string) *ipsettest.IPSet {
+	return f.IPSet(string(scope), id)
+}
+
+func (f *fakeWAFV2API) addresses(scope Scope, id string) []string {
+	return f.Addresses(string(scope), id)
+}
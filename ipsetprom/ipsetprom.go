@@ -0,0 +1,159 @@
+// Package ipsetprom exports the number of addresses of IP sets as Prometheus metrics,
+// e.g. to alarm when a blocklist approaches ipset.MaxAddressesPerIPSet
+package ipsetprom
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	ipset "github.com/kei2100/idempotent-aws-waf-ipset"
+)
+
+// DefaultConcurrency is the number of IP sets read at the same time on a scrape when WithConcurrency is not specified
+const DefaultConcurrency = 4
+
+// Target is an IP set whose addresses are counted by the Collector
+type Target struct {
+	IPSetID   string
+	IPSetName string
+	// Scope is the scope of the IP set, ipset.ScopeRegional if empty
+	Scope ipset.Scope
+}
+
+// Option configures a Collector
+type Option func(*Collector)
+
+// WithConcurrency sets the number of IP sets read at the same time on a scrape. The default is DefaultConcurrency,
+// and a concurrency less than 1 is treated as 1
+func WithConcurrency(n int) Option {
+	return func(c *Collector) {
+		if n < 1 {
+			n = 1
+		}
+		c.concurrency = n
+	}
+}
+
+// WithCacheTTL makes the scrapes within ttl reuse the number of addresses read by a previous scrape,
+// so that frequent scrapes do not call GetIPSet every time. The failures are not cached. The default is no cache
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(c *Collector) {
+		c.cacheTTL = ttl
+	}
+}
+
+// WithTimeout bounds the reads of the IP sets of a scrape by d. The default is no bound
+func WithTimeout(d time.Duration) Option {
+	return func(c *Collector) {
+		c.timeout = d
+	}
+}
+
+// Collector is a prometheus.Collector reading the IP sets on each scrape.
+// It exports the gauges waf_ipset_addresses with the number of addresses of each IP set,
+// and waf_ipset_scrape_success with 1 if the IP set was read and 0 otherwise.
+// Both of them have the labels ipset_id, ipset_name and scope, and waf_ipset_addresses is missing for an IP set not read
+type Collector struct {
+	client      *ipset.Client
+	targets     []Target
+	concurrency int
+	cacheTTL    time.Duration
+	timeout     time.Duration
+
+	addresses *prometheus.Desc
+	success   *prometheus.Desc
+
+	mu    sync.Mutex
+	cache map[Target]cached
+}
+
+type cached struct {
+	count     int
+	expiresAt time.Time
+}
+
+// NewCollector creates a Collector counting the addresses of targets with client
+func NewCollector(client *ipset.Client, targets []Target, opts ...Option) *Collector {
+	targets = append([]Target(nil), targets...)
+	for i := range targets {
+		if targets[i].Scope == "" {
+			targets[i].Scope = ipset.ScopeRegional
+		}
+	}
+	labels := []string{"ipset_id", "ipset_name", "scope"}
+	c := &Collector{
+		client:      client,
+		targets:     targets,
+		concurrency: DefaultConcurrency,
+		addresses:   prometheus.NewDesc("waf_ipset_addresses", "Number of addresses of the WAF IP set.", labels, nil),
+		success:     prometheus.NewDesc("waf_ipset_scrape_success", "Whether the WAF IP set was read by the last scrape.", labels, nil),
+		cache:       make(map[Target]cached),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.addresses
+	ch <- c.success
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	sem := make(chan struct{}, c.concurrency)
+	var wg sync.WaitGroup
+	for _, t := range c.targets {
+		t := t
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			labels := []string{t.IPSetID, t.IPSetName, string(t.Scope)}
+			count, err := c.count(ctx, t)
+			if err != nil {
+				ch <- prometheus.MustNewConstMetric(c.success, prometheus.GaugeValue, 0, labels...)
+				return
+			}
+			ch <- prometheus.MustNewConstMetric(c.addresses, prometheus.GaugeValue, float64(count), labels...)
+			ch <- prometheus.MustNewConstMetric(c.success, prometheus.GaugeValue, 1, labels...)
+		}()
+	}
+	wg.Wait()
+}
+
+// count returns the number of addresses of t, from the cache if it is not expired
+func (c *Collector) count(ctx context.Context, t Target) (int, error) {
+	if c.cacheTTL > 0 {
+		c.mu.Lock()
+		e, ok := c.cache[t]
+		c.mu.Unlock()
+		if ok && time.Now().Before(e.expiresAt) {
+			return e.count, nil
+		}
+	}
+	count, err := c.client.AddressCount(ctx, t.IPSetID, t.IPSetName, ipset.WithScope(t.Scope))
+	if err != nil {
+		return 0, err
+	}
+	if c.cacheTTL > 0 {
+		c.mu.Lock()
+		c.cache[t] = cached{count: count, expiresAt: time.Now().Add(c.cacheTTL)}
+		c.mu.Unlock()
+	}
+	return count, nil
+}
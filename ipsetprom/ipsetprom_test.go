@@ -0,0 +1,61 @@
+package ipsetprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	ipset "github.com/kei2100/idempotent-aws-waf-ipset"
+	"github.com/kei2100/idempotent-aws-waf-ipset/ipsettest"
+)
+
+func TestCollector(t *testing.T) {
+	fake := ipsettest.New()
+	block := fake.AddIPSet("REGIONAL", "block", "IPV4", "192.0.2.1/32", "192.0.2.2/32")
+	allow := fake.AddIPSet("CLOUDFRONT", "allow", "IPV6", "2001:db8::/32")
+	targets := []Target{
+		{IPSetID: aws.StringValue(block.Id), IPSetName: "block", Scope: ipset.ScopeRegional},
+		{IPSetID: aws.StringValue(allow.Id), IPSetName: "allow", Scope: ipset.ScopeCloudFront},
+		{IPSetID: "no-such-id", IPSetName: "missing", Scope: ipset.ScopeRegional},
+	}
+	c := NewCollector(ipset.NewClient(fake), targets, WithConcurrency(2), WithCacheTTL(time.Minute))
+	want := `
+# HELP waf_ipset_addresses Number of addresses of the WAF IP set.
+# TYPE waf_ipset_addresses gauge
+waf_ipset_addresses{ipset_id="` + aws.StringValue(allow.Id) + `",ipset_name="allow",scope="CLOUDFRONT"} 1
+waf_ipset_addresses{ipset_id="` + aws.StringValue(block.Id) + `",ipset_name="block",scope="REGIONAL"} 2
+# HELP waf_ipset_scrape_success Whether the WAF IP set was read by the last scrape.
+# TYPE waf_ipset_scrape_success gauge
+waf_ipset_scrape_success{ipset_id="` + aws.StringValue(allow.Id) + `",ipset_name="allow",scope="CLOUDFRONT"} 1
+waf_ipset_scrape_success{ipset_id="` + aws.StringValue(block.Id) + `",ipset_name="block",scope="REGIONAL"} 1
+waf_ipset_scrape_success{ipset_id="no-such-id",ipset_name="missing",scope="REGIONAL"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(want)))
+	assert.Equal(t, 3, fake.GetCalls)
+
+	t.Run("cache", func(t *testing.T) {
+		// the counts of the IP sets read are cached, and the failed one is read again
+		assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(want)))
+		assert.Equal(t, 4, fake.GetCalls)
+	})
+	t.Run("no cache", func(t *testing.T) {
+		c := NewCollector(ipset.NewClient(fake), targets[:1])
+		fake.GetCalls = 0
+		assert.Equal(t, 2, testutil.CollectAndCount(c))
+		assert.Equal(t, 2, testutil.CollectAndCount(c))
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("default scope", func(t *testing.T) {
+		c := NewCollector(ipset.NewClient(fake), []Target{{IPSetID: aws.StringValue(block.Id), IPSetName: "block"}})
+		want := `
+# HELP waf_ipset_addresses Number of addresses of the WAF IP set.
+# TYPE waf_ipset_addresses gauge
+waf_ipset_addresses{ipset_id="` + aws.StringValue(block.Id) + `",ipset_name="block",scope="REGIONAL"} 2
+`
+		assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(want), "waf_ipset_addresses"))
+	})
+}
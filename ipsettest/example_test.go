@@ -0,0 +1,26 @@
+package ipsettest_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	ipset "github.com/kei2100/idempotent-aws-waf-ipset"
+	"github.com/kei2100/idempotent-aws-waf-ipset/ipsettest"
+)
+
+func ExampleFake() {
+	fake := ipsettest.New()
+	ipSet := fake.AddIPSet("REGIONAL", "blocklist", "IPV4", "192.0.2.1/32")
+	// the first update conflicts with another writer and is retried
+	fake.InjectConflicts(1)
+
+	c := ipset.NewClient(fake, ipset.WithBackoff(ipset.ConstantBackoff(0, 0)))
+	if err := c.AppendToIPSet(context.Background(), aws.StringValue(ipSet.Id), "blocklist", "198.51.100.7"); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(fake.Addresses("REGIONAL", aws.StringValue(ipSet.Id)), fake.UpdateCalls)
+	// Output: [192.0.2.1/32 198.51.100.7/32] 2
+}
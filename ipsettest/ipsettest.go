@@ -0,0 +1,264 @@
+// Package ipsettest provides an in-memory WAFV2API to test the code using ipset without AWS
+package ipsettest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
+)
+
+// Fake is an in-memory WAFV2API holding IP sets with the lock token semantics of WAF:
+// the lock token changes on each update, and an update or a delete with a stale lock token
+// fails with WAFOptimisticLockException.
+// Only the IP set operations used by ipset are implemented, and the others panic.
+// The call counters and the hooks must not be accessed while operations are in progress
+type Fake struct {
+	wafv2iface.WAFV2API
+
+	mu     sync.Mutex
+	seq    int
+	ipSets map[string]*IPSet
+
+	// GetCalls is the number of GetIPSet calls
+	GetCalls int
+	// UpdateCalls is the number of UpdateIPSet calls
+	UpdateCalls int
+	// ListCalls is the number of ListIPSets calls
+	ListCalls int
+	// CreateCalls is the number of CreateIPSet calls
+	CreateCalls int
+	// DeleteCalls is the number of DeleteIPSet calls
+	DeleteCalls int
+
+	// BeforeUpdate is called with the IP set being updated before the lock token is checked.
+	// It can simulate a concurrent writer by modifying the IP set and calling Rotate
+	BeforeUpdate func(s *IPSet)
+	// BeforeDelete is called like BeforeUpdate with the IP set being deleted
+	BeforeDelete func(s *IPSet)
+	// BeforeCreate is called before the name of the IP set being created is checked for duplicates.
+	// It can simulate a concurrent creator by calling AddIPSet
+	BeforeCreate func()
+}
+
+// IPSet is an IP set held by Fake
+type IPSet struct {
+	IPSet     wafv2.IPSet
+	LockToken string
+	Tags      []*wafv2.Tag
+	rotate    func() string
+}
+
+// Rotate changes the lock token of the IP set as an update by another writer does
+func (s *IPSet) Rotate() {
+	s.LockToken = s.rotate()
+}
+
+// New creates an empty Fake
+func New() *Fake {
+	return &Fake{ipSets: make(map[string]*IPSet)}
+}
+
+func (f *Fake) key(scope, id string) string {
+	return scope + "/" + id
+}
+
+// AddIPSet adds an IP set and returns its summary
+func (f *Fake) AddIPSet(scope, name, version string, addresses ...string) *wafv2.IPSetSummary {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return summary(f.insert(scope, name, version, addresses...))
+}
+
+func (f *Fake) insert(scope, name, version string, addresses ...string) *IPSet {
+	f.seq++
+	id := fmt.Sprintf("id-%d", f.seq)
+	s := &IPSet{
+		IPSet: wafv2.IPSet{
+			ARN:              aws.String("arn:aws:wafv2:us-east-1:123456789012:" + scope + "/ipset/" + name + "/" + id),
+			Addresses:        aws.StringSlice(addresses),
+			IPAddressVersion: aws.String(version),
+			Id:               aws.String(id),
+			Name:             aws.String(name),
+		},
+		LockToken: fmt.Sprintf("token-%d", f.seq),
+		rotate:    f.nextToken,
+	}
+	f.ipSets[f.key(scope, id)] = s
+	return s
+}
+
+// nextToken must be called with f.mu held
+func (f *Fake) nextToken() string {
+	f.seq++
+	return fmt.Sprintf("token-%d", f.seq)
+}
+
+// ConcurrentWrite returns a BeforeUpdate hook that simulates another writer
+// replacing the addresses of the IP set on the first n updates
+func (f *Fake) ConcurrentWrite(n int, addresses ...string) func(s *IPSet) {
+	return func(s *IPSet) {
+		if n <= 0 {
+			return
+		}
+		n--
+		s.IPSet.Addresses = aws.StringSlice(addresses)
+		s.Rotate()
+	}
+}
+
+// InjectConflicts makes the next n updates fail with WAFOptimisticLockException
+// as if another writer updated the IP set without changing its addresses
+func (f *Fake) InjectConflicts(n int) {
+	f.BeforeUpdate = func(s *IPSet) {
+		if n <= 0 {
+			return
+		}
+		n--
+		s.Rotate()
+	}
+}
+
+// RemoveIPSet removes the IP set
+func (f *Fake) RemoveIPSet(scope, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.ipSets, f.key(scope, id))
+}
+
+// IPSet returns the IP set, or nil if it does not exist
+func (f *Fake) IPSet(scope, id string) *IPSet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ipSets[f.key(scope, id)]
+}
+
+// Addresses returns the addresses of the IP set
+func (f *Fake) Addresses(scope, id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return aws.StringValueSlice(f.ipSets[f.key(scope, id)].IPSet.Addresses)
+}
+
+func (f *Fake) lookup(scope, id, name *string) (*IPSet, error) {
+	s, ok := f.ipSets[f.key(aws.StringValue(scope), aws.StringValue(id))]
+	if !ok || aws.StringValue(s.IPSet.Name) != aws.StringValue(name) {
+		return nil, &wafv2.WAFNonexistentItemException{Message_: aws.String("ip set not found")}
+	}
+	return s, nil
+}
+
+// GetIPSetWithContext implements wafv2iface.WAFV2API
+func (f *Fake) GetIPSetWithContext(_ aws.Context, in *wafv2.GetIPSetInput, _ ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.GetCalls++
+	s, err := f.lookup(in.Scope, in.Id, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	ipSet := s.IPSet
+	ipSet.Addresses = aws.StringSlice(aws.StringValueSlice(s.IPSet.Addresses))
+	return &wafv2.GetIPSetOutput{IPSet: &ipSet, LockToken: aws.String(s.LockToken)}, nil
+}
+
+// UpdateIPSetWithContext implements wafv2iface.WAFV2API
+func (f *Fake) UpdateIPSetWithContext(_ aws.Context, in *wafv2.UpdateIPSetInput, _ ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.UpdateCalls++
+	s, err := f.lookup(in.Scope, in.Id, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	if f.BeforeUpdate != nil {
+		f.BeforeUpdate(s)
+	}
+	if aws.StringValue(in.LockToken) != s.LockToken {
+		return nil, &wafv2.WAFOptimisticLockException{Message_: aws.String("stale lock token")}
+	}
+	s.IPSet.Addresses = aws.StringSlice(aws.StringValueSlice(in.Addresses))
+	s.IPSet.Description = in.Description
+	s.Rotate()
+	return &wafv2.UpdateIPSetOutput{NextLockToken: aws.String(s.LockToken)}, nil
+}
+
+// ListIPSetsWithContext implements wafv2iface.WAFV2API
+func (f *Fake) ListIPSetsWithContext(_ aws.Context, in *wafv2.ListIPSetsInput, _ ...request.Option) (*wafv2.ListIPSetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ListCalls++
+	var keys []string
+	for k := range f.ipSets {
+		if strings.HasPrefix(k, aws.StringValue(in.Scope)+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(aws.StringValue(in.NextMarker))
+	end := start + int(aws.Int64Value(in.Limit))
+	out := &wafv2.ListIPSetsOutput{}
+	if end < len(keys) {
+		out.NextMarker = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(keys)
+	}
+	for _, k := range keys[start:end] {
+		out.IPSets = append(out.IPSets, summary(f.ipSets[k]))
+	}
+	return out, nil
+}
+
+// CreateIPSetWithContext implements wafv2iface.WAFV2API
+func (f *Fake) CreateIPSetWithContext(_ aws.Context, in *wafv2.CreateIPSetInput, _ ...request.Option) (*wafv2.CreateIPSetOutput, error) {
+	if f.BeforeCreate != nil {
+		f.BeforeCreate()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.CreateCalls++
+	for k, s := range f.ipSets {
+		if strings.HasPrefix(k, aws.StringValue(in.Scope)+"/") && aws.StringValue(s.IPSet.Name) == aws.StringValue(in.Name) {
+			return nil, &wafv2.WAFDuplicateItemException{Message_: aws.String("ip set already exists")}
+		}
+	}
+	s := f.insert(aws.StringValue(in.Scope), aws.StringValue(in.Name), aws.StringValue(in.IPAddressVersion), aws.StringValueSlice(in.Addresses)...)
+	s.IPSet.Description = in.Description
+	s.Tags = in.Tags
+	return &wafv2.CreateIPSetOutput{Summary: summary(s)}, nil
+}
+
+// DeleteIPSetWithContext implements wafv2iface.WAFV2API
+func (f *Fake) DeleteIPSetWithContext(_ aws.Context, in *wafv2.DeleteIPSetInput, _ ...request.Option) (*wafv2.DeleteIPSetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.DeleteCalls++
+	s, err := f.lookup(in.Scope, in.Id, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	if f.BeforeDelete != nil {
+		f.BeforeDelete(s)
+	}
+	if aws.StringValue(in.LockToken) != s.LockToken {
+		return nil, &wafv2.WAFOptimisticLockException{Message_: aws.String("stale lock token")}
+	}
+	delete(f.ipSets, f.key(aws.StringValue(in.Scope), aws.StringValue(in.Id)))
+	return &wafv2.DeleteIPSetOutput{}, nil
+}
+
+func summary(s *IPSet) *wafv2.IPSetSummary {
+	return &wafv2.IPSetSummary{
+		ARN:         s.IPSet.ARN,
+		Description: s.IPSet.Description,
+		Id:          s.IPSet.Id,
+		LockToken:   aws.String(s.LockToken),
+		Name:        s.IPSet.Name,
+	}
+}
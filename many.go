@@ -0,0 +1,117 @@
+package ipset
+
+import "context"
+
+// Entry is a CIDR to append to an IP set with AppendMany
+type Entry struct {
+	IPSetID   string
+	IPSetName string
+	// Scope is the scope of the IP set. The scope of the options is used if it is empty
+	Scope Scope
+	CIDR  string
+}
+
+// IPSetKey identifies an IP set updated by AppendMany
+type IPSetKey struct {
+	IPSetID   string
+	IPSetName string
+	Scope     Scope
+}
+
+// String returns the scope and the name of the IP set of k
+func (k IPSetKey) String() string {
+	return string(k.Scope) + "/" + k.IPSetName
+}
+
+// IPSetStatus is the outcome of an IP set of AppendMany
+type IPSetStatus string
+
+const (
+	// IPSetChanged is the status of an IP set to which some of the CIDRs were appended
+	IPSetChanged IPSetStatus = "changed"
+	// IPSetUnchanged is the status of an IP set which already had all of the CIDRs
+	IPSetUnchanged IPSetStatus = "unchanged"
+	// IPSetFailed is the status of an IP set whose update failed or which had invalid CIDRs
+	IPSetFailed IPSetStatus = "failed"
+)
+
+// IPSetResult is the result of an IP set of AppendMany
+type IPSetResult struct {
+	IPSetKey
+	Status IPSetStatus
+	// Err is the error of the IP set, nil unless Status is IPSetFailed
+	Err error
+	// Change is the change of the IP set, nil if it was not updated.
+	// An IP set with invalid CIDRs fails with the change of its valid ones
+	Change *Change
+}
+
+// ManyResult is the result of AppendMany
+type ManyResult struct {
+	// IPSets are the results of the IP sets, in the order of their first entries
+	IPSets []IPSetResult
+	// Remaining is the RetryBudget left when AppendMany finished, or nil without WithRetryBudget
+	Remaining *RetryBudget
+}
+
+// AppendMany appends the CIDRs of entries to their IP sets, and returns the result of each IP set.
+// The entries are grouped by IP set, and each IP set is updated once with all of its CIDRs by AppendCIDRs,
+// in the order of the first entry of each IP set. The entries without a scope are grouped with the scope of opts.
+// It returns a *ManyError summarizing the succeeded and the failed IP sets if any of them fails, along with the result.
+// The error of an IP set with invalid CIDRs is the *BatchError of AppendCIDRs, and its valid CIDRs are still appended.
+// With WithRetryBudget, the budget is shared by all the IP sets, and the IP sets not started when its time is over
+// fail with a *RetryBudgetExhaustedError without calling the WAFV2 API
+func (c *Client) AppendMany(ctx context.Context, entries []Entry, opts ...Option) (*ManyResult, error) {
+	o, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	var keys []IPSetKey
+	cidrs := make(map[IPSetKey][]string)
+	for _, e := range entries {
+		k := IPSetKey{IPSetID: e.IPSetID, IPSetName: e.IPSetName, Scope: e.Scope}
+		if k.Scope == "" {
+			k.Scope = o.scope
+		}
+		if _, ok := cidrs[k]; !ok {
+			keys = append(keys, k)
+		}
+		cidrs[k] = append(cidrs[k], e.CIDR)
+	}
+	result := &ManyResult{IPSets: make([]IPSetResult, 0, len(keys))}
+	manyErr := &ManyError{Failed: make(map[IPSetKey]error)}
+	opts = opts[:len(opts):len(opts)]
+	var budget *retryBudget
+	if o.retryBudget != nil {
+		budget = newRetryBudget(*o.retryBudget)
+		opts = append(opts, withBudget(budget))
+	}
+	for _, k := range keys {
+		r := IPSetResult{IPSetKey: k}
+		if budget != nil && budget.exhausted() {
+			r.Err = &RetryBudgetExhaustedError{}
+		} else {
+			r.Change, r.Err = c.batchChange(ctx, "append", appendToIPSet, k.IPSetID, k.IPSetName, cidrs[k], validateCIDRs(cidrs[k]), append(opts[:len(opts):len(opts)], WithScope(k.Scope)))
+		}
+		switch {
+		case r.Err != nil:
+			r.Status = IPSetFailed
+			manyErr.Failed[k] = r.Err
+		case r.Change != nil && r.Change.Changed():
+			r.Status = IPSetChanged
+			manyErr.Succeeded = append(manyErr.Succeeded, k)
+		default:
+			r.Status = IPSetUnchanged
+			manyErr.Succeeded = append(manyErr.Succeeded, k)
+		}
+		result.IPSets = append(result.IPSets, r)
+	}
+	if budget != nil {
+		remaining := budget.remaining()
+		result.Remaining = &remaining
+	}
+	if len(manyErr.Failed) == 0 {
+		return result, nil
+	}
+	return result, manyErr
+}
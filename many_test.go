@@ -0,0 +1,148 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kei2100/idempotent-aws-waf-ipset/ipsettest"
+)
+
+func TestAppendMany(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	regional := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	cf := fake.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+	other := fake.addIPSet(ScopeRegional, "other", "IPV4")
+	c := NewClient(fake)
+	regionalKey := IPSetKey{IPSetID: aws.StringValue(regional.Id), IPSetName: ipSetName, Scope: ScopeRegional}
+	cfKey := IPSetKey{IPSetID: aws.StringValue(cf.Id), IPSetName: ipSetName, Scope: ScopeCloudFront}
+	otherKey := IPSetKey{IPSetID: aws.StringValue(other.Id), IPSetName: "other", Scope: ScopeRegional}
+	entry := func(k IPSetKey, cidr string) Entry {
+		return Entry{IPSetID: k.IPSetID, IPSetName: k.IPSetName, Scope: k.Scope, CIDR: cidr}
+	}
+
+	result, err := c.AppendMany(ctx, []Entry{
+		{IPSetID: regionalKey.IPSetID, IPSetName: ipSetName, CIDR: "192.0.2.1"},
+		entry(cfKey, "192.0.2.2"),
+		entry(regionalKey, "192.0.2.3"),
+		entry(otherKey, "192.0.2.4"),
+		entry(cfKey, "192.0.2.2"),
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, result.IPSets, 3) {
+		assert.Equal(t, IPSetResult{IPSetKey: regionalKey, Status: IPSetChanged, Change: &Change{Added: []string{"192.0.2.1/32", "192.0.2.3/32"}, Size: 2}}, result.IPSets[0])
+		assert.Equal(t, cfKey, result.IPSets[1].IPSetKey)
+		assert.Equal(t, otherKey, result.IPSets[2].IPSetKey)
+	}
+	assert.Equal(t, 3, fake.GetCalls, "each IP set is updated once")
+	assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, regionalKey.IPSetID))
+	assert.Equal(t, []string{"192.0.2.2/32"}, fake.addresses(ScopeCloudFront, cfKey.IPSetID))
+	assert.Equal(t, []string{"192.0.2.4/32"}, fake.addresses(ScopeRegional, otherKey.IPSetID))
+
+	t.Run("partial failure", func(t *testing.T) {
+		fake.removeIPSet(ScopeRegional, otherKey.IPSetID)
+		result, err := c.AppendMany(ctx, []Entry{
+			entry(otherKey, "192.0.2.5"),
+			entry(regionalKey, "192.0.2.5"),
+			entry(cfKey, "foo"),
+			entry(cfKey, "192.0.2.6"),
+			entry(regionalKey, "192.0.2.1"),
+		})
+		if assert.Len(t, result.IPSets, 3) {
+			assert.Equal(t, IPSetFailed, result.IPSets[0].Status)
+			assert.ErrorIs(t, result.IPSets[0].Err, ErrIPSetNotFound)
+			assert.Nil(t, result.IPSets[0].Change)
+			assert.Equal(t, IPSetResult{IPSetKey: regionalKey, Status: IPSetChanged, Change: &Change{Added: []string{"192.0.2.5/32"}, Size: 3}}, result.IPSets[1])
+			// the valid cidrs of an IP set with invalid ones are appended
+			assert.Equal(t, IPSetFailed, result.IPSets[2].Status)
+			assert.ErrorIs(t, result.IPSets[2].Err, ErrInvalidCIDR)
+			assert.Equal(t, &Change{Added: []string{"192.0.2.6/32"}, Size: 2}, result.IPSets[2].Change)
+		}
+		var manyErr *ManyError
+		if assert.True(t, errors.As(err, &manyErr)) {
+			assert.Equal(t, []IPSetKey{cfKey, otherKey}, manyErr.FailedIPSets())
+			assert.Equal(t, []IPSetKey{regionalKey}, manyErr.Succeeded)
+			var batchErr *BatchError
+			if assert.True(t, errors.As(manyErr.Failed[cfKey], &batchErr)) {
+				assert.Equal(t, []string{"192.0.2.6"}, batchErr.Succeeded)
+			}
+		}
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.ErrorContains(t, err, "ipset: 2 of 3 ip sets failed: CLOUDFRONT/"+ipSetName+": ")
+		result, err = c.AppendMany(ctx, []Entry{entry(regionalKey, "192.0.2.1")})
+		assert.NoError(t, err)
+		assert.Equal(t, IPSetUnchanged, result.IPSets[0].Status)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.3/32", "192.0.2.5/32"}, fake.addresses(ScopeRegional, regionalKey.IPSetID))
+		// the valid cidrs of an IP set with invalid ones are appended
+		assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.6/32"}, fake.addresses(ScopeCloudFront, cfKey.IPSetID))
+	})
+}
+
+func TestAppendMany_RetryBudget(t *testing.T) {
+	ctx := context.Background()
+	fast := WithRetryConfig(RetryConfig{MaxAttempts: 10, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	newKeys := func(fake *fakeWAFV2API) []IPSetKey {
+		var keys []IPSetKey
+		for _, name := range []string{"first", "second", "third"} {
+			ipSet := fake.addIPSet(ScopeRegional, name, "IPV4")
+			keys = append(keys, IPSetKey{IPSetID: aws.StringValue(ipSet.Id), IPSetName: name, Scope: ScopeRegional})
+		}
+		return keys
+	}
+	entries := func(keys []IPSetKey) []Entry {
+		var entries []Entry
+		for _, k := range keys {
+			entries = append(entries, Entry{IPSetID: k.IPSetID, IPSetName: k.IPSetName, Scope: k.Scope, CIDR: "192.0.2.1"})
+		}
+		return entries
+	}
+	t.Run("retries", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		keys := newKeys(fake)
+		fake.InjectConflicts(3)
+		result, err := NewClient(fake).AppendMany(ctx, entries(keys), fast, WithRetryBudget(RetryBudget{Retries: 2}))
+		assert.Equal(t, &RetryBudget{}, result.Remaining)
+		var manyErr *ManyError
+		if assert.True(t, errors.As(err, &manyErr)) {
+			assert.Equal(t, []IPSetKey{keys[0]}, manyErr.FailedIPSets())
+			assert.Equal(t, keys[1:], manyErr.Succeeded)
+		}
+		assert.ErrorIs(t, err, ErrRetryBudgetExhausted)
+		assert.True(t, IsOptimisticLock(manyErr.Failed[keys[0]]))
+		assert.Equal(t, 5, fake.UpdateCalls)
+	})
+	t.Run("time", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		keys := newKeys(fake)
+		fake.BeforeUpdate = func(*ipsettest.IPSet) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		result, err := NewClient(fake).AppendMany(ctx, entries(keys), WithRetryBudget(RetryBudget{Retries: 10, Time: 10 * time.Millisecond}))
+		assert.Equal(t, []IPSetStatus{IPSetChanged, IPSetFailed, IPSetFailed}, []IPSetStatus{result.IPSets[0].Status, result.IPSets[1].Status, result.IPSets[2].Status})
+		var manyErr *ManyError
+		if assert.True(t, errors.As(err, &manyErr)) {
+			assert.Equal(t, keys[:1], manyErr.Succeeded)
+			assert.Equal(t, keys[1:], manyErr.FailedIPSets())
+			assert.EqualError(t, manyErr.Failed[keys[1]], "ipset: retry budget exhausted: not started")
+		}
+		assert.Equal(t, &RetryBudget{Retries: 10}, result.Remaining)
+		assert.Equal(t, 1, fake.GetCalls)
+	})
+	t.Run("all succeeded", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		keys := newKeys(fake)
+		fake.InjectConflicts(1)
+		result, err := NewClient(fake).AppendMany(ctx, entries(keys), fast, WithRetryBudget(RetryBudget{Retries: 2}))
+		assert.NoError(t, err)
+		assert.Equal(t, &RetryBudget{Retries: 1}, result.Remaining)
+		result, err = NewClient(fake).AppendMany(ctx, entries(keys))
+		assert.NoError(t, err)
+		assert.Nil(t, result.Remaining)
+	})
+}
@@ -0,0 +1,36 @@
+package ipset
+
+import (
+	"context"
+	"fmt"
+)
+
+// MetadataStore keeps the metadata of the addresses that WAF IP sets cannot hold, such as why and by whom an address is blocked.
+// It can be implemented with DynamoDB, for example, to keep an audit trail of the IP sets
+type MetadataStore interface {
+	// Record is called for each address appended to or removed from an IP set by a successful operation.
+	// op is "append" or "remove", and meta is the metadata given by WithMetadata, which may be nil
+	Record(ctx context.Context, cidr, op string, meta map[string]string) error
+}
+
+// recordMetadata records the addresses changed by change to the MetadataStore of o.
+// The errors of the store are returned only if the store is required
+func recordMetadata(ctx context.Context, o *options, change *Change) error {
+	if o.metadataStore == nil || o.dryRun {
+		return nil
+	}
+	var errs []error
+	record := func(cidrs []string, op string) {
+		for _, cidr := range cidrs {
+			if err := o.metadataStore.Record(ctx, cidr, op, o.metadata); err != nil {
+				errs = append(errs, fmt.Errorf("ipset: record metadata: %s %s: %w", op, cidr, err))
+			}
+		}
+	}
+	record(change.Added, "append")
+	record(change.Removed, "remove")
+	if !o.metadataRequired || len(errs) == 0 {
+		return nil
+	}
+	return &MetadataError{Errs: errs}
+}
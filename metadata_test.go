@@ -0,0 +1,71 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type record struct {
+	cidr string
+	op   string
+	meta map[string]string
+}
+
+type recordStore struct {
+	records []record
+	err     error
+}
+
+func (s *recordStore) Record(_ context.Context, cidr, op string, meta map[string]string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.records = append(s.records, record{cidr: cidr, op: op, meta: meta})
+	return nil
+}
+
+func TestWithMetadataStore(t *testing.T) {
+	ctx := context.Background()
+	t.Run("changed addresses are recorded", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		store := &recordStore{}
+		c := NewClient(fake, WithMetadataStore(store, false))
+		meta := map[string]string{"reason": "abuse", "by": "sre"}
+		assert.NoError(t, c.AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"}, WithMetadata(meta)))
+		assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		// no change
+		assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		_, err := c.SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.3"}, WithDryRun())
+		assert.NoError(t, err)
+		assert.Equal(t, []record{
+			{cidr: "192.0.2.2/32", op: "append", meta: meta},
+			{cidr: "192.0.2.1/32", op: "remove"},
+		}, store.records)
+	})
+	t.Run("best-effort", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		store := &recordStore{err: errors.New("store unavailable")}
+		c := NewClient(fake, WithMetadataStore(store, false))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("required", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		store := &recordStore{err: errors.New("store unavailable")}
+		c := NewClient(fake, WithMetadataStore(store, true))
+		err := c.AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"})
+		var metaErr *MetadataError
+		assert.True(t, errors.As(err, &metaErr))
+		assert.ErrorIs(t, err, store.err)
+		assert.ErrorContains(t, err, "ipset: record metadata: append 192.0.2.1/32: store unavailable (and 1 more)")
+		// the IP set is updated anyway
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
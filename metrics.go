@@ -0,0 +1,17 @@
+package ipset
+
+import "time"
+
+// Metrics observes the operations that update IP sets
+type Metrics interface {
+	// ObserveUpdate is called after each operation that updates an IP set.
+	// The "plan" operations of Plan and the ones with WithDryRun are observed too although they make no update.
+	// op is the name of the operation ("append", "remove", "change", "delta", "set", "clear", "plan" or "apply"),
+	// attempts is the number of attempts including the optimistic lock retries,
+	// dur is the time taken by the whole operation and err is the result of the operation
+	ObserveUpdate(op string, attempts int, dur time.Duration, err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveUpdate(string, int, time.Duration, error) {}
@@ -0,0 +1,42 @@
+package ipset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type observation struct {
+	op       string
+	attempts int
+	err      error
+}
+
+type recordMetrics struct {
+	observations []observation
+}
+
+func (m *recordMetrics) ObserveUpdate(op string, attempts int, _ time.Duration, err error) {
+	m.observations = append(m.observations, observation{op: op, attempts: attempts, err: err})
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	fake.BeforeUpdate = fake.ConcurrentWrite(1)
+	m := &recordMetrics{}
+	c := NewClient(fake, WithMetrics(m), WithRetryConfig(RetryConfig{MaxAttempts: 4}))
+	assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32"))
+	assert.NoError(t, c.RemoveCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.44/32"}))
+	err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "foo")
+	assert.Error(t, err)
+	assert.Equal(t, []observation{
+		{op: "append", attempts: 2},
+		{op: "remove", attempts: 1},
+		{op: "append", attempts: 0, err: err},
+	}, m.observations)
+}
@@ -0,0 +1,77 @@
+package ipset
+
+import (
+	"context"
+	"sync"
+)
+
+// Target is an IP set updated by MultiClient
+type Target struct {
+	// Region is the AWS region of the IP set, used to identify the target in the errors.
+	// The region of the requests is the one of Client
+	Region    string
+	Scope     Scope
+	IPSetID   string
+	IPSetName string
+	// Client is the client updating the IP set
+	Client *Client
+}
+
+// String returns the region, the scope and the name of the IP set of t
+func (t Target) String() string {
+	return t.Region + "/" + string(t.Scope) + "/" + t.IPSetName
+}
+
+// MultiClient updates the same logical IP set kept in several regions and scopes
+type MultiClient struct {
+	targets []Target
+}
+
+// NewMultiClient creates a new MultiClient updating targets
+func NewMultiClient(targets ...Target) *MultiClient {
+	return &MultiClient{targets: targets}
+}
+
+// AppendToIPSet appends cidr to the IP sets of all the targets concurrently.
+// It returns a *MultiError reporting the failed targets if any of them fails
+func (m *MultiClient) AppendToIPSet(ctx context.Context, cidr string, opts ...Option) error {
+	return m.each(ctx, opts, func(ctx context.Context, t Target, opts []Option) error {
+		return t.Client.AppendToIPSet(ctx, t.IPSetID, t.IPSetName, cidr, opts...)
+	})
+}
+
+// RemoveFromIPSet removes cidr from the IP sets of all the targets concurrently.
+// It returns a *MultiError reporting the failed targets if any of them fails
+func (m *MultiClient) RemoveFromIPSet(ctx context.Context, cidr string, opts ...Option) error {
+	return m.each(ctx, opts, func(ctx context.Context, t Target, opts []Option) error {
+		return t.Client.RemoveFromIPSet(ctx, t.IPSetID, t.IPSetName, cidr, opts...)
+	})
+}
+
+// each calls fn for each target concurrently with opts and the scope of the target
+func (m *MultiClient) each(ctx context.Context, opts []Option, fn func(ctx context.Context, t Target, opts []Option) error) error {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		err = &MultiError{Failed: make(map[Target]error)}
+	)
+	for _, t := range m.targets {
+		wg.Add(1)
+		go func(t Target) {
+			defer wg.Done()
+			terr := fn(ctx, t, append(opts[:len(opts):len(opts)], WithScope(t.Scope)))
+			mu.Lock()
+			defer mu.Unlock()
+			if terr != nil {
+				err.Failed[t] = terr
+			} else {
+				err.Succeeded = append(err.Succeeded, t)
+			}
+		}(t)
+	}
+	wg.Wait()
+	if len(err.Failed) == 0 {
+		return nil
+	}
+	return err
+}
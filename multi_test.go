@@ -0,0 +1,53 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiClient(t *testing.T) {
+	ctx := context.Background()
+	east, west := newFakeWAFV2API(), newFakeWAFV2API()
+	eastSet := east.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	cfSet := east.addIPSet(ScopeCloudFront, ipSetName, "IPV4")
+	westSet := west.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	eastClient, westClient := NewClient(east), NewClient(west)
+	targets := []Target{
+		{Region: "us-east-1", Scope: ScopeRegional, IPSetID: aws.StringValue(eastSet.Id), IPSetName: ipSetName, Client: eastClient},
+		{Region: "us-east-1", Scope: ScopeCloudFront, IPSetID: aws.StringValue(cfSet.Id), IPSetName: ipSetName, Client: eastClient},
+		{Region: "us-west-2", Scope: ScopeRegional, IPSetID: aws.StringValue(westSet.Id), IPSetName: ipSetName, Client: westClient},
+	}
+	m := NewMultiClient(targets...)
+	assert.NoError(t, m.AppendToIPSet(ctx, "192.0.2.1"))
+	assert.Equal(t, []string{"192.0.2.1/32"}, east.addresses(ScopeRegional, aws.StringValue(eastSet.Id)))
+	assert.Equal(t, []string{"192.0.2.1/32"}, east.addresses(ScopeCloudFront, aws.StringValue(cfSet.Id)))
+	assert.Equal(t, []string{"192.0.2.1/32"}, west.addresses(ScopeRegional, aws.StringValue(westSet.Id)))
+
+	assert.NoError(t, m.RemoveFromIPSet(ctx, "192.0.2.1"))
+	assert.Empty(t, east.addresses(ScopeCloudFront, aws.StringValue(cfSet.Id)))
+	assert.Empty(t, west.addresses(ScopeRegional, aws.StringValue(westSet.Id)))
+
+	t.Run("partial failure", func(t *testing.T) {
+		west.removeIPSet(ScopeRegional, aws.StringValue(westSet.Id))
+		err := m.AppendToIPSet(ctx, "192.0.2.2")
+		var multiErr *MultiError
+		if assert.True(t, errors.As(err, &multiErr)) {
+			assert.Equal(t, []Target{targets[2]}, multiErr.FailedTargets())
+			assert.Len(t, multiErr.Succeeded, 2)
+		}
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.ErrorContains(t, err, "ipset: 1 of 3 targets failed: us-west-2/REGIONAL/"+ipSetName+": ")
+		assert.Equal(t, []string{"192.0.2.2/32"}, east.addresses(ScopeRegional, aws.StringValue(eastSet.Id)))
+
+		// retry the failed targets
+		recreated := west.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		retried := multiErr.FailedTargets()
+		retried[0].IPSetID = aws.StringValue(recreated.Id)
+		assert.NoError(t, NewMultiClient(retried...).AppendToIPSet(ctx, "192.0.2.2"))
+		assert.Equal(t, []string{"192.0.2.2/32"}, west.addresses(ScopeRegional, aws.StringValue(recreated.Id)))
+	})
+}
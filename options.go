@@ -0,0 +1,477 @@
+package ipset
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/servicequotas/servicequotasiface"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"golang.org/x/time/rate"
+)
+
+// DefaultIDCacheTTL is the default TTL of the IP set IDs cached by the ByName functions
+const DefaultIDCacheTTL = 10 * time.Minute
+
+// Option configures an IP set operation
+type Option func(*options)
+
+type options struct {
+	scope            Scope
+	retry            RetryConfig
+	transientRetry   RetryConfig
+	retryable        func(error) bool
+	idCacheTTL       time.Duration
+	logger           func(RetryEvent)
+	metrics          Metrics
+	random           *lockedRand
+	timeout          time.Duration
+	aggregate        bool
+	coverCheck       bool
+	dryRun           bool
+	noDedupe         bool
+	onChange         func(*Change)
+	description      *string
+	sorted           bool
+	forceUpdate      bool
+	limiter          *rate.Limiter
+	getCacheTTL      time.Duration
+	listCacheTTL     time.Duration
+	verify           bool
+	preflightUpdate  bool
+	maxAddresses     int
+	quotaAPI         servicequotasiface.ServiceQuotasAPI
+	addressQuotaCode string
+	evict            EvictFunc
+	dedupWindow      time.Duration
+	tracer           Tracer
+	requestOptions   []request.Option
+	metadataStore    MetadataStore
+	metadataRequired bool
+	metadata         map[string]string
+	retryBudget      *RetryBudget
+	errorOnDuplicate bool
+	errorOnMissing   bool
+	minAddresses     int
+	// budget is the RetryBudget shared by the IP sets of AppendMany
+	budget *retryBudget
+	// prefetched is returned by the first read of the IP set of the operation
+	prefetched *wafv2.GetIPSetOutput
+	// ipSets is the cache of the client running the operation
+	ipSets *ipSetCache
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		scope:          ScopeRegional,
+		retry:          DefaultRetryConfig,
+		transientRetry: DefaultTransientRetryConfig,
+		retryable:      isTransientError,
+		idCacheTTL:     DefaultIDCacheTTL,
+		metrics:        nopMetrics{},
+		tracer:         nopTracer{},
+		random:         random,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithScope sets the scope of the IP set. The default is ScopeRegional
+func WithScope(scope Scope) Option {
+	return func(o *options) {
+		o.scope = scope
+	}
+}
+
+// WithRetryConfig sets the retry configuration on WAFOptimisticLockException. The default is DefaultRetryConfig.
+// A MaxAttempts less than 1 is treated as 1
+func WithRetryConfig(rc RetryConfig) Option {
+	return func(o *options) {
+		if rc.MaxAttempts < 1 {
+			rc.MaxAttempts = 1
+		}
+		o.retry = rc
+	}
+}
+
+// WithTransientRetryConfig sets the retry configuration on transient errors such as throttling.
+// The default is DefaultTransientRetryConfig. A MaxAttempts less than 1 is treated as 1.
+// The attempts are counted separately from the retries on WAFOptimisticLockException
+func WithTransientRetryConfig(rc RetryConfig) Option {
+	return func(o *options) {
+		if rc.MaxAttempts < 1 {
+			rc.MaxAttempts = 1
+		}
+		o.transientRetry = rc
+	}
+}
+
+// WithNoRetry makes the operation attempt once, e.g. when the caller has a retry loop of its own.
+// It is the same as the RetryConfigs of WithRetryConfig and WithTransientRetryConfig with a MaxAttempts of 1:
+// WAFOptimisticLockException is returned as OptimisticLockExhaustedError, which IsOptimisticLock reports.
+// The retries made by the AWS SDK itself are configured by the session
+func WithNoRetry() Option {
+	return func(o *options) {
+		o.retry.MaxAttempts = 1
+		o.transientRetry.MaxAttempts = 1
+	}
+}
+
+// WithRetryableErrors sets the function reporting whether an error is transient and retried by the transient retry configuration.
+// It replaces the default, which retries the throttling errors and the server errors of AWS.
+// WAFOptimisticLockException is always retried by the retry configuration of WithRetryConfig
+func WithRetryableErrors(retryable func(err error) bool) Option {
+	return func(o *options) {
+		if retryable == nil {
+			retryable = isTransientError
+		}
+		o.retryable = retryable
+	}
+}
+
+// WithIDCacheTTL sets how long the ByName functions cache the IP set ID resolved from the name.
+// The default is DefaultIDCacheTTL, and a zero or negative ttl disables the cache
+func WithIDCacheTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.idCacheTTL = ttl
+	}
+}
+
+// WithRetryBudget bounds all the retries of an operation by b, on top of the MaxAttempts of the RetryConfigs.
+// AppendMany shares b by all of its IP sets, and fails the IP sets not started yet when the time of b is over,
+// so that a contended batch has a predictable worst-case latency.
+// An operation that runs out of b returns a *RetryBudgetExhaustedError
+func WithRetryBudget(b RetryBudget) Option {
+	return func(o *options) {
+		o.retryBudget = &b
+	}
+}
+
+// withPrefetched makes the first read of the IP set return out instead of calling GetIPSet
+func withPrefetched(out *wafv2.GetIPSetOutput) Option {
+	return func(o *options) {
+		o.prefetched = out
+	}
+}
+
+// withBudget makes the operations share b
+func withBudget(b *retryBudget) Option {
+	return func(o *options) {
+		o.budget = b
+	}
+}
+
+// WithBackoff sets the Backoff strategy of the retries on WAFOptimisticLockException.
+// The default is ConstantBackoff(DefaultRetryConfig.BaseDelay, DefaultRetryConfig.MaxDelay)
+func WithBackoff(b Backoff) Option {
+	return func(o *options) {
+		o.retry.Backoff = b
+	}
+}
+
+// WithRandSource sets the source of the random jitter of the retry delays, e.g. a fixed seed for reproducible tests.
+// The source is guarded by a mutex, so src does not need to be safe for concurrent use.
+// The default is a source shared by the package
+func WithRandSource(src rand.Source) Option {
+	r := newLockedRand(src)
+	return func(o *options) {
+		o.random = r
+	}
+}
+
+// WithTimeout bounds the whole operation including all the retries and their delays by d.
+// When d elapses, the operation returns an error wrapping context.DeadlineExceeded
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithLogger sets a function called on each retry, before waiting for the delay
+func WithLogger(logger func(RetryEvent)) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithMetrics sets the Metrics that observes the operations. The default discards all the observations
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		if m == nil {
+			m = nopMetrics{}
+		}
+		o.metrics = m
+	}
+}
+
+// WithRequestOptions passes opts to all the calls of the WAFV2 API, e.g. to add a request handler for signing or metrics.
+// The options given by several WithRequestOptions, such as the ones of NewClient and the ones of a call, are all passed in order.
+// The operations without options such as FindIPSetIDByName pass the ones of NewClient.
+// The WAFV2API of the sdkv2 package ignores them, so configure the aws-sdk-go-v2 client instead
+func WithRequestOptions(opts ...request.Option) Option {
+	return func(o *options) {
+		o.requestOptions = append(o.requestOptions[:len(o.requestOptions):len(o.requestOptions)], opts...)
+	}
+}
+
+// WithUserAgent appends suffix to the user agent of all the calls of the WAFV2 API,
+// e.g. to tell the changes made by your tooling in CloudTrail from the ones made by Terraform or the console.
+// It is passed as WithRequestOptions, so the WAFV2API of the sdkv2 package ignores it too
+func WithUserAgent(suffix string) Option {
+	return WithRequestOptions(request.WithAppendUserAgent(suffix))
+}
+
+// WithTracer sets the Tracer of the operations.
+// An operation updating an IP set has a span named "ipset.<op>" (such as "ipset.append") with a child span "ipset.attempt"
+// for each attempt, and the retries are recorded as "retry" events of the operation span.
+// All the calls of the WAFV2 API have spans named after them such as "WAFV2.GetIPSet" and "WAFV2.UpdateIPSet",
+// including the ones of the operations without options such as FindIPSetIDByName, which use the Tracer of NewClient
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// WithAggregation makes the append and set operations aggregate the resulting addresses of the IP set,
+// removing prefixes contained in another one and merging adjacent prefixes into their parent
+// (10.0.0.0/25 and 10.0.0.128/25 become 10.0.0.0/24).
+// The aggregated addresses cover exactly the same IP addresses as before
+func WithAggregation() Option {
+	return func(o *options) {
+		o.aggregate = true
+	}
+}
+
+// WithCoverCheck makes the append operations treat a CIDR covered by a broader prefix of the IP set as already present,
+// so appending 10.1.2.3/32 to an IP set containing 10.0.0.0/8 is a no-op.
+// The remove operations return a *CIDRCoveredError for such a CIDR, because it cannot be removed from the covering prefix
+func WithCoverCheck() Option {
+	return func(o *options) {
+		o.coverCheck = true
+	}
+}
+
+// WithErrorOnDuplicate makes the append operations return an error matching ErrCIDRAlreadyPresent
+// without updating the IP set if any of the CIDRs already exists, instead of skipping it.
+//
+// WithErrorOnDuplicate and WithErrorOnMissing opt out of the idempotency of the operations on purpose, for diagnostics:
+// a pipeline appending an address twice or removing an address it never appended has a bug that the idempotent no-op hides.
+// Do not use them for the operations that are retried or redelivered, which fail on their second run
+func WithErrorOnDuplicate() Option {
+	return func(o *options) {
+		o.errorOnDuplicate = true
+	}
+}
+
+// WithErrorOnMissing makes the remove operations return an error matching ErrCIDRNotPresent
+// without updating the IP set if any of the CIDRs does not exist, instead of skipping it.
+// See WithErrorOnDuplicate for the use of the options opting out of the idempotency
+func WithErrorOnMissing() Option {
+	return func(o *options) {
+		o.errorOnMissing = true
+	}
+}
+
+// WithDryRun makes the operations read the IP set and compute the change without updating the IP set.
+// Use WithOnChange or the *Change returned by SetAddresses to see the change that would be made
+func WithDryRun() Option {
+	return func(o *options) {
+		o.dryRun = true
+	}
+}
+
+// WithOnChange sets a function called with the change computed by a successful operation, even if nothing is changed.
+// With WithDryRun, it is called with the change that would be made
+func WithOnChange(fn func(*Change)) Option {
+	return func(o *options) {
+		o.onChange = fn
+	}
+}
+
+// WithMetadataStore makes the operations record the addresses they append or remove to store.
+// The recording is best-effort by default and its failures are ignored, as the IP set has already been updated.
+// If required is true, the operations return a *MetadataError for the failures in addition to updating the IP set
+func WithMetadataStore(store MetadataStore, required bool) Option {
+	return func(o *options) {
+		o.metadataStore = store
+		o.metadataRequired = required
+	}
+}
+
+// WithMetadata sets the metadata recorded to the MetadataStore with the addresses changed by the operation
+func WithMetadata(meta map[string]string) Option {
+	return func(o *options) {
+		o.metadata = meta
+	}
+}
+
+// WithoutDedupeCheck makes the append operations append the CIDRs without checking whether they already exist in the IP set.
+// It saves the scan of the addresses when appending to a large IP set, but the IP set is updated even if the CIDRs exist,
+// which competes for the lock token with other writers. If WAF rejects the update for a duplicated address,
+// the append is made again with the dedupe check.
+// It is ignored with WithAggregation and WithCoverCheck
+func WithoutDedupeCheck() Option {
+	return func(o *options) {
+		o.noDedupe = true
+	}
+}
+
+// WithDescription sets the description of the IP set on update. An empty description removes the description.
+// Without WithDescription, the updates keep the current description of the IP set
+func WithDescription(description string) Option {
+	return func(o *options) {
+		o.description = &description
+	}
+}
+
+// WithSortedAddresses makes the updates sort the addresses of the IP set by IP address and then by prefix length,
+// so 10.0.0.2/32 comes before 10.0.0.10/32 and IPv4 addresses come before IPv6 ones.
+// The addresses are sorted only when the IP set is updated, and a different order alone does not update it
+func WithSortedAddresses() Option {
+	return func(o *options) {
+		o.sorted = true
+	}
+}
+
+// WithForceUpdate makes the operations update the IP set even if its addresses are unchanged,
+// for example to rotate the lock token or to trigger the change events of the IP set.
+// It is ignored with WithDryRun
+func WithForceUpdate() Option {
+	return func(o *options) {
+		o.forceUpdate = true
+	}
+}
+
+// WithRateLimit limits the calls of the WAFV2 API, such as GetIPSet, UpdateIPSet and ListIPSets, to r per second with bursts of burst calls.
+// The calls wait for the limiter until ctx is done instead of failing.
+// The limiter is created by WithRateLimit and shared by the operations given the option,
+// so pass it to NewClient to limit all the operations of the client. A burst less than 1 is treated as 1
+func WithRateLimit(r rate.Limit, burst int) Option {
+	if burst < 1 {
+		burst = 1
+	}
+	limiter := rate.NewLimiter(r, burst)
+	return func(o *options) {
+		o.limiter = limiter
+	}
+}
+
+// WithGetCacheTTL makes the operations reuse the IP set got by a previous operation of the client within ttl,
+// such as Plan followed by Apply. The cached IP set is dropped when the IP set is updated or deleted by the client,
+// or when an update fails. An update using a stale cached IP set fails with WAFOptimisticLockException and is retried
+// with a fresh one. The default is 0, which disables the cache
+func WithGetCacheTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.getCacheTTL = ttl
+	}
+}
+
+// WithListCacheTTL makes ListIPSets reuse the summaries listed by a previous call of the client within ttl,
+// since ListIPSets takes a call per page and the IP sets are rarely created or deleted. The default is 0, which disables the cache
+func WithListCacheTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.listCacheTTL = ttl
+	}
+}
+
+// WithVerify makes the operations read the IP set again after updating it, and return a *VerificationError
+// if the IP set does not have the added addresses or still has the removed ones.
+// The read is repeated a few times with delays because WAF is eventually consistent.
+// A concurrent writer modifying the same addresses right after the update also fails the verification
+func WithVerify() Option {
+	return func(o *options) {
+		o.verify = true
+	}
+}
+
+// WithPreflightUpdate makes Preflight check the permission of UpdateIPSet too, by an update with a lock token that never matches.
+// WAF rejects the update with WAFOptimisticLockException without modifying the IP set,
+// but it is still a mutating call recorded as a failed UpdateIPSet in CloudTrail, and may trigger the alarms on it
+func WithPreflightUpdate() Option {
+	return func(o *options) {
+		o.preflightUpdate = true
+	}
+}
+
+// EvictFunc chooses n of addresses to evict from the IP set to keep it within the limit of WithMaxAddresses.
+// addresses are the current addresses of the IP set except the ones being appended, in the order of the IP set.
+// Returning fewer than n addresses makes the append fail with an *IPSetFullError
+type EvictFunc func(addresses []string, n int) []string
+
+// EvictOldest is an EvictFunc evicting the first addresses of the IP set,
+// which are the oldest ones if the IP set is updated only by the append operations without WithSortedAddresses
+func EvictOldest(addresses []string, n int) []string {
+	if n > len(addresses) {
+		n = len(addresses)
+	}
+	return addresses[:n]
+}
+
+// WithMaxAddresses limits the number of addresses of the IP set to n on the append operations.
+// When appending would exceed n, the addresses chosen by evict are removed in the same update.
+// A nil evict makes the append fail with an *IPSetFullError instead.
+// n is capped at the limit of the IP sets, MaxAddressesPerIPSet unless WithMaxAddressesFromQuota is given,
+// and n less than 1 disables the limit
+func WithMaxAddresses(n int, evict EvictFunc) Option {
+	return func(o *options) {
+		o.maxAddresses = n
+		o.evict = evict
+	}
+}
+
+// WithMaxAddressesFromQuota replaces MaxAddressesPerIPSet, the limit of the IP sets checked before updating them,
+// with the value of the WAFv2 quota of the addresses per IP set read by api, e.g. for an account with a raised limit.
+// api must be of the region of the IP sets, us-east-1 for ScopeCloudFront. The applied value of the quota is used,
+// or its default value if the applied one is not available.
+// The value is cached by the client for DefaultQuotaCacheTTL, and MaxAddressesPerIPSet is used if the quota cannot be read
+func WithMaxAddressesFromQuota(api servicequotasiface.ServiceQuotasAPI) Option {
+	return func(o *options) {
+		o.quotaAPI = api
+	}
+}
+
+// WithAddressQuotaCode replaces DefaultAddressQuotaCode, the quota read by WithMaxAddressesFromQuota,
+// with quotaCode as listed by "aws service-quotas list-service-quotas --service-code wafv2".
+// It has no effect without WithMaxAddressesFromQuota
+func WithAddressQuotaCode(quotaCode string) Option {
+	return func(o *options) {
+		o.addressQuotaCode = quotaCode
+	}
+}
+
+// WithMinAddresses makes the operations removing addresses, such as SetAddresses, RemoveCIDRs and Plan,
+// fail with an *UnderflowError without updating the IP set if the IP set would have less than n addresses,
+// e.g. to protect a blocklist from a bad diff removing everything.
+// ClearIPSet is not guarded since it empties the IP set explicitly. n less than 1 disables the guard
+func WithMinAddresses(n int) Option {
+	return func(o *options) {
+		o.minAddresses = n
+	}
+}
+
+// WithDedupWindow makes the append and remove operations of the client remember the CIDRs they applied for d,
+// and return without calling WAF when the same operation is repeated on the same CIDRs within d,
+// e.g. for a message redelivered by a queue. The *Change of a skipped operation is empty except its Size,
+// which is the one of the last remembered operation.
+// It is best-effort and per client in the process: an update by another client or process within d is not noticed,
+// so a CIDR removed by another writer is not appended again until d elapses
+func WithDedupWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.dedupWindow = d
+	}
+}
+
+// wait waits for the rate limiter of WithRateLimit before a call of the WAFV2 API
+func (o *options) wait(ctx context.Context) error {
+	if o.limiter == nil {
+		return nil
+	}
+	if err := o.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("ipset: wait for rate limit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package ipset
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/aws/aws-sdk-go/service/servicequotas/servicequotasiface"
+)
+
+// DefaultQuotaCacheTTL is how long the address limit read by WithMaxAddressesFromQuota is cached by the client
+const DefaultQuotaCacheTTL = time.Hour
+
+const (
+	// QuotaServiceCode is the Service Quotas code of WAFv2, of which WithMaxAddressesFromQuota reads the quota
+	QuotaServiceCode = "wafv2"
+	// DefaultAddressQuotaCode is the Service Quotas code of the maximum number of addresses in an IP set,
+	// read by WithMaxAddressesFromQuota unless replaced by WithAddressQuotaCode
+	DefaultAddressQuotaCode = "L-4BC1D60F"
+)
+
+// addressLimit returns the maximum number of addresses of the IP sets:
+// the value of the quota of WithMaxAddressesFromQuota if it is given and can be read, or MaxAddressesPerIPSet otherwise
+func (c *Client) addressLimit(ctx context.Context, o *options) int {
+	if o.quotaAPI == nil {
+		return MaxAddressesPerIPSet
+	}
+	code := o.addressQuotaCode
+	if code == "" {
+		code = DefaultAddressQuotaCode
+	}
+	if limit, ok := c.quotas.get(QuotaServiceCode, code); ok {
+		return limit
+	}
+	limit := readAddressQuota(ctx, o.quotaAPI, code)
+	// the fallback is cached too, so that a caller not allowed to read the quota does not call Service Quotas on every update,
+	// unless it is caused by ctx
+	if ctx.Err() == nil {
+		c.quotas.set(QuotaServiceCode, code, limit, DefaultQuotaCacheTTL)
+	}
+	return limit
+}
+
+// readAddressQuota reads the applied value of the WAFv2 quota of quotaCode, or its default value if the applied one is not available.
+// It returns MaxAddressesPerIPSet if neither of them can be read
+func readAddressQuota(ctx context.Context, api servicequotasiface.ServiceQuotasAPI, quotaCode string) int {
+	out, err := api.GetServiceQuotaWithContext(ctx, &servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(QuotaServiceCode),
+		QuotaCode:   aws.String(quotaCode),
+	})
+	if err == nil && out.Quota != nil && aws.Float64Value(out.Quota.Value) >= 1 {
+		return int(aws.Float64Value(out.Quota.Value))
+	}
+	def, err := api.GetAWSDefaultServiceQuotaWithContext(ctx, &servicequotas.GetAWSDefaultServiceQuotaInput{
+		ServiceCode: aws.String(QuotaServiceCode),
+		QuotaCode:   aws.String(quotaCode),
+	})
+	if err == nil && def.Quota != nil && aws.Float64Value(def.Quota.Value) >= 1 {
+		return int(aws.Float64Value(def.Quota.Value))
+	}
+	return MaxAddressesPerIPSet
+}
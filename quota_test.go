@@ -0,0 +1,110 @@
+package ipset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/aws/aws-sdk-go/service/servicequotas/servicequotasiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServiceQuotasAPI returns applied and def as the applied and the default values of the quota DefaultAddressQuotaCode of wafv2,
+// or fails with err if they are 0
+type fakeServiceQuotasAPI struct {
+	servicequotasiface.ServiceQuotasAPI
+	applied, def float64
+	err          error
+	calls        int
+}
+
+func (a *fakeServiceQuotasAPI) GetServiceQuotaWithContext(_ aws.Context, in *servicequotas.GetServiceQuotaInput, _ ...request.Option) (*servicequotas.GetServiceQuotaOutput, error) {
+	a.calls++
+	if a.applied == 0 || aws.StringValue(in.ServiceCode) != "wafv2" || aws.StringValue(in.QuotaCode) != DefaultAddressQuotaCode {
+		return nil, a.err
+	}
+	return &servicequotas.GetServiceQuotaOutput{Quota: &servicequotas.ServiceQuota{Value: aws.Float64(a.applied)}}, nil
+}
+
+func (a *fakeServiceQuotasAPI) GetAWSDefaultServiceQuotaWithContext(_ aws.Context, in *servicequotas.GetAWSDefaultServiceQuotaInput, _ ...request.Option) (*servicequotas.GetAWSDefaultServiceQuotaOutput, error) {
+	a.calls++
+	if a.def == 0 || aws.StringValue(in.ServiceCode) != "wafv2" || aws.StringValue(in.QuotaCode) != DefaultAddressQuotaCode {
+		return nil, a.err
+	}
+	return &servicequotas.GetAWSDefaultServiceQuotaOutput{Quota: &servicequotas.ServiceQuota{Value: aws.Float64(a.def)}}, nil
+}
+
+func TestWithMaxAddressesFromQuota(t *testing.T) {
+	ctx := context.Background()
+	t.Run("raised quota", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", largeAddresses(0, MaxAddressesPerIPSet)...)
+		quotas := &fakeServiceQuotasAPI{applied: MaxAddressesPerIPSet + 1, def: MaxAddressesPerIPSet}
+		c := NewClient(fake, WithMaxAddressesFromQuota(quotas))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2")
+		var fullErr *IPSetFullError
+		if assert.ErrorAs(t, err, &fullErr) {
+			assert.Equal(t, MaxAddressesPerIPSet+1, fullErr.Limit)
+		}
+		// the quota is cached by the client
+		assert.Equal(t, 1, quotas.calls)
+	})
+	t.Run("default value", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		quotas := &fakeServiceQuotasAPI{def: 2, err: awserr.New(servicequotas.ErrCodeNoSuchResourceException, "no applied value", nil)}
+		c := NewClient(fake, WithMaxAddressesFromQuota(quotas))
+		assert.ErrorIs(t, c.AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.3"}), ErrIPSetFull)
+		_, err := c.CreateIPSet(ctx, "other", ScopeRegional, IPv4, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, "")
+		assert.ErrorIs(t, err, ErrIPSetFull)
+		// the soft cap is capped at the quota too
+		assert.NoError(t, c.AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2", "192.0.2.3"}, WithMaxAddresses(3, EvictOldest)))
+		assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		assert.Equal(t, 2, quotas.calls)
+	})
+	t.Run("fallback", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		// filled by a client reading the raised quota
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", largeAddresses(0, MaxAddressesPerIPSet+1)...)
+		quotas := &fakeServiceQuotasAPI{err: awserr.New(errCodeAccessDenied, "not authorized", nil)}
+		c := NewClient(fake, WithMaxAddressesFromQuota(quotas))
+		for i := 0; i < 2; i++ {
+			err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+			var fullErr *IPSetFullError
+			if assert.ErrorAs(t, err, &fullErr) {
+				assert.Equal(t, MaxAddressesPerIPSet, fullErr.Limit)
+			}
+		}
+		// the fallback is cached too
+		assert.Equal(t, 2, quotas.calls)
+		// the IP set beyond the limit can still shrink
+		assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id))[0]))
+	})
+	t.Run("not read by a skipped update", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		quotas := &fakeServiceQuotasAPI{err: awserr.New(errCodeAccessDenied, "not authorized", nil)}
+		c := NewClient(fake, WithMaxAddressesFromQuota(quotas), WithDedupWindow(time.Minute))
+		assert.ErrorIs(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "foo"), ErrInvalidCIDR)
+		assert.Equal(t, 0, quotas.calls)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		c.quotas = newQuotaCache()
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 2, quotas.calls)
+	})
+	t.Run("quota code", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		quotas := &fakeServiceQuotasAPI{def: 1, err: awserr.New(servicequotas.ErrCodeNoSuchResourceException, "no such quota", nil)}
+		// the other quota is not found, so MaxAddressesPerIPSet is used
+		c := NewClient(fake, WithAddressQuotaCode("L-OTHER"), WithMaxAddressesFromQuota(quotas))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2"))
+		c = NewClient(fake, WithMaxAddressesFromQuota(quotas))
+		assert.ErrorIs(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.3"), ErrIPSetFull)
+	})
+}
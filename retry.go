@@ -0,0 +1,176 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+// random is the default source of the jitter shared by all the clients
+var random = newLockedRand(rand.NewSource(time.Now().UnixNano()))
+
+// lockedRand is a *rand.Rand that is safe for concurrent use
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	return &lockedRand{r: rand.New(src)}
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Int63n(n)
+}
+
+// RetryConfig configures the retries on WAFOptimisticLockException
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts including the first one
+	MaxAttempts int
+	// BaseDelay and MaxDelay are the bounds of the delay before each retry.
+	// The delay is chosen randomly between them (jitter), so that writers that collided do not retry at the same time
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Backoff computes the bounds of the delay instead of BaseDelay and MaxDelay if it is not nil
+	Backoff Backoff
+}
+
+// RetryEvent describes a retry on WAFOptimisticLockException or a transient error
+type RetryEvent struct {
+	// Attempt is the number of the attempt that failed, starting at 1
+	Attempt int
+	// Err is the error of the attempt
+	Err error
+	// Delay is the delay before the next attempt
+	Delay time.Duration
+	// CorrelationID is the correlation ID of the context of the operation set by ContextWithCorrelationID, if any
+	CorrelationID string
+}
+
+// DefaultRetryConfig is the RetryConfig used when WithRetryConfig is not specified
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 4,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    200 * time.Millisecond,
+}
+
+// DefaultTransientRetryConfig is the RetryConfig of the retries on transient errors
+// used when WithTransientRetryConfig is not specified
+var DefaultTransientRetryConfig = RetryConfig{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+// delay returns the delay before the retry after the attempt-th attempt, with the jitter drawn from rnd
+func (rc RetryConfig) delay(rnd *lockedRand, attempt int, prev time.Duration) time.Duration {
+	min, max := rc.BaseDelay, rc.MaxDelay
+	if rc.Backoff != nil {
+		min, max = rc.Backoff.Delay(attempt, prev)
+	}
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rnd.Int63n(int64(max-min)+1))
+}
+
+// retry calls fn until it succeeds or returns an error that is neither WAFOptimisticLockException nor transient.
+// The retries on WAFOptimisticLockException and on transient errors have their own RetryConfig and attempts,
+// so that a storm of throttling does not exhaust the retries on WAFOptimisticLockException
+func retry(ctx context.Context, o *options, fn func() error) error {
+	var lockAttempts, transientAttempts int
+	var lockDelay, transientDelay time.Duration
+	budget := o.budget
+	if budget == nil && o.retryBudget != nil {
+		budget = newRetryBudget(*o.retryBudget)
+	}
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var delay time.Duration
+		switch {
+		case IsOptimisticLock(err):
+			lockAttempts++
+			if lockAttempts >= o.retry.MaxAttempts {
+				return &OptimisticLockExhaustedError{Attempts: lockAttempts, Err: err}
+			}
+			lockDelay = o.retry.delay(o.random, lockAttempts, lockDelay)
+			delay = lockDelay
+		case o.retryable(err):
+			transientAttempts++
+			if transientAttempts >= o.transientRetry.MaxAttempts {
+				return err
+			}
+			transientDelay = o.transientRetry.delay(o.random, transientAttempts, transientDelay)
+			delay = transientDelay
+		default:
+			return err
+		}
+		if budget != nil && !budget.take(delay) {
+			return &RetryBudgetExhaustedError{Err: err}
+		}
+		if o.logger != nil {
+			id, _ := CorrelationIDFromContext(ctx)
+			o.logger(RetryEvent{Attempt: lockAttempts + transientAttempts, Err: err, Delay: delay, CorrelationID: id})
+		}
+		spanFromContext(ctx).AddEvent("retry",
+			Attribute{Key: "attempt", Value: lockAttempts + transientAttempts},
+			Attribute{Key: "error", Value: err.Error()},
+			Attribute{Key: "delay", Value: delay},
+		)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// IsOptimisticLock reports whether err is or wraps the WAFOptimisticLockException returned by WAF
+// when the IP set has been modified since its lock token was obtained.
+// The operation can be retried after reading the IP set again
+func IsOptimisticLock(err error) bool {
+	var lockErr *wafv2.WAFOptimisticLockException
+	return errors.As(err, &lockErr)
+}
+
+// IsRetryable reports whether err is worth retrying by a custom retry loop,
+// i.e. WAFOptimisticLockException or a transient error such as throttling or a server error of AWS
+func IsRetryable(err error) bool {
+	return IsOptimisticLock(err) || isTransientError(err)
+}
+
+// isTransientError reports whether err is a throttling error or a server error of AWS that may succeed on retry
+func isTransientError(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && request.IsErrorThrottle(aerr) {
+		return true
+	}
+	var internalErr *wafv2.WAFInternalErrorException
+	if errors.As(err, &internalErr) {
+		return true
+	}
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() >= 500 && reqErr.StatusCode() != 501
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("ipset: wait for retry: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
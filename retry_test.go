@@ -0,0 +1,457 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+
+	"github.com/kei2100/idempotent-aws-waf-ipset/ipsettest"
+)
+
+func TestRetryConfig(t *testing.T) {
+	ctx := context.Background()
+	cidr := "192.0.2.44/32"
+	t.Run("default max attempts", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeUpdate = fake.ConcurrentWrite(100)
+		c := NewClient(fake, WithRetryConfig(RetryConfig{MaxAttempts: DefaultRetryConfig.MaxAttempts}))
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr)
+		var lockErr *wafv2.WAFOptimisticLockException
+		assert.True(t, errors.As(err, &lockErr))
+		assert.Equal(t, 4, fake.UpdateCalls)
+	})
+	t.Run("custom max attempts", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeUpdate = fake.ConcurrentWrite(9)
+		c := NewClient(fake, WithRetryConfig(RetryConfig{MaxAttempts: 10, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}))
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, cidr))
+		assert.Equal(t, 10, fake.UpdateCalls)
+	})
+}
+
+func TestWithNoRetry(t *testing.T) {
+	ctx := context.Background()
+	t.Run("optimistic lock", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeUpdate = fake.ConcurrentWrite(1)
+		start := time.Now()
+		err := NewClient(fake).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithNoRetry())
+		assert.True(t, IsOptimisticLock(err))
+		assert.ErrorIs(t, err, ErrOptimisticLockExhausted)
+		assert.Equal(t, 1, fake.UpdateCalls)
+		assert.Less(t, time.Since(start), DefaultRetryConfig.BaseDelay)
+	})
+	t.Run("transient", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{awserr.New("ThrottlingException", "rate exceeded", nil)}}
+		// the option of the operation overrides the retry configuration of the client
+		c := NewClient(api, WithTransientRetryConfig(RetryConfig{MaxAttempts: 10}))
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithNoRetry())
+		assert.True(t, IsRetryable(err))
+		assert.Empty(t, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+}
+
+func TestRetry_Logger(t *testing.T) {
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	fake.BeforeUpdate = fake.ConcurrentWrite(2)
+	var events []RetryEvent
+	c := NewClient(fake,
+		WithRetryConfig(RetryConfig{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithLogger(func(e RetryEvent) {
+			events = append(events, e)
+		}),
+	)
+	assert.NoError(t, c.AppendToIPSet(context.Background(), aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32"))
+	if assert.Len(t, events, 2) {
+		for i, e := range events {
+			assert.Equal(t, i+1, e.Attempt)
+			assert.Equal(t, time.Millisecond, e.Delay)
+			var lockErr *wafv2.WAFOptimisticLockException
+			assert.True(t, errors.As(e.Err, &lockErr))
+		}
+	}
+}
+
+func TestRetry_ContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	fake.BeforeUpdate = func(s *ipsettest.IPSet) {
+		fake.ConcurrentWrite(1)(s)
+		cancel()
+	}
+	c := NewClient(fake, WithRetryConfig(RetryConfig{MaxAttempts: 4, BaseDelay: time.Hour, MaxDelay: time.Hour}))
+	err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, fake.UpdateCalls)
+}
+
+func TestWithTimeout(t *testing.T) {
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	fake.BeforeUpdate = fake.ConcurrentWrite(100)
+	c := NewClient(fake,
+		WithRetryConfig(RetryConfig{MaxAttempts: 100, BaseDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond}),
+		WithTimeout(50*time.Millisecond),
+	)
+	start := time.Now()
+	err := c.AppendToIPSet(context.Background(), aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Less(t, fake.UpdateCalls, 10)
+}
+
+func TestWithRateLimit(t *testing.T) {
+	ctx := context.Background()
+	t.Run("shared by the operations of the client", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithRateLimit(rate.Every(20*time.Millisecond), 1))
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, fmt.Sprintf("192.0.2.%d", i)))
+		}
+		// 6 calls are 5 intervals after the first one
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, 3, fake.GetCalls)
+		assert.Equal(t, 3, fake.UpdateCalls)
+	})
+	t.Run("context canceled while waiting", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithRateLimit(rate.Every(time.Hour), 1))
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorContains(t, err, "ipset: wait for rate limit")
+		assert.Equal(t, 1, fake.GetCalls)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("operations without options", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		c := NewClient(fake, WithRateLimit(rate.Every(time.Hour), 1))
+		// the first call takes the burst
+		_, err := c.FindIPSetIDByName(ctx, ipSetName, ScopeRegional)
+		assert.NoError(t, err)
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err = c.FindIPSetIDByName(ctx, ipSetName, ScopeRegional)
+		assert.ErrorContains(t, err, "ipset: wait for rate limit")
+		_, err = c.UpdateAddressesWithToken(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional, "token", nil)
+		assert.ErrorContains(t, err, "ipset: wait for rate limit")
+		_, err = c.CreateIPSet(ctx, "other", ScopeRegional, IPv4, nil, "")
+		assert.ErrorContains(t, err, "ipset: wait for rate limit")
+		assert.Equal(t, 1, fake.ListCalls)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+}
+
+func TestRetryConfig_delay(t *testing.T) {
+	rc := RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: 200 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		d := rc.delay(random, 1, 0)
+		assert.GreaterOrEqual(t, d, rc.BaseDelay)
+		assert.LessOrEqual(t, d, rc.MaxDelay)
+	}
+	assert.Equal(t, rc.BaseDelay, RetryConfig{BaseDelay: rc.BaseDelay}.delay(random, 1, 0))
+	rc.Backoff = BackoffFunc(func(attempt int, prev time.Duration) (time.Duration, time.Duration) {
+		return time.Duration(attempt) * time.Second, time.Duration(attempt) * time.Second
+	})
+	assert.Equal(t, 3*time.Second, rc.delay(random, 3, 0))
+}
+
+func TestWithRandSource(t *testing.T) {
+	delays := func() []time.Duration {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		fake.BeforeUpdate = fake.ConcurrentWrite(3)
+		var delays []time.Duration
+		c := NewClient(fake,
+			WithRandSource(rand.NewSource(1)),
+			WithRetryConfig(RetryConfig{MaxAttempts: 4, MaxDelay: time.Millisecond}),
+			WithLogger(func(e RetryEvent) {
+				delays = append(delays, e.Delay)
+			}),
+		)
+		assert.NoError(t, c.AppendToIPSet(context.Background(), aws.StringValue(ipSet.Id), ipSetName, "192.0.2.44/32"))
+		return delays
+	}
+	assert.Equal(t, delays(), delays())
+}
+
+func TestRetry_ConcurrentJitter(t *testing.T) {
+	// run with -race to detect the data race on the shared random source
+	rc := RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: 200 * time.Millisecond}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rc.delay(random, 1, 0)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// failingUpdateAPI fails the updates with errs in order before delegating to the fake
+type failingUpdateAPI struct {
+	*fakeWAFV2API
+	errs []error
+}
+
+func (a *failingUpdateAPI) UpdateIPSetWithContext(ctx aws.Context, in *wafv2.UpdateIPSetInput, opts ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
+	if len(a.errs) > 0 {
+		err := a.errs[0]
+		a.errs = a.errs[1:]
+		return nil, err
+	}
+	return a.fakeWAFV2API.UpdateIPSetWithContext(ctx, in, opts...)
+}
+
+// failingGetAPI fails the gets with errs in order before delegating to the fake
+type failingGetAPI struct {
+	*fakeWAFV2API
+	errs []error
+}
+
+func (a *failingGetAPI) GetIPSetWithContext(ctx aws.Context, in *wafv2.GetIPSetInput, opts ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	if len(a.errs) > 0 {
+		err := a.errs[0]
+		a.errs = a.errs[1:]
+		return nil, err
+	}
+	return a.fakeWAFV2API.GetIPSetWithContext(ctx, in, opts...)
+}
+
+// tokenRecordingAPI records the lock tokens returned by GetIPSet and sent by UpdateIPSet
+type tokenRecordingAPI struct {
+	*fakeWAFV2API
+	got, sent []string
+}
+
+func (a *tokenRecordingAPI) GetIPSetWithContext(ctx aws.Context, in *wafv2.GetIPSetInput, opts ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	out, err := a.fakeWAFV2API.GetIPSetWithContext(ctx, in, opts...)
+	if err == nil {
+		a.got = append(a.got, aws.StringValue(out.LockToken))
+	}
+	return out, err
+}
+
+func (a *tokenRecordingAPI) UpdateIPSetWithContext(ctx aws.Context, in *wafv2.UpdateIPSetInput, opts ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
+	a.sent = append(a.sent, aws.StringValue(in.LockToken))
+	return a.fakeWAFV2API.UpdateIPSetWithContext(ctx, in, opts...)
+}
+
+func TestRetry_RefetchesLockToken(t *testing.T) {
+	ctx := context.Background()
+	for name, opts := range map[string][]Option{
+		"default":        nil,
+		"get cache":      {WithGetCacheTTL(time.Minute)},
+		"without dedupe": {WithoutDedupeCheck()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeWAFV2API()
+			ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+			// other writers rotate the lock token before each of the first 3 updates
+			fake.InjectConflicts(3)
+			api := &tokenRecordingAPI{fakeWAFV2API: fake}
+			c := NewClient(api, append(opts, WithBackoff(ConstantBackoff(0, 0)))...)
+			assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+
+			// each attempt sends the lock token of its own GetIPSet, never the one of a previous attempt
+			assert.Len(t, api.sent, 4)
+			assert.Equal(t, api.got, api.sent)
+			seen := make(map[string]bool)
+			for _, token := range api.sent {
+				assert.False(t, seen[token], "lock token %s is reused", token)
+				seen[token] = true
+			}
+			assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+		})
+	}
+}
+
+func TestRetry_TransientErrors(t *testing.T) {
+	ctx := context.Background()
+	throttle := awserr.New("ThrottlingException", "rate exceeded", nil)
+	unavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request-id")
+	conflict := &wafv2.WAFOptimisticLockException{Message_: aws.String("stale lock token")}
+	fastRetry := []Option{
+		WithRetryConfig(RetryConfig{MaxAttempts: 2}),
+		WithTransientRetryConfig(RetryConfig{MaxAttempts: 4}),
+	}
+	t.Run("separate budgets", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{throttle, conflict, unavailable, &wafv2.WAFInternalErrorException{}}}
+		c := NewClient(api, fastRetry...)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("transient retries exhausted", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{throttle, throttle, throttle, throttle}}
+		c := NewClient(api, fastRetry...)
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, throttle)
+		assert.NotErrorIs(t, err, ErrOptimisticLockExhausted)
+		assert.Equal(t, 4, fake.GetCalls)
+	})
+	t.Run("not transient", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		invalid := awserr.NewRequestFailure(awserr.New("WAFInvalidParameterException", "invalid", nil), 400, "request-id")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{invalid}}
+		err := NewClient(api, fastRetry...).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, invalid)
+		assert.Equal(t, 1, fake.GetCalls)
+	})
+	t.Run("get", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		c := NewClient(&failingGetAPI{fakeWAFV2API: fake, errs: []error{throttle, unavailable}}, fastRetry...)
+		assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.2"))
+		assert.Equal(t, 1, fake.UpdateCalls)
+
+		// the operations only reading the IP set retry too
+		c = NewClient(&failingGetAPI{fakeWAFV2API: fake, errs: []error{throttle, unavailable}}, fastRetry...)
+		addresses, err := c.ListAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, addresses)
+
+		// not found fails at once
+		fake.GetCalls = 0
+		_, err = c.ListAddresses(ctx, "no-such-id", ipSetName)
+		assert.ErrorIs(t, err, ErrIPSetNotFound)
+		assert.Equal(t, 1, fake.GetCalls)
+	})
+	t.Run("custom retryable errors", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		custom := errors.New("custom")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{custom, throttle}}
+		c := NewClient(api, append(fastRetry, WithRetryableErrors(func(err error) bool {
+			return errors.Is(err, custom)
+		}))...)
+		err := c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, throttle)
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+}
+
+func TestDuplicateAddressError(t *testing.T) {
+	ctx := context.Background()
+	duplicate := &wafv2.WAFInvalidParameterException{Message_: aws.String("Error reason: Duplicate value found., field: IP_ADDRESS")}
+	t.Run("appended without the dedupe check", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{duplicate}}
+		err := NewClient(api).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1", WithoutDedupeCheck())
+		assert.NoError(t, err)
+		assert.Equal(t, 2, fake.GetCalls)
+		assert.Equal(t, 0, fake.UpdateCalls)
+	})
+	t.Run("missing cidrs are appended", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{duplicate}}
+		assert.NoError(t, NewClient(api).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, []string{"192.0.2.1/32"}, fake.addresses(ScopeRegional, aws.StringValue(ipSet.Id)))
+	})
+	t.Run("handled once", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{duplicate, duplicate, duplicate}}
+		err := NewClient(api).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, duplicate)
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("other invalid parameters", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		invalid := &wafv2.WAFInvalidParameterException{Message_: aws.String("Error reason: The parameter contains formatting that is not valid., field: IP_ADDRESS")}
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{invalid}}
+		err := NewClient(api).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, invalid)
+		assert.Equal(t, 1, fake.GetCalls)
+	})
+	t.Run("counted in the same attempt", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{duplicate}}
+		m := &recordMetrics{}
+		assert.NoError(t, NewClient(api, WithMetrics(m)).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, []observation{{op: "append", attempts: 1}}, m.observations)
+	})
+	t.Run("reason and field", func(t *testing.T) {
+		tests := []struct {
+			name string
+			err  error
+			want bool
+		}{
+			{name: "duplicate address", err: &wafv2.WAFInvalidParameterException{Field: aws.String("IP_ADDRESS"), Reason: aws.String("Duplicate value found.")}, want: true},
+			{name: "other field", err: &wafv2.WAFInvalidParameterException{Field: aws.String("TAGS"), Reason: aws.String("Duplicate value found.")}},
+			{name: "other reason", err: &wafv2.WAFInvalidParameterException{Field: aws.String("IP_ADDRESS"), Reason: aws.String("Not valid.")}},
+			{name: "message only", err: duplicate, want: true},
+			{name: "message of another field", err: &wafv2.WAFInvalidParameterException{Message_: aws.String("Error reason: Duplicate value found., field: TAGS")}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, isDuplicateAddressError(fmt.Errorf("ipset: update ip set: %w", tt.err)))
+			})
+		}
+	})
+	t.Run("not handled on remove", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		api := &failingUpdateAPI{fakeWAFV2API: fake, errs: []error{duplicate}}
+		err := NewClient(api).RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1")
+		assert.ErrorIs(t, err, duplicate)
+		assert.Equal(t, 1, fake.GetCalls)
+	})
+}
+
+func TestIsRetryable(t *testing.T) {
+	conflict := &wafv2.WAFOptimisticLockException{Message_: aws.String("stale lock token")}
+	tests := []struct {
+		name           string
+		err            error
+		retryable      bool
+		optimisticLock bool
+	}{
+		{name: "optimistic lock", err: fmt.Errorf("ipset: update ip set: %w", conflict), retryable: true, optimisticLock: true},
+		{name: "throttling", err: awserr.New("ThrottlingException", "rate exceeded", nil), retryable: true},
+		{name: "server error", err: awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request-id"), retryable: true},
+		{name: "internal error", err: &wafv2.WAFInternalErrorException{}, retryable: true},
+		{name: "not found", err: &wafv2.WAFNonexistentItemException{}},
+		{name: "invalid cidr", err: &InvalidCIDRError{CIDRs: []string{"x"}}},
+		{name: "nil", err: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.retryable, IsRetryable(tt.err))
+			assert.Equal(t, tt.optimisticLock, IsOptimisticLock(tt.err))
+		})
+	}
+}
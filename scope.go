@@ -0,0 +1,59 @@
+package ipset
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+// Scope specifies whether the IP set is for a regional application or for an Amazon CloudFront distribution
+type Scope string
+
+const (
+	// ScopeRegional is the scope for regional applications (ALB, API Gateway, AppSync, ...)
+	ScopeRegional Scope = wafv2.ScopeRegional
+	// ScopeCloudFront is the scope for Amazon CloudFront distributions.
+	// The WAFv2 client must be configured for the us-east-1 region
+	ScopeCloudFront Scope = wafv2.ScopeCloudfront
+)
+
+// String returns the value of the scope in the WAF API (REGIONAL or CLOUDFRONT)
+func (s Scope) String() string {
+	return string(s)
+}
+
+// ParseScope parses the WAF API value of a scope case-insensitively, e.g. from a config file or a flag
+func ParseScope(s string) (Scope, error) {
+	scope := Scope(strings.ToUpper(s))
+	if err := scope.validate(); err != nil {
+		return "", fmt.Errorf("ipset: invalid scope %q", s)
+	}
+	return scope, nil
+}
+
+func (s Scope) validate() error {
+	switch s {
+	case ScopeRegional, ScopeCloudFront:
+		return nil
+	}
+	return fmt.Errorf("ipset: invalid scope %q", string(s))
+}
+
+// IPAddressVersion is the IP address version of an IP set
+type IPAddressVersion string
+
+const (
+	// IPv4 is the IP address version of IP sets for IPv4 addresses
+	IPv4 IPAddressVersion = wafv2.IPAddressVersionIpv4
+	// IPv6 is the IP address version of IP sets for IPv6 addresses
+	IPv6 IPAddressVersion = wafv2.IPAddressVersionIpv6
+)
+
+func (v IPAddressVersion) validate() error {
+	switch v {
+	case IPv4, IPv6:
+		return nil
+	}
+	return fmt.Errorf("ipset: invalid ip address version %q", string(v))
+}
@@ -0,0 +1,36 @@
+package ipset
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Scope
+	}{
+		{in: "REGIONAL", want: ScopeRegional},
+		{in: "CLOUDFRONT", want: ScopeCloudFront},
+		{in: "cloudfront", want: ScopeCloudFront},
+		{in: "Regional", want: ScopeRegional},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseScope(tt.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseScope("global")
+		assert.EqualError(t, err, `ipset: invalid scope "global"`)
+	})
+}
+
+func TestScope_String(t *testing.T) {
+	assert.Equal(t, "REGIONAL", ScopeRegional.String())
+	assert.Equal(t, "CLOUDFRONT", fmt.Sprint(ScopeCloudFront))
+}
@@ -0,0 +1,220 @@
+// Package sdkv2 makes the ipset.Client usable with the WAFV2 client of aws-sdk-go-v2.
+// The calls go through aws-sdk-go-v2, but the module still depends on aws-sdk-go since ipset.Client is built on its types
+package sdkv2
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v1 "github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	ipset "github.com/kei2100/idempotent-aws-waf-ipset"
+)
+
+// API is the subset of the aws-sdk-go-v2 WAFV2 client used by ipset. *wafv2.Client implements it
+type API interface {
+	GetIPSet(ctx context.Context, params *wafv2.GetIPSetInput, optFns ...func(*wafv2.Options)) (*wafv2.GetIPSetOutput, error)
+	UpdateIPSet(ctx context.Context, params *wafv2.UpdateIPSetInput, optFns ...func(*wafv2.Options)) (*wafv2.UpdateIPSetOutput, error)
+	ListIPSets(ctx context.Context, params *wafv2.ListIPSetsInput, optFns ...func(*wafv2.Options)) (*wafv2.ListIPSetsOutput, error)
+	CreateIPSet(ctx context.Context, params *wafv2.CreateIPSetInput, optFns ...func(*wafv2.Options)) (*wafv2.CreateIPSetOutput, error)
+	DeleteIPSet(ctx context.Context, params *wafv2.DeleteIPSetInput, optFns ...func(*wafv2.Options)) (*wafv2.DeleteIPSetOutput, error)
+}
+
+// NewClient creates an ipset.Client that uses the aws-sdk-go-v2 WAFV2 client created from cfg
+func NewClient(cfg aws.Config, opts ...ipset.Option) *ipset.Client {
+	return ipset.NewClient(NewAPI(wafv2.NewFromConfig(cfg)), opts...)
+}
+
+// NewAPI adapts api to the aws-sdk-go WAFV2API used by ipset.NewClient.
+// Only the operations used by ipset are implemented, and request.Options of aws-sdk-go are ignored.
+// The errors of api are converted to the aws-sdk-go errors of the same code (e.g. *wafv2.WAFOptimisticLockException),
+// and the original errors are still available to errors.As
+func NewAPI(api API) wafv2iface.WAFV2API {
+	return &adapter{api: api}
+}
+
+type adapter struct {
+	wafv2iface.WAFV2API
+	api API
+}
+
+func (a *adapter) GetIPSetWithContext(ctx context.Context, in *v1.GetIPSetInput, _ ...request.Option) (*v1.GetIPSetOutput, error) {
+	out, err := a.api.GetIPSet(ctx, &wafv2.GetIPSetInput{
+		Id:    in.Id,
+		Name:  in.Name,
+		Scope: types.Scope(aws.ToString(in.Scope)),
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	res := &v1.GetIPSetOutput{LockToken: out.LockToken}
+	if out.IPSet != nil {
+		res.IPSet = &v1.IPSet{
+			ARN:              out.IPSet.ARN,
+			Addresses:        toPointers(out.IPSet.Addresses),
+			Description:      out.IPSet.Description,
+			IPAddressVersion: aws.String(string(out.IPSet.IPAddressVersion)),
+			Id:               out.IPSet.Id,
+			Name:             out.IPSet.Name,
+		}
+	}
+	return res, nil
+}
+
+func (a *adapter) UpdateIPSetWithContext(ctx context.Context, in *v1.UpdateIPSetInput, _ ...request.Option) (*v1.UpdateIPSetOutput, error) {
+	out, err := a.api.UpdateIPSet(ctx, &wafv2.UpdateIPSetInput{
+		Addresses:   toValues(in.Addresses),
+		Description: in.Description,
+		Id:          in.Id,
+		LockToken:   in.LockToken,
+		Name:        in.Name,
+		Scope:       types.Scope(aws.ToString(in.Scope)),
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &v1.UpdateIPSetOutput{NextLockToken: out.NextLockToken}, nil
+}
+
+func (a *adapter) ListIPSetsWithContext(ctx context.Context, in *v1.ListIPSetsInput, _ ...request.Option) (*v1.ListIPSetsOutput, error) {
+	params := &wafv2.ListIPSetsInput{
+		NextMarker: in.NextMarker,
+		Scope:      types.Scope(aws.ToString(in.Scope)),
+	}
+	if in.Limit != nil {
+		params.Limit = aws.Int32(int32(*in.Limit))
+	}
+	out, err := a.api.ListIPSets(ctx, params)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	res := &v1.ListIPSetsOutput{NextMarker: out.NextMarker}
+	for _, s := range out.IPSets {
+		res.IPSets = append(res.IPSets, &v1.IPSetSummary{
+			ARN:         s.ARN,
+			Description: s.Description,
+			Id:          s.Id,
+			LockToken:   s.LockToken,
+			Name:        s.Name,
+		})
+	}
+	return res, nil
+}
+
+func (a *adapter) CreateIPSetWithContext(ctx context.Context, in *v1.CreateIPSetInput, _ ...request.Option) (*v1.CreateIPSetOutput, error) {
+	params := &wafv2.CreateIPSetInput{
+		Addresses:        toValues(in.Addresses),
+		Description:      in.Description,
+		IPAddressVersion: types.IPAddressVersion(aws.ToString(in.IPAddressVersion)),
+		Name:             in.Name,
+		Scope:            types.Scope(aws.ToString(in.Scope)),
+	}
+	for _, t := range in.Tags {
+		params.Tags = append(params.Tags, types.Tag{Key: t.Key, Value: t.Value})
+	}
+	out, err := a.api.CreateIPSet(ctx, params)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	res := &v1.CreateIPSetOutput{}
+	if s := out.Summary; s != nil {
+		res.Summary = &v1.IPSetSummary{
+			ARN:         s.ARN,
+			Description: s.Description,
+			Id:          s.Id,
+			LockToken:   s.LockToken,
+			Name:        s.Name,
+		}
+	}
+	return res, nil
+}
+
+func (a *adapter) DeleteIPSetWithContext(ctx context.Context, in *v1.DeleteIPSetInput, _ ...request.Option) (*v1.DeleteIPSetOutput, error) {
+	_, err := a.api.DeleteIPSet(ctx, &wafv2.DeleteIPSetInput{
+		Id:        in.Id,
+		LockToken: in.LockToken,
+		Name:      in.Name,
+		Scope:     types.Scope(aws.ToString(in.Scope)),
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &v1.DeleteIPSetOutput{}, nil
+}
+
+// convertError converts err of aws-sdk-go-v2 to the aws-sdk-go error of the same code
+func convertError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	msg := aws.String(apiErr.ErrorMessage())
+	var converted error
+	switch apiErr.ErrorCode() {
+	case v1.ErrCodeWAFOptimisticLockException:
+		converted = &v1.WAFOptimisticLockException{Message_: msg}
+	case v1.ErrCodeWAFNonexistentItemException:
+		converted = &v1.WAFNonexistentItemException{Message_: msg}
+	case v1.ErrCodeWAFDuplicateItemException:
+		converted = &v1.WAFDuplicateItemException{Message_: msg}
+	case v1.ErrCodeWAFLimitsExceededException:
+		converted = &v1.WAFLimitsExceededException{Message_: msg}
+	case v1.ErrCodeWAFInvalidParameterException:
+		converted = &v1.WAFInvalidParameterException{Message_: msg}
+	case v1.ErrCodeWAFInternalErrorException:
+		converted = &v1.WAFInternalErrorException{Message_: msg}
+	case v1.ErrCodeWAFUnavailableEntityException:
+		converted = &v1.WAFUnavailableEntityException{Message_: msg}
+	default:
+		generic := awserr.New(apiErr.ErrorCode(), apiErr.ErrorMessage(), nil)
+		converted = generic
+		// keep the HTTP status so that ipset retries the 5xx responses as for aws-sdk-go
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) {
+			var requestID string
+			var withID interface{ ServiceRequestID() string }
+			if errors.As(err, &withID) {
+				requestID = withID.ServiceRequestID()
+			}
+			converted = awserr.NewRequestFailure(generic, respErr.HTTPStatusCode(), requestID)
+		}
+	}
+	return &convertedError{converted: converted, err: err}
+}
+
+type convertedError struct {
+	converted error
+	err       error
+}
+
+func (e *convertedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *convertedError) Unwrap() []error {
+	return []error{e.converted, e.err}
+}
+
+func toPointers(ss []string) []*string {
+	ps := make([]*string, len(ss))
+	for i := range ss {
+		ps[i] = aws.String(ss[i])
+	}
+	return ps
+}
+
+func toValues(ps []*string) []string {
+	ss := make([]string, len(ps))
+	for i, p := range ps {
+		ss[i] = aws.ToString(p)
+	}
+	return ss
+}
@@ -0,0 +1,147 @@
+package sdkv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+
+	ipset "github.com/kei2100/idempotent-aws-waf-ipset"
+)
+
+// fakeAPI is an in-memory API holding a single ip set
+type fakeAPI struct {
+	ipSet       types.IPSet
+	lockToken   int
+	conflicts   int
+	failures    []error
+	updateCalls int
+	created     *wafv2.CreateIPSetInput
+	deleted     bool
+}
+
+func (f *fakeAPI) GetIPSet(_ context.Context, in *wafv2.GetIPSetInput, _ ...func(*wafv2.Options)) (*wafv2.GetIPSetOutput, error) {
+	if aws.ToString(in.Id) != aws.ToString(f.ipSet.Id) || in.Scope != types.ScopeRegional {
+		return nil, &smithyOperationError{err: &types.WAFNonexistentItemException{Message: aws.String("not found")}}
+	}
+	ipSet := f.ipSet
+	ipSet.Addresses = append([]string{}, f.ipSet.Addresses...)
+	return &wafv2.GetIPSetOutput{IPSet: &ipSet, LockToken: aws.String(fmt.Sprint(f.lockToken))}, nil
+}
+
+func (f *fakeAPI) UpdateIPSet(_ context.Context, in *wafv2.UpdateIPSetInput, _ ...func(*wafv2.Options)) (*wafv2.UpdateIPSetOutput, error) {
+	f.updateCalls++
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		return nil, err
+	}
+	if f.conflicts > 0 {
+		f.conflicts--
+		f.lockToken++
+	}
+	if aws.ToString(in.LockToken) != fmt.Sprint(f.lockToken) {
+		return nil, &smithyOperationError{err: &types.WAFOptimisticLockException{Message: aws.String("stale")}}
+	}
+	f.lockToken++
+	f.ipSet.Addresses = in.Addresses
+	return &wafv2.UpdateIPSetOutput{NextLockToken: aws.String(fmt.Sprint(f.lockToken))}, nil
+}
+
+func (f *fakeAPI) ListIPSets(_ context.Context, in *wafv2.ListIPSetsInput, _ ...func(*wafv2.Options)) (*wafv2.ListIPSetsOutput, error) {
+	return &wafv2.ListIPSetsOutput{IPSets: []types.IPSetSummary{{Id: f.ipSet.Id, Name: f.ipSet.Name}}}, nil
+}
+
+func (f *fakeAPI) CreateIPSet(_ context.Context, in *wafv2.CreateIPSetInput, _ ...func(*wafv2.Options)) (*wafv2.CreateIPSetOutput, error) {
+	if aws.ToString(in.Name) == aws.ToString(f.ipSet.Name) {
+		return nil, &smithyOperationError{err: &types.WAFDuplicateItemException{Message: aws.String("duplicate")}}
+	}
+	f.created = in
+	return &wafv2.CreateIPSetOutput{Summary: &types.IPSetSummary{Id: aws.String("created-id"), Name: in.Name}}, nil
+}
+
+func (f *fakeAPI) DeleteIPSet(_ context.Context, in *wafv2.DeleteIPSetInput, _ ...func(*wafv2.Options)) (*wafv2.DeleteIPSetOutput, error) {
+	if aws.ToString(in.LockToken) != fmt.Sprint(f.lockToken) {
+		return nil, &smithyOperationError{err: &types.WAFOptimisticLockException{Message: aws.String("stale")}}
+	}
+	f.deleted = true
+	return &wafv2.DeleteIPSetOutput{}, nil
+}
+
+// smithyOperationError wraps err like the operation errors of aws-sdk-go-v2
+type smithyOperationError struct {
+	err error
+}
+
+func (e *smithyOperationError) Error() string { return "operation error WAFV2: " + e.err.Error() }
+func (e *smithyOperationError) Unwrap() error { return e.err }
+
+func TestNewAPI(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeAPI{ipSet: types.IPSet{
+		Id:               aws.String("id"),
+		Name:             aws.String("test-ip-set"),
+		IPAddressVersion: types.IPAddressVersionIpv4,
+		Addresses:        []string{"192.0.2.1/32"},
+	}}
+	c := ipset.NewClient(NewAPI(fake))
+	t.Run("retry on optimistic lock error", func(t *testing.T) {
+		fake.conflicts = 1
+		assert.NoError(t, c.AppendToIPSet(ctx, "id", "test-ip-set", "192.0.2.2"))
+		assert.Equal(t, []string{"192.0.2.1/32", "192.0.2.2/32"}, fake.ipSet.Addresses)
+		assert.Equal(t, 2, fake.updateCalls)
+	})
+	t.Run("retry on 5xx responses", func(t *testing.T) {
+		unavailable := &smithyOperationError{err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+				Err:      &smithy.GenericAPIError{Code: "ServiceUnavailable", Message: "unavailable"},
+			},
+			RequestID: "request-id",
+		}}
+		var reqErr awserr.RequestFailure
+		if assert.True(t, errors.As(convertError(unavailable), &reqErr)) {
+			assert.Equal(t, http.StatusServiceUnavailable, reqErr.StatusCode())
+			assert.Equal(t, "request-id", reqErr.RequestID())
+			assert.Equal(t, "ServiceUnavailable", reqErr.Code())
+		}
+		assert.True(t, ipset.IsRetryable(convertError(unavailable)))
+
+		fake.failures = []error{unavailable}
+		calls := fake.updateCalls
+		assert.NoError(t, c.AppendToIPSet(ctx, "id", "test-ip-set", "192.0.2.3", ipset.WithBackoff(ipset.ConstantBackoff(0, 0))))
+		assert.Equal(t, calls+2, fake.updateCalls)
+	})
+	t.Run("find ip set by name", func(t *testing.T) {
+		id, err := c.FindIPSetIDByName(ctx, "test-ip-set", ipset.ScopeRegional)
+		assert.NoError(t, err)
+		assert.Equal(t, "id", id)
+	})
+	t.Run("ensure ip set", func(t *testing.T) {
+		id, err := c.EnsureIPSet(ctx, "new-ip-set", ipset.ScopeRegional, ipset.IPv6, map[string]string{"team": "sre"})
+		assert.NoError(t, err)
+		assert.Equal(t, "created-id", id)
+		assert.Equal(t, types.IPAddressVersionIpv6, fake.created.IPAddressVersion)
+		assert.Equal(t, []types.Tag{{Key: aws.String("team"), Value: aws.String("sre")}}, fake.created.Tags)
+	})
+	t.Run("delete ip set", func(t *testing.T) {
+		assert.NoError(t, c.DeleteIPSet(ctx, "id", "test-ip-set", ipset.ScopeRegional))
+		assert.True(t, fake.deleted)
+	})
+	t.Run("ip set not found", func(t *testing.T) {
+		err := c.AppendToIPSet(ctx, "id", "test-ip-set", "192.0.2.2", ipset.WithScope(ipset.ScopeCloudFront))
+		assert.ErrorIs(t, err, ipset.ErrIPSetNotFound)
+		var notFound *types.WAFNonexistentItemException
+		assert.True(t, errors.As(err, &notFound))
+	})
+}
@@ -1,22 +1,87 @@
 package ipset
 
 import (
-	"log"
+	"fmt"
+	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 )
 
-// Session is an AWS session
+// CloudFrontRegion is the AWS region where the IP sets of ScopeCloudFront are managed
+const CloudFrontRegion = "us-east-1"
+
+// Session is an AWS session used by the package-level functions.
+// Unless it is set beforehand, it is created by NewSession() on first use
 var Session *session.Session
 
-func init() {
-	var err error
-	Session, err = session.NewSessionWithOptions(
-		session.Options{
-			SharedConfigState: session.SharedConfigEnable,
-		},
-	)
+var (
+	sessionOnce sync.Once
+	sessionErr  error
+)
+
+// SessionOption configures the session created by NewSession
+type SessionOption func(*session.Options)
+
+// WithRegion sets the AWS region of the session.
+// The package-level functions use CloudFrontRegion for ScopeCloudFront regardless of the region
+func WithRegion(region string) SessionOption {
+	return func(o *session.Options) {
+		o.Config.Region = aws.String(region)
+	}
+}
+
+// WithEndpoint sets the endpoint URL of the AWS services, e.g. http://localhost:4566 of LocalStack
+func WithEndpoint(url string) SessionOption {
+	return func(o *session.Options) {
+		o.Config.Endpoint = aws.String(url)
+	}
+}
+
+// WithDisableSSL makes the session use HTTP instead of HTTPS for an endpoint without a scheme
+func WithDisableSSL() SessionOption {
+	return func(o *session.Options) {
+		o.Config.DisableSSL = aws.Bool(true)
+	}
+}
+
+// NewSession creates a new AWS session with the shared config enabled
+func NewSession(opts ...SessionOption) (*session.Session, error) {
+	so := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	for _, opt := range opts {
+		opt(&so)
+	}
+	sess, err := session.NewSessionWithOptions(so)
 	if err != nil {
-		log.Fatalf("main: new aws session: %+v", err)
+		return nil, fmt.Errorf("ipset: new aws session: %w", err)
 	}
+	return sess, nil
+}
+
+// cloudFrontSession returns sess, or a copy of sess of CloudFrontRegion if sess is of another region
+func cloudFrontSession(sess *session.Session) *session.Session {
+	if aws.StringValue(sess.Config.Region) == CloudFrontRegion {
+		return sess
+	}
+	return sess.Copy(&aws.Config{Region: aws.String(CloudFrontRegion)})
+}
+
+// defaultSession returns the Session, creating it on first use
+func defaultSession() (*session.Session, error) {
+	sessionOnce.Do(func() {
+		if Session != nil {
+			return
+		}
+		Session, sessionErr = NewSession()
+	})
+	return Session, sessionErr
+}
+
+// SessionError returns the error that occurred while creating the Session on first use, if any.
+// The package-level functions also return this error
+func SessionError() error {
+	_, err := defaultSession()
+	return err
 }
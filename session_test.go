@@ -0,0 +1,107 @@
+package ipset
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSession(t *testing.T) {
+	sess, err := NewSession(WithRegion("us-east-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-1", aws.StringValue(sess.Config.Region))
+}
+
+func TestWithEndpoint(t *testing.T) {
+	// the endpoint responds WAFOptimisticLockException to the first update
+	var updates int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AWSWAF_20190729.") {
+		case "GetIPSet":
+			fmt.Fprintf(w, `{"IPSet":{"Id":"id","Name":%q,"IPAddressVersion":"IPV4","Addresses":[]},"LockToken":"token-%d"}`, ipSetName, updates)
+		case "UpdateIPSet":
+			updates++
+			if updates == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"WAFOptimisticLockException","Message":"stale lock token"}`)
+				return
+			}
+			fmt.Fprint(w, `{"NextLockToken":"next"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	sess, err := NewSession(WithRegion("us-east-1"), WithEndpoint(strings.TrimPrefix(srv.URL, "http://")), WithDisableSSL())
+	assert.NoError(t, err)
+	c := NewClient(wafv2.New(sess), WithBackoff(ConstantBackoff(0, 0)))
+	assert.NoError(t, c.AppendToIPSet(context.Background(), "id", ipSetName, "192.0.2.1"))
+	assert.Equal(t, 2, updates)
+}
+
+// TestLocalStack runs against the WAFV2 of LocalStack when LOCALSTACK_ENDPOINT (e.g. http://localhost:4566) is set
+func TestLocalStack(t *testing.T) {
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LOCALSTACK_ENDPOINT is not set")
+	}
+	ctx := context.Background()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	sess, err := NewSession(WithRegion("us-east-1"), WithEndpoint(endpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(wafv2.New(sess))
+	id, err := c.EnsureIPSet(ctx, ipSetName, ScopeRegional, IPv4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.DeleteIPSet(ctx, id, ipSetName, ScopeRegional)
+	})
+	assert.NoError(t, c.ClearIPSet(ctx, id, ipSetName))
+	// concurrent writers compete for the lock token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, c.AppendToIPSet(ctx, id, ipSetName, fmt.Sprintf("192.0.2.%d", i), WithRetryConfig(RetryConfig{MaxAttempts: 20})))
+		}(i)
+	}
+	wg.Wait()
+	addresses, err := c.ListAddresses(ctx, id, ipSetName)
+	assert.NoError(t, err)
+	assert.Len(t, addresses, 10)
+}
+
+func TestSessionError(t *testing.T) {
+	resetSession := func() {
+		Session = nil
+		sessionOnce = sync.Once{}
+		sessionErr = nil
+	}
+	resetSession()
+	t.Cleanup(resetSession)
+	// an invalid environment variable makes the session creation fail
+	t.Setenv("AWS_STS_REGIONAL_ENDPOINTS", "invalid")
+
+	assert.Error(t, SessionError())
+	err := AppendToIPSet(context.Background(), "id", ipSetName, "192.0.2.44/32")
+	assert.ErrorContains(t, err, "ipset: new aws session")
+	assert.Equal(t, SessionError(), err)
+}
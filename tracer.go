@@ -0,0 +1,52 @@
+package ipset
+
+import "context"
+
+// Tracer starts the spans of the operations updating IP sets, of their attempts and of their calls of the WAFV2 API.
+// It can be implemented with OpenTelemetry, for example, without making this package depend on it
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, and returns a context holding the new span
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by Tracer
+type Span interface {
+	// AddEvent records an event on the span, such as a retry on WAFOptimisticLockException
+	AddEvent(name string, attrs ...Attribute)
+	// End ends the span with the result of what the span covers
+	End(err error)
+}
+
+// Attribute is an attribute of a span or an event
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) AddEvent(string, ...Attribute) {}
+
+func (nopSpan) End(error) {}
+
+type spanKey struct{}
+
+// startSpan starts a span by the tracer of o and keeps it in the returned context for spanFromContext
+func startSpan(ctx context.Context, o *options, name string, attrs ...Attribute) (context.Context, Span) {
+	ctx, span := o.tracer.Start(ctx, name, attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the span started by startSpan, or a span doing nothing
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{}
+}
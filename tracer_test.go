@@ -0,0 +1,89 @@
+package ipset
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordSpan struct {
+	name   string
+	parent string
+	attrs  []Attribute
+	events []string
+	ended  bool
+	err    error
+}
+
+func (s *recordSpan) AddEvent(name string, _ ...Attribute) {
+	s.events = append(s.events, name)
+}
+
+func (s *recordSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type recordSpanKey struct{}
+
+type recordTracer struct {
+	spans []*recordSpan
+}
+
+func (t *recordTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &recordSpan{name: name, attrs: attrs}
+	if parent, ok := ctx.Value(recordSpanKey{}).(*recordSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, recordSpanKey{}, span), span
+}
+
+func TestWithTracer(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWAFV2API()
+	ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+	fake.BeforeUpdate = fake.ConcurrentWrite(1)
+	tracer := &recordTracer{}
+	c := NewClient(fake, WithTracer(tracer), WithRetryConfig(RetryConfig{MaxAttempts: 4}))
+	assert.NoError(t, c.AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.45/32"))
+
+	var names, parents []string
+	for _, s := range tracer.spans {
+		names = append(names, s.name)
+		parents = append(parents, s.parent)
+		assert.True(t, s.ended, s.name)
+	}
+	assert.Equal(t, []string{
+		"ipset.append",
+		"ipset.attempt", "WAFV2.GetIPSet", "WAFV2.UpdateIPSet",
+		"ipset.attempt", "WAFV2.GetIPSet", "WAFV2.UpdateIPSet",
+	}, names)
+	assert.Equal(t, []string{
+		"",
+		"ipset.append", "ipset.attempt", "ipset.attempt",
+		"ipset.append", "ipset.attempt", "ipset.attempt",
+	}, parents)
+
+	op := tracer.spans[0]
+	assert.Contains(t, op.attrs, Attribute{Key: "ipset.id", Value: aws.StringValue(ipSet.Id)})
+	assert.Contains(t, op.attrs, Attribute{Key: "ipset.scope", Value: string(ScopeRegional)})
+	assert.Equal(t, []string{"retry"}, op.events)
+	assert.NoError(t, op.err)
+	assert.Error(t, tracer.spans[3].err, "the first update fails with WAFOptimisticLockException")
+	assert.Equal(t, Attribute{Key: "attempt", Value: 2}, tracer.spans[4].attrs[0])
+
+	t.Run("operations without options", func(t *testing.T) {
+		tracer.spans = nil
+		_, err := c.FindIPSetIDByName(ctx, ipSetName, ScopeRegional)
+		assert.NoError(t, err)
+		assert.NoError(t, c.DeleteIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, ScopeRegional))
+		var names []string
+		for _, s := range tracer.spans {
+			names = append(names, s.name)
+		}
+		assert.Equal(t, []string{"WAFV2.ListIPSets", "WAFV2.GetIPSet", "WAFV2.DeleteIPSet"}, names)
+	})
+}
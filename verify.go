@@ -0,0 +1,48 @@
+package ipset
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
+)
+
+// verifyDelays are the delays before the reads of WithVerify after the first one,
+// which wait for the update to be visible because WAF is eventually consistent
+var verifyDelays = []time.Duration{200 * time.Millisecond, 500 * time.Millisecond}
+
+// verifyChange reads the IP set until it has the added addresses and none of the removed addresses of change,
+// and returns a *VerificationError if the last read still does not reflect change
+func verifyChange(ctx context.Context, api wafv2iface.WAFV2API, o *options, ipSetID, ipSetName string, change *Change) error {
+	// each read must reach WAF, and a stale read must not be cached for the other operations
+	uncached := *o
+	uncached.getCacheTTL = 0
+	var verr *VerificationError
+	for i := 0; ; i++ {
+		current, err := getIPSet(ctx, api, &uncached, ipSetID, ipSetName)
+		if err != nil {
+			return err
+		}
+		addresses := addressSet(canonicalAddresses(current.IPSet.Addresses))
+		verr = &VerificationError{}
+		for _, a := range change.Added {
+			if _, ok := addresses[a]; !ok {
+				verr.Missing = append(verr.Missing, a)
+			}
+		}
+		for _, r := range change.Removed {
+			if _, ok := addresses[r]; ok {
+				verr.Unexpected = append(verr.Unexpected, r)
+			}
+		}
+		if len(verr.Missing) == 0 && len(verr.Unexpected) == 0 {
+			return nil
+		}
+		if i >= len(verifyDelays) {
+			return verr
+		}
+		if err := sleep(ctx, verifyDelays[i]); err != nil {
+			return err
+		}
+	}
+}
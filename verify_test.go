@@ -0,0 +1,88 @@
+package ipset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/stretchr/testify/assert"
+)
+
+// laggingAPI makes the updates visible to GetIPSet only after lag reads, as the eventual consistency of WAF
+type laggingAPI struct {
+	*fakeWAFV2API
+	lag     int
+	pending *wafv2.UpdateIPSetInput
+}
+
+func (a *laggingAPI) GetIPSetWithContext(ctx aws.Context, in *wafv2.GetIPSetInput, opts ...request.Option) (*wafv2.GetIPSetOutput, error) {
+	if a.pending != nil {
+		if a.lag > 0 {
+			a.lag--
+		} else {
+			if _, err := a.fakeWAFV2API.UpdateIPSetWithContext(ctx, a.pending, opts...); err != nil {
+				return nil, err
+			}
+			a.pending = nil
+		}
+	}
+	return a.fakeWAFV2API.GetIPSetWithContext(ctx, in, opts...)
+}
+
+func (a *laggingAPI) UpdateIPSetWithContext(_ aws.Context, in *wafv2.UpdateIPSetInput, _ ...request.Option) (*wafv2.UpdateIPSetOutput, error) {
+	a.pending = in
+	return &wafv2.UpdateIPSetOutput{NextLockToken: aws.String("next")}, nil
+}
+
+func TestWithVerify(t *testing.T) {
+	ctx := context.Background()
+	delays := verifyDelays
+	verifyDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	t.Cleanup(func() {
+		verifyDelays = delays
+	})
+	t.Run("append", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4")
+		assert.NoError(t, NewClient(fake, WithVerify()).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 2, fake.GetCalls)
+	})
+	t.Run("eventually consistent", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		api := &laggingAPI{fakeWAFV2API: fake, lag: 2}
+		assert.NoError(t, NewClient(api, WithVerify()).RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 4, fake.GetCalls)
+	})
+	t.Run("get cache", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		api := &laggingAPI{fakeWAFV2API: fake, lag: 1}
+		c := NewClient(api, WithVerify(), WithGetCacheTTL(time.Minute))
+		assert.NoError(t, c.RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 3, fake.GetCalls)
+		// the reads of the verification are not cached
+		addresses, err := c.ListAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName)
+		assert.NoError(t, err)
+		assert.Empty(t, addresses)
+		assert.Equal(t, 4, fake.GetCalls)
+	})
+	t.Run("lost update", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		api := &laggingAPI{fakeWAFV2API: fake, lag: 100}
+		_, err := NewClient(api, WithVerify()).SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.2"})
+		assert.ErrorIs(t, err, ErrVerificationFailed)
+		assert.EqualError(t, err, "ipset: verification failed: missing 192.0.2.2/32; unexpected 192.0.2.1/32")
+		assert.Equal(t, 1+1+len(verifyDelays), fake.GetCalls)
+	})
+	t.Run("not verified without changes", func(t *testing.T) {
+		fake := newFakeWAFV2API()
+		ipSet := fake.addIPSet(ScopeRegional, ipSetName, "IPV4", "192.0.2.1/32")
+		assert.NoError(t, NewClient(fake, WithVerify()).AppendToIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+		assert.Equal(t, 1, fake.GetCalls)
+	})
+}
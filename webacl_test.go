@@ -0,0 +1,91 @@
+package ipset
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/stretchr/testify/assert"
+)
+
+const webACLName = "test-web-acl"
+
+// TestWebACLReference checks against AWS that updating the addresses of an IP set referenced by a rule of a WebACL
+// leaves the WebACL untouched: UpdateIPSet only replaces the addresses of the IP set, whose ARN does not change
+func TestWebACLReference(t *testing.T) {
+	ctx := context.Background()
+	ipSet := setupIPSet(t)
+	webACL := setupWebACL(t, ipSet)
+	before := getWebACL(t, webACL)
+
+	assert.NoError(t, AppendCIDRs(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"192.0.2.1", "192.0.2.2"}))
+	assert.NoError(t, RemoveFromIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName, "192.0.2.1"))
+	_, err := SetAddresses(ctx, aws.StringValue(ipSet.Id), ipSetName, []string{"198.51.100.0/24"}, WithDescription("blocklist"))
+	assert.NoError(t, err)
+	assert.NoError(t, ClearIPSet(ctx, aws.StringValue(ipSet.Id), ipSetName))
+
+	after := getWebACL(t, webACL)
+	// the WebACL has not been updated, so its lock token and rules are the same
+	assert.Equal(t, aws.StringValue(before.LockToken), aws.StringValue(after.LockToken))
+	assert.Equal(t, before.WebACL.Rules, after.WebACL.Rules)
+	if assert.Len(t, after.WebACL.Rules, 1) {
+		assert.Equal(t, aws.StringValue(ipSet.ARN), aws.StringValue(after.WebACL.Rules[0].Statement.IPSetReferenceStatement.ARN))
+	}
+}
+
+func setupWebACL(t *testing.T, ipSet *wafv2.IPSetSummary) *wafv2.WebACLSummary {
+	t.Helper()
+	api := mustNewWAFv2(t)
+	visibility := func(name string) *wafv2.VisibilityConfig {
+		return &wafv2.VisibilityConfig{
+			CloudWatchMetricsEnabled: aws.Bool(false),
+			MetricName:               aws.String(name),
+			SampledRequestsEnabled:   aws.Bool(false),
+		}
+	}
+	out, err := api.CreateWebACL(&wafv2.CreateWebACLInput{
+		Name:          aws.String(webACLName),
+		Scope:         aws.String("REGIONAL"),
+		DefaultAction: &wafv2.DefaultAction{Allow: &wafv2.AllowAction{}},
+		Rules: []*wafv2.Rule{{
+			Name:     aws.String("block-ip-set"),
+			Priority: aws.Int64(0),
+			Action:   &wafv2.RuleAction{Block: &wafv2.BlockAction{}},
+			Statement: &wafv2.Statement{
+				IPSetReferenceStatement: &wafv2.IPSetReferenceStatement{ARN: ipSet.ARN},
+			},
+			VisibilityConfig: visibility("block-ip-set"),
+		}},
+		VisibilityConfig: visibility(webACLName),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// registered after the cleanup of the IP set, so the WebACL referencing it is deleted first
+	t.Cleanup(func() {
+		current := getWebACL(t, out.Summary)
+		if _, err := api.DeleteWebACL(&wafv2.DeleteWebACLInput{
+			Id:        out.Summary.Id,
+			Name:      out.Summary.Name,
+			Scope:     aws.String("REGIONAL"),
+			LockToken: current.LockToken,
+		}); err != nil {
+			t.Error(err)
+		}
+	})
+	return out.Summary
+}
+
+func getWebACL(t *testing.T, webACL *wafv2.WebACLSummary) *wafv2.GetWebACLOutput {
+	t.Helper()
+	out, err := mustNewWAFv2(t).GetWebACL(&wafv2.GetWebACLInput{
+		Id:    webACL.Id,
+		Name:  webACL.Name,
+		Scope: aws.String("REGIONAL"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}